@@ -1,8 +1,12 @@
 module github.com/dpeckett/screwdb
 
-go 1.21.0
+go 1.23.0
 
-require github.com/stretchr/testify v1.8.4
+require (
+	github.com/stretchr/testify v1.10.0
+	go.opentelemetry.io/otel v1.34.0
+	go.opentelemetry.io/otel/trace v1.34.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
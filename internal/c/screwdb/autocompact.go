@@ -0,0 +1,133 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"syscall"
+	"time"
+)
+
+// AutoCompactPolicy decides when EnableAutoCompact compacts the database.
+type AutoCompactPolicy struct {
+	// Interval is how often the file is checked, and so also the least time
+	// between two compactions.
+	Interval time.Duration
+	// MinReclaimableRatio is the fraction of the pages in the file that must
+	// be reclaimable, as reported by Stat, before it is compacted.
+	MinReclaimableRatio float64
+	// MinFileSize is the size in bytes below which the file is never
+	// compacted.
+	MinFileSize int64
+}
+
+type autoCompactor struct {
+	quit chan struct{}
+	done chan struct{}
+}
+
+// EnableAutoCompact starts a goroutine that checks the file every
+// policy.Interval and compacts it once the policy says enough of it is
+// reclaimable, replacing any policy enabled before. A write transaction that
+// starts while it is compacting fails with ErrTxnConflict, as with Compact. It
+// stops on Close.
+func (db *DB) EnableAutoCompact(policy AutoCompactPolicy) error {
+	if db.bt == nil {
+		return ErrClosed
+	}
+
+	if db.flags&ReadOnly != 0 {
+		return ErrReadOnly
+	}
+
+	if db.path == "" {
+		// As with Compact, the file can't be replaced without its path.
+		return fmt.Errorf("auto compact failed: %w", syscall.EINVAL)
+	}
+
+	if policy.Interval <= 0 {
+		return fmt.Errorf("auto compact interval %v is not positive", policy.Interval)
+	}
+
+	if db.compactor != nil {
+		db.compactor.stop()
+	}
+
+	c := &autoCompactor{quit: make(chan struct{}), done: make(chan struct{})}
+	db.compactor = c
+
+	go c.run(db, policy)
+
+	return nil
+}
+
+func (c *autoCompactor) run(db *DB, policy AutoCompactPolicy) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := db.autoCompact(policy); err != nil && !errors.Is(err, ErrTxnConflict) {
+			slog.Warn("screwdb: auto compaction failed", slog.String("path", db.path), slog.Any("error", err))
+		}
+	}
+}
+
+func (c *autoCompactor) stop() {
+	close(c.quit)
+	<-c.done
+}
+
+// autoCompact compacts the file if the policy says so. It works through db
+// itself rather than a handle of its own, which would share the file lock
+// with db, and so could release it on some systems by closing the file.
+func (db *DB) autoCompact(policy AutoCompactPolicy) error {
+	size, err := db.FileSize()
+	if err != nil {
+		return err
+	}
+
+	if size < policy.MinFileSize {
+		return nil
+	}
+
+	stat, err := db.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.FilePages == 0 || float64(stat.ReclaimablePages)/float64(stat.FilePages) < policy.MinReclaimableRatio {
+		return nil
+	}
+
+	err = db.Compact()
+	if errors.Is(err, syscall.EBUSY) {
+		return ErrTxnConflict
+	}
+
+	return err
+}
@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include <stdlib.h>
+// #include "btree.h"
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Backup writes a copy of the latest revision to a new file at destPath, which
+// can be opened like any other database. It copies the pages of the revision
+// as they are, rather than the keys and values as Dump does, so it is much
+// faster, and leaves out the pages of earlier revisions as Compact does. The
+// revision is read in a transaction of its own, so writes carry on while the
+// backup is taken without changing what it holds. The file is written beside
+// destPath and renamed into place once complete, replacing any file already
+// there.
+func (db *DB) Backup(destPath string) error {
+	cpath := C.CString(destPath)
+	defer C.free(unsafe.Pointer(cpath))
+
+	err := db.View(func(tx *Tx) error {
+		rc, err := C.btree_txn_backup(tx.tx, cpath)
+		if rc != 0 {
+			return fmt.Errorf("backup failed: %w", errnoError(err))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return syncDir(destPath)
+}
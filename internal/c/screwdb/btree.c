@@ -32,6 +32,7 @@
  */
 
 #include <errno.h>
+#include <pthread.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
@@ -51,6 +52,7 @@
 #include "btree.h"
 
 #define PAGESIZE 4096
+#define MAXPAGESIZE (32 * 1024)
 #define BT_MINKEYS 4
 #define BT_MAGIC 0xB3DBB3DB
 #define BT_VERSION 4
@@ -60,6 +62,11 @@
 
 #define F_ISSET(w, f) (((w) & (f)) == (f))
 #define MINIMUM(a, b) ((a) < (b) ? (a) : (b))
+#define ASCII_TOLOWER(c) ((c) >= 'A' && (c) <= 'Z' ? (c) + ('a' - 'A') : (c))
+
+/* Key prefix compression relies on keys being ordered bytewise. */
+#define BT_PREFIXED(bt)                                                        \
+  (!F_ISSET((bt)->flags, BT_CASEFOLD) && (bt)->cmp == NULL)
 
 typedef uint32_t pgno_t;
 typedef uint16_t indx_t;
@@ -138,6 +145,7 @@ struct mpage {                 /* an in-memory cached page */
   pgno_t pgno; /* copy of page->pgno */
   short ref;   /* increased by cursors */
   short dirty; /* 1 if on dirty queue */
+  short frozen; /* savepoint level the page belongs to, 0 if none */
 };
 RB_HEAD(page_cache, mpage);
 SIMPLEQ_HEAD(dirty_queue, mpage);
@@ -175,6 +183,7 @@ struct cursor {
   struct page_stack stack; /* stack of parent pages */
   short initialized;       /* 1 if initialized */
   short eof;               /* 1 if end is reached */
+  short deleted;           /* 1 if the current entry was deleted */
 };
 
 #define METAHASHLEN offsetof(struct bt_meta, hash)
@@ -193,6 +202,20 @@ struct node {
   char data[1];
 } __attribute__((packed));
 
+/* A value reserved on overflow pages, which can't be filled in place. */
+struct reservation {
+  pgno_t pgno;       /* first overflow page */
+  struct btval data; /* filled in by the caller, copied in on commit */
+};
+
+/* The state of a write transaction when a savepoint was taken. */
+struct savepoint {
+  pgno_t root;
+  pgno_t next_pgno;
+  struct bt_meta meta;
+  unsigned int nreserved;
+};
+
 struct btree_txn {
   pgno_t root;                     /* current / new root page */
   pgno_t next_pgno;                /* next unallocated page */
@@ -200,25 +223,53 @@ struct btree_txn {
   struct dirty_queue *dirty_queue; /* modified pages */
 #define BT_TXN_RDONLY 0x01         /* read-only transaction */
 #define BT_TXN_ERROR 0x02          /* an error has occurred */
+#define BT_TXN_COMMITTED 0x04      /* the meta page has been written */
   unsigned int flags;
+  pgno_t meta_pgno;  /* meta page the txn reads from */
+  uint32_t revision; /* revision of that meta page */
+  struct bt_meta meta; /* bt->meta to restore if a write txn aborts */
+  struct reservation *reserved; /* values put with BT_RESERVE */
+  unsigned int nreserved;
+  struct savepoint *savepoints; /* innermost last */
+  unsigned int nsavepoints;
+};
+
+struct btree_cache_pool {
+  size_t size; /* bytes cached by all participating btrees */
+  size_t max;
 };
 
 struct btree {
   int fd;
   char *path;
 #define BT_FIXPADDING 0x01 /* internal */
+#define BT_LOCKED 0x10     /* holds a flock for as long as it is open */
   unsigned int flags;
   struct bt_head head;
   struct bt_meta meta;
+  pgno_t meta_pgno; /* page of the current meta, 0 if none */
   struct page_cache *page_cache;
   struct lru_queue *lru_queue;
   struct btree_txn *txn; /* current write transaction */
   int ref;               /* increased by cursors & txn */
   unsigned int cache_size;
   unsigned int max_cache;
+  struct btree_cache_pool *pool; /* shared cache budget, or NULL */
   off_t size; /* current file size */
+  bt_cmp_func cmp; /* user key order, or NULL */
+  void *cmp_ctx;
+  pthread_mutex_t mu; /* held by every entry point, see BT_ENTER */
 };
 
+/* Every entry point taking a btree holds its lock for the duration of the
+ * call, so that threads can share it, and a reference, so that it outlives
+ * the call even if the last other reference is dropped during it. The lock
+ * is recursive, as entry points call one another.
+ */
+#define BT_ENTER(bt)                                                           \
+  struct btree *entered __attribute__((cleanup(btree_leave))) =               \
+      btree_enter(bt)
+
 #define NODESIZE offsetof(struct node, data)
 
 #define INDXSIZE(k) (NODESIZE + ((k) == NULL ? 0 : (k)->size))
@@ -230,8 +281,9 @@ struct btree {
 #define NODEPGNO(node) ((node)->p.np_pgno)
 #define NODEDSZ(node) ((node)->p.np_dsize)
 
-#define BT_COMMIT_PAGES 64   /* max number of pages to write in one commit */
-#define BT_MAXCACHE_DEF 1024 /* max number of pages to keep in cache  */
+#define BT_COMMIT_PAGES 64    /* max number of pages to write in one commit */
+#define BT_MAXCACHE_DEF 1024  /* max number of pages to keep in cache  */
+#define BT_PROGRESS_PAGES 256 /* pages to copy between compaction progress */
 
 static int btree_read_page(struct btree *bt, pgno_t pgno, struct page *page);
 static struct mpage *btree_get_mpage(struct btree *bt, pgno_t pgno);
@@ -241,13 +293,18 @@ static int btree_search_page_root(struct btree *bt, struct mpage *root,
 static int btree_search_page(struct btree *bt, struct btree_txn *txn,
                              struct btval *key, struct cursor *cursor,
                              int modify, struct mpage **mpp);
+static int btree_root_page(struct btree *bt, struct btree_txn *txn,
+                           int modify, struct mpage **mpp);
 
-static int btree_write_header(struct btree *bt, int fd);
+static int btree_write_header(struct btree *bt, int fd, unsigned int psize);
 static int btree_read_header(struct btree *bt);
 static int btree_is_meta_page(struct page *p);
 static int btree_read_meta(struct btree *bt, pgno_t *p_next);
 static int btree_write_meta(struct btree *bt, pgno_t root, unsigned int flags);
 static void btree_ref(struct btree *bt);
+static struct btree *btree_enter(struct btree *bt);
+static void btree_leave(struct btree **btp);
+static int btree_free(struct btree *bt);
 
 static struct node *btree_search_node(struct btree *bt, struct mpage *mp,
                                       struct btval *key, int *exactp,
@@ -268,10 +325,14 @@ static int btree_move_node(struct btree *bt, struct mpage *src, indx_t srcindx,
 static int btree_merge(struct btree *bt, struct mpage *src, struct mpage *dst);
 static int btree_split(struct btree *bt, struct mpage **mpp,
                        unsigned int *newindxp, struct btval *newkey,
-                       struct btval *newdata, pgno_t newpgno);
+                       struct btval *newdata, pgno_t newpgno,
+                       unsigned int flags);
 static struct mpage *btree_new_page(struct btree *bt, uint32_t flags);
 static int btree_write_overflow_data(struct btree *bt, struct page *p,
                                      struct btval *data);
+static int btree_reserve(struct btree *bt, struct btree_txn *txn,
+                         struct btval *key, struct btval *data);
+static int btree_fill_reserved(struct btree_txn *txn);
 
 static void cursor_pop_page(struct cursor *cursor);
 static struct ppage *cursor_push_page(struct cursor *cursor, struct mpage *mp);
@@ -285,6 +346,12 @@ static int btree_cursor_set(struct cursor *cursor, struct btval *key,
                             struct btval *data, int *exactp);
 static int btree_cursor_first(struct cursor *cursor, struct btval *key,
                               struct btval *data);
+static int btree_cursor_last(struct cursor *cursor, struct btval *key,
+                             struct btval *data);
+static int btree_cursor_prev(struct cursor *cursor, struct btval *key,
+                             struct btval *data);
+static int btree_cursor_current(struct cursor *cursor, struct btval *key,
+                                struct btval *data);
 
 static void bt_reduce_separator(struct btree *bt, struct node *min,
                                 struct btval *sep);
@@ -301,10 +368,19 @@ static size_t bt_leaf_size(struct btree *bt, struct btval *key,
                            struct btval *data);
 static size_t bt_branch_size(struct btree *bt, struct btval *key);
 
+struct compact_progress {
+  bt_progress_func fn;
+  void *ctx;
+  uint64_t copied;
+  uint64_t total;
+};
+
 static pgno_t btree_compact_tree(struct btree *bt, pgno_t pgno,
-                                 struct btree *btc);
+                                 struct btree *btc,
+                                 struct compact_progress *cp);
 
 static int memncmp(const void *s1, size_t n1, const void *s2, size_t n2);
+static int memncasecmp(const void *s1, size_t n1, const void *s2, size_t n2);
 
 static int memncmp(const void *s1, size_t n1, const void *s2, size_t n2) {
   if (n1 < n2 && memcmp(s1, s2, n1) == 0) {
@@ -316,10 +392,60 @@ static int memncmp(const void *s1, size_t n1, const void *s2, size_t n2) {
   return memcmp(s1, s2, n1);
 }
 
+/* Like memncmp, but ignores the case of ASCII letters. */
+static int memncasecmp(const void *s1, size_t n1, const void *s2, size_t n2) {
+  const unsigned char *p1 = s1, *p2 = s2;
+  size_t i, n;
+  int c1, c2;
+
+  n = MINIMUM(n1, n2);
+  for (i = 0; i < n; i++) {
+    c1 = ASCII_TOLOWER(p1[i]);
+    c2 = ASCII_TOLOWER(p2[i]);
+    if (c1 != c2) {
+      return c1 - c2;
+    }
+  }
+
+  if (n1 < n2) {
+    return -1;
+  } else if (n1 > n2) {
+    return 1;
+  }
+
+  return 0;
+}
+
 int btree_cmp(struct btree *bt, const struct btval *a, const struct btval *b) {
+  if (bt->cmp != NULL) {
+    return bt->cmp(a, b, bt->cmp_ctx);
+  }
+
+  if (F_ISSET(bt->flags, BT_CASEFOLD)) {
+    return memncasecmp(a->data, a->size, b->data, b->size);
+  }
+
   return memncmp(a->data, a->size, b->data, b->size);
 }
 
+/* Release a value returned by the btree: drop the reference it holds on its
+ * memory page, or free it if it was copied.
+ */
+void btval_reset(struct btval *btv) {
+  if (btv == NULL) {
+    return;
+  }
+
+  /* Values can be released without holding the lock of their btree. */
+  if (btv->mp != NULL) {
+    __atomic_sub_fetch(&btv->mp->ref, 1, __ATOMIC_ACQ_REL);
+  }
+  if (btv->free_data) {
+    free(btv->data);
+  }
+  memset(btv, 0, sizeof(*btv));
+}
+
 static void common_prefix(struct btree *bt, struct btkey *min,
                           struct btkey *max, struct btkey *pfx) {
   size_t n = 0;
@@ -369,6 +495,10 @@ static void expand_prefix(struct btree *bt, struct mpage *mp, indx_t indx,
 
 static int bt_cmp(struct btree *bt, const struct btval *key1,
                   const struct btval *key2, struct btkey *pfx) {
+  if (!BT_PREFIXED(bt)) {
+    return btree_cmp(bt, key1, key2);
+  }
+
   return memncmp((char *)key1->data + pfx->len, key1->size - pfx->len,
                  key2->data, key2->size);
 }
@@ -399,6 +529,9 @@ static struct mpage *mpage_lookup(struct btree *bt, pgno_t pgno) {
 static void mpage_add(struct btree *bt, struct mpage *mp) {
   RB_INSERT(page_cache, bt->page_cache, mp);
   bt->cache_size++;
+  if (bt->pool != NULL) {
+    __atomic_add_fetch(&bt->pool->size, bt->head.psize, __ATOMIC_RELAXED);
+  }
   TAILQ_INSERT_TAIL(bt->lru_queue, mp, lru_next);
 }
 
@@ -412,6 +545,9 @@ static void mpage_free(struct mpage *mp) {
 static void mpage_del(struct btree *bt, struct mpage *mp) {
   RB_REMOVE(page_cache, bt->page_cache, mp);
   bt->cache_size--;
+  if (bt->pool != NULL) {
+    __atomic_sub_fetch(&bt->pool->size, bt->head.psize, __ATOMIC_RELAXED);
+  }
   TAILQ_REMOVE(bt->lru_queue, mp, lru_next);
 }
 
@@ -443,6 +579,14 @@ static struct mpage *mpage_copy(struct btree *bt, struct mpage *mp) {
   return copy;
 }
 
+static int mpage_over_budget(struct btree *bt) {
+  if (bt->pool != NULL) {
+    return __atomic_load_n(&bt->pool->size, __ATOMIC_RELAXED) > bt->pool->max;
+  }
+
+  return bt->cache_size > bt->max_cache;
+}
+
 /* Remove the least recently used memory pages until the cache size is
  * within the configured bounds. Pages referenced by cursors or returned
  * key/data are not pruned.
@@ -451,12 +595,12 @@ static void mpage_prune(struct btree *bt) {
   struct mpage *mp, *next;
 
   for (mp = TAILQ_FIRST(bt->lru_queue); mp; mp = next) {
-    if (bt->cache_size <= bt->max_cache) {
+    if (!mpage_over_budget(bt)) {
       break;
     }
 
     next = TAILQ_NEXT(mp, lru_next);
-    if (!mp->dirty && mp->ref <= 0) {
+    if (!mp->dirty && __atomic_load_n(&mp->ref, __ATOMIC_ACQUIRE) <= 0) {
       mpage_del(bt, mp);
       mpage_free(mp);
     }
@@ -471,10 +615,13 @@ static void mpage_dirty(struct btree *bt, struct mpage *mp) {
   }
 }
 
-/* Touch a page: make it dirty and re-insert into tree with updated pgno. */
+/* Touch a page: make it dirty and re-insert into tree with updated pgno.
+ * A dirty page frozen by a savepoint is copied like a clean one, so that
+ * rolling back to the savepoint finds it as it was.
+ */
 static struct mpage *mpage_touch(struct btree *bt, struct mpage *mp) {
-  if (!mp->dirty) {
-    if (mp->ref == 0) {
+  if (!mp->dirty || mp->frozen) {
+    if (!mp->dirty && __atomic_load_n(&mp->ref, __ATOMIC_ACQUIRE) == 0) {
       mpage_del(bt, mp);
     } else if ((mp = mpage_copy(bt, mp)) == NULL) {
       return NULL;
@@ -500,13 +647,13 @@ static int btree_read_page(struct btree *bt, pgno_t pgno, struct page *page) {
     return BT_FAIL;
   } else if (rc != (ssize_t)bt->head.psize) {
     if (rc > 0) {
-      errno = EINVAL;
+      errno = EBADMSG;
     }
     return BT_FAIL;
   }
 
   if (page->pgno != pgno) {
-    errno = EINVAL;
+    errno = EBADMSG;
     return BT_FAIL;
   }
 
@@ -514,15 +661,35 @@ static int btree_read_page(struct btree *bt, pgno_t pgno, struct page *page) {
 }
 
 int btree_sync(struct btree *bt) {
-  if (!F_ISSET(bt->flags, BT_NOSYNC)) {
+  BT_ENTER(bt);
+
+  if (!F_ISSET(bt->flags, BT_NOSYNC) && !F_ISSET(bt->flags, BT_RDONLY)) {
     return fsync(bt->fd);
   }
 
   return 0;
 }
 
+int btree_get_fd(struct btree *bt) { return bt->fd; }
+
+unsigned int btree_get_flags(struct btree *bt) { return bt->flags; }
+
+/* The largest key that can be stored, which must leave room for BT_MINKEYS
+ * nodes on a page.
+ */
+unsigned int btree_get_maxkeysize(struct btree *bt) {
+  return MINIMUM(MAXKEYSIZE,
+                 bt->head.psize / BT_MINKEYS - NODESIZE - sizeof(indx_t));
+}
+
 struct btree_txn *btree_txn_begin(struct btree *bt, int rdonly) {
   struct btree_txn *txn;
+  BT_ENTER(bt);
+
+  if (!rdonly && F_ISSET(bt->flags, BT_RDONLY)) {
+    errno = EPERM;
+    return NULL;
+  }
 
   if (!rdonly && bt->txn != NULL) {
     errno = EBUSY;
@@ -543,7 +710,8 @@ struct btree_txn *btree_txn_begin(struct btree *bt, int rdonly) {
     }
     SIMPLEQ_INIT(txn->dirty_queue);
 
-    if (flock(bt->fd, LOCK_EX | LOCK_NB) != 0) {
+    if (!F_ISSET(bt->flags, BT_LOCKED) &&
+        flock(bt->fd, LOCK_EX | LOCK_NB) != 0) {
       errno = EBUSY;
       free(txn->dirty_queue);
       free(txn);
@@ -555,17 +723,25 @@ struct btree_txn *btree_txn_begin(struct btree *bt, int rdonly) {
   txn->bt = bt;
   btree_ref(bt);
 
+  /* A concurrent commit can't make this fail: its meta page is appended
+   * last and carries a hash, so a partially written one is skipped in
+   * favour of the previous meta page.
+   */
   if (btree_read_meta(bt, &txn->next_pgno) != BT_SUCCESS) {
     btree_txn_abort(txn);
     return NULL;
   }
 
   txn->root = bt->meta.root;
+  txn->meta_pgno = bt->meta_pgno;
+  txn->revision = bt->meta.revisions;
+  memmove(&txn->meta, &bt->meta, sizeof(txn->meta));
 
   return txn;
 }
 
 void btree_txn_abort(struct btree_txn *txn) {
+  unsigned int i;
   struct mpage *mp;
   struct btree *bt;
 
@@ -574,6 +750,7 @@ void btree_txn_abort(struct btree_txn *txn) {
   }
 
   bt = txn->bt;
+  BT_ENTER(bt);
 
   if (!F_ISSET(txn->flags, BT_TXN_RDONLY)) {
     /* Discard all dirty pages. */
@@ -584,15 +761,49 @@ void btree_txn_abort(struct btree_txn *txn) {
       mpage_free(mp);
     }
 
+    /* Undo the changes made to the page and entry counts. */
+    if (!F_ISSET(txn->flags, BT_TXN_COMMITTED)) {
+      memmove(&bt->meta, &txn->meta, sizeof(bt->meta));
+    }
+
+    for (i = 0; i < txn->nreserved; i++) {
+      btval_reset(&txn->reserved[i].data);
+    }
+    free(txn->reserved);
+    free(txn->savepoints);
+
     txn->bt->txn = NULL;
-    flock(txn->bt->fd, LOCK_UN);
+    if (!F_ISSET(txn->bt->flags, BT_LOCKED)) {
+      flock(txn->bt->fd, LOCK_UN);
+    }
     free(txn->dirty_queue);
   }
 
+  /* Pages read while starting the txn haven't been pruned yet. */
+  mpage_prune(bt);
   btree_close(txn->bt);
   free(txn);
 }
 
+/* Commit a write transaction.
+ *
+ * No page is ever overwritten: dirty pages are appended to the end of the
+ * file, followed by fsync, then a new meta page pointing at the new root is
+ * appended, followed by a second fsync. The meta page carries a SHA256 hash
+ * of its contents and is always written last, so it is the commit record.
+ *
+ * On open (and at the start of every transaction) the file is scanned
+ * backwards for the most recent valid meta page. A crash at any point before
+ * the meta page is durable leaves only unreferenced pages (or a torn partial
+ * page) after the previous meta page, which are ignored, and the database
+ * opens at the previous revision. A torn meta page fails its hash check and
+ * is likewise ignored. Torn trailing pages are the only thing skipped: any
+ * other error reading a page fails the scan.
+ *
+ * With BT_NOSYNC neither fsync happens, and the kernel may write the meta
+ * page before the pages it references, so a crash can lose recent commits or
+ * leave a meta page pointing at missing pages.
+ */
 int btree_txn_commit(struct btree_txn *txn) {
   int n, done;
   ssize_t rc;
@@ -600,6 +811,7 @@ int btree_txn_commit(struct btree_txn *txn) {
   struct mpage *mp;
   struct btree *bt;
   struct iovec iov[BT_COMMIT_PAGES];
+  BT_ENTER(txn->bt);
 
   bt = txn->bt;
 
@@ -621,6 +833,11 @@ int btree_txn_commit(struct btree_txn *txn) {
     return BT_FAIL;
   }
 
+  if (btree_fill_reserved(txn) != BT_SUCCESS) {
+    btree_txn_abort(txn);
+    return BT_FAIL;
+  }
+
   if (SIMPLEQ_EMPTY(txn->dirty_queue)) {
     goto done;
   }
@@ -662,6 +879,7 @@ int btree_txn_commit(struct btree_txn *txn) {
     while (!SIMPLEQ_EMPTY(txn->dirty_queue)) {
       mp = SIMPLEQ_FIRST(txn->dirty_queue);
       mp->dirty = 0;
+      mp->frozen = 0;
       SIMPLEQ_REMOVE_HEAD(txn->dirty_queue, next);
       if (--n == 0) {
         break;
@@ -676,24 +894,149 @@ int btree_txn_commit(struct btree_txn *txn) {
   }
 
 done:
+  txn->flags |= BT_TXN_COMMITTED;
   mpage_prune(bt);
   btree_txn_abort(txn);
 
   return BT_SUCCESS;
 }
 
-static int btree_write_header(struct btree *bt, int fd) {
+/* Take a savepoint in a write transaction, which btree_txn_rollback can
+ * later return the transaction to. Savepoints nest: rollback and release
+ * act on the innermost one. The dirty pages are frozen, so that changes made
+ * after the savepoint copy them rather than modifying them in place.
+ */
+int btree_txn_savepoint(struct btree_txn *txn) {
+  struct mpage *mp;
+  struct savepoint *sp;
+  struct btree *bt;
+  BT_ENTER(txn->bt);
+
+  bt = txn->bt;
+
+  if (F_ISSET(txn->flags, BT_TXN_RDONLY)) {
+    errno = EPERM;
+    return BT_FAIL;
+  }
+
+  if (txn != bt->txn || F_ISSET(txn->flags, BT_TXN_ERROR)) {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
+  sp = realloc(txn->savepoints,
+               (txn->nsavepoints + 1) * sizeof(*txn->savepoints));
+  if (sp == NULL) {
+    return BT_FAIL;
+  }
+  txn->savepoints = sp;
+
+  sp = &txn->savepoints[txn->nsavepoints++];
+  sp->root = txn->root;
+  sp->next_pgno = txn->next_pgno;
+  sp->nreserved = txn->nreserved;
+  memmove(&sp->meta, &bt->meta, sizeof(sp->meta));
+
+  SIMPLEQ_FOREACH(mp, txn->dirty_queue, next) {
+    if (!mp->frozen) {
+      mp->frozen = txn->nsavepoints;
+    }
+  }
+
+  return BT_SUCCESS;
+}
+
+/* Return a write transaction to its innermost savepoint and drop it. Pages
+ * are numbered in the order they are dirtied, so those dirtied since the
+ * savepoint are the ones numbered from its next_pgno on.
+ */
+int btree_txn_rollback(struct btree_txn *txn) {
+  unsigned int i, n;
+  struct mpage *mp;
+  struct savepoint *sp;
+  struct btree *bt;
+  BT_ENTER(txn->bt);
+
+  bt = txn->bt;
+
+  if (txn != bt->txn || txn->nsavepoints == 0) {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
+  sp = &txn->savepoints[txn->nsavepoints - 1];
+
+  n = 0;
+  SIMPLEQ_FOREACH(mp, txn->dirty_queue, next) {
+    n++;
+  }
+
+  for (i = 0; i < n; i++) {
+    mp = SIMPLEQ_FIRST(txn->dirty_queue);
+    SIMPLEQ_REMOVE_HEAD(txn->dirty_queue, next);
+    if (mp->pgno >= sp->next_pgno) {
+      mpage_del(bt, mp);
+      mpage_free(mp);
+      continue;
+    }
+
+    if (mp->frozen == (short)txn->nsavepoints) {
+      mp->frozen = 0;
+    }
+    SIMPLEQ_INSERT_TAIL(txn->dirty_queue, mp, next);
+  }
+
+  for (i = sp->nreserved; i < txn->nreserved; i++) {
+    btval_reset(&txn->reserved[i].data);
+  }
+  txn->nreserved = sp->nreserved;
+
+  txn->root = sp->root;
+  txn->next_pgno = sp->next_pgno;
+  memmove(&bt->meta, &sp->meta, sizeof(bt->meta));
+
+  /* Whatever failed did so after the savepoint, and has been undone. */
+  txn->flags &= ~BT_TXN_ERROR;
+  txn->nsavepoints--;
+
+  return BT_SUCCESS;
+}
+
+/* Drop the innermost savepoint of a write transaction, keeping the changes
+ * made since.
+ */
+int btree_txn_release(struct btree_txn *txn) {
+  struct mpage *mp;
+  BT_ENTER(txn->bt);
+
+  if (txn != txn->bt->txn || txn->nsavepoints == 0) {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
+  SIMPLEQ_FOREACH(mp, txn->dirty_queue, next) {
+    if (mp->frozen == (short)txn->nsavepoints) {
+      mp->frozen = 0;
+    }
+  }
+  txn->nsavepoints--;
+
+  return BT_SUCCESS;
+}
+
+static int btree_write_header(struct btree *bt, int fd, unsigned int psize) {
   struct stat sb;
   struct bt_head *h;
   struct page *p;
   ssize_t rc;
-  unsigned int psize;
 
-  /* Ask stat for 'optimal blocksize for I/O', but cap to fit in indx_t. */
-  if (fstat(fd, &sb) == 0) {
-    psize = MINIMUM(32 * 1024, sb.st_blksize);
-  } else {
-    psize = PAGESIZE;
+  if (psize == 0) {
+    /* Ask stat for 'optimal blocksize for I/O', but cap to fit in indx_t. */
+    if (fstat(fd, &sb) == 0) {
+      psize = MINIMUM(MAXPAGESIZE, sb.st_blksize);
+    } else {
+      psize = PAGESIZE;
+    }
   }
 
   if ((p = calloc(1, psize)) == NULL) {
@@ -704,6 +1047,7 @@ static int btree_write_header(struct btree *bt, int fd) {
   h = METADATA(p);
   h->magic = BT_MAGIC;
   h->version = BT_VERSION;
+  h->flags = bt->flags & BT_CASEFOLD;
   h->psize = psize;
   memmove(&bt->head, h, sizeof(*h));
 
@@ -736,13 +1080,13 @@ static int btree_read_header(struct btree *bt) {
   p = (struct page *)page;
 
   if (!F_ISSET(p->flags, P_HEAD)) {
-    errno = EINVAL;
+    errno = EBADMSG;
     return -1;
   }
 
   h = METADATA(p);
   if (h->magic != BT_MAGIC) {
-    errno = EINVAL;
+    errno = EBADMSG;
     return -1;
   }
 
@@ -776,6 +1120,7 @@ static int btree_write_meta(struct btree *bt, pgno_t root, unsigned int flags) {
   memmove(meta, &bt->meta, sizeof(*meta));
 
   rc = write(bt->fd, mp->page, bt->head.psize);
+  bt->meta_pgno = mp->pgno;
   mp->dirty = 0;
   SIMPLEQ_REMOVE_HEAD(bt->txn->dirty_queue, next);
   if (rc != (ssize_t)bt->head.psize) {
@@ -825,7 +1170,7 @@ static int btree_read_meta(struct btree *bt, pgno_t *p_next) {
   }
 
   if (size < bt->size) {
-    errno = EIO;
+    errno = EBADMSG;
     goto fail;
   }
 
@@ -838,7 +1183,7 @@ static int btree_read_meta(struct btree *bt, pgno_t *p_next) {
 
   next_pgno = size / bt->head.psize;
   if (next_pgno == 0) {
-    errno = EIO;
+    errno = EBADMSG;
     goto fail;
   }
 
@@ -861,27 +1206,39 @@ static int btree_read_meta(struct btree *bt, pgno_t *p_next) {
       return BT_SUCCESS;
     }
   }
-  bt->size = size;
 
   while (meta_pgno > 0) {
+    /* A page that reads back short or with the wrong page number is the
+     * remains of a torn write from an interrupted commit; it can't be a
+     * valid meta page, so skip it. Any other error is real and fails.
+     */
     if ((mp = btree_get_mpage(bt, meta_pgno)) == NULL) {
-      break;
+      if (errno != EBADMSG) {
+        goto fail;
+      }
+      --meta_pgno;
+      continue;
     }
     if (btree_is_meta_page(mp->page)) {
       meta = METADATA(mp->page);
       if (F_ISSET(meta->flags, BT_TOMBSTONE)) {
+        /* bt->size is left alone, so every later call finds the
+         * tombstone again rather than taking the file as unchanged.
+         */
         errno = ESTALE;
         return BT_FAIL;
       } else {
         /* Make copy of last meta page. */
         memmove(&bt->meta, meta, sizeof(bt->meta));
+        bt->meta_pgno = meta_pgno;
+        bt->size = size;
         return BT_SUCCESS;
       }
     }
     --meta_pgno; /* scan backwards to first valid meta page */
   }
 
-  errno = EIO;
+  errno = EBADMSG;
 fail:
   if (p_next != NULL) {
     *p_next = P_INVALID;
@@ -890,15 +1247,29 @@ fail:
   return BT_FAIL;
 }
 
-struct btree *btree_open_fd(int fd, unsigned int flags) {
+/* Opens the btree in fd. If the file is empty, a new btree is created with
+ * pages of psize bytes, which must be a power of two between 4 and 32 KiB, or
+ * 0 to pick the file system's block size. psize is ignored for an existing
+ * btree.
+ */
+struct btree *btree_open_fd(int fd, unsigned int flags, unsigned int psize) {
   struct btree *bt;
+  pthread_mutexattr_t attr;
   int fl;
 
-  fl = fcntl(fd, F_GETFL);
-  if (fcntl(fd, F_SETFL, fl | O_APPEND) == -1) {
+  if (psize != 0 &&
+      (psize < PAGESIZE || psize > MAXPAGESIZE || (psize & (psize - 1)) != 0)) {
+    errno = EINVAL;
     return NULL;
   }
 
+  if (!F_ISSET(flags, BT_RDONLY)) {
+    fl = fcntl(fd, F_GETFL);
+    if (fcntl(fd, F_SETFL, fl | O_APPEND) == -1) {
+      return NULL;
+    }
+  }
+
   if ((bt = calloc(1, sizeof(*bt))) == NULL) {
     return NULL;
   }
@@ -920,17 +1291,30 @@ struct btree *btree_open_fd(int fd, unsigned int flags) {
   TAILQ_INIT(bt->lru_queue);
 
   if (btree_read_header(bt) != 0) {
-    if (errno != ENOENT) {
+    /* Never initialize a new file when opened read only. */
+    if (errno != ENOENT || F_ISSET(flags, BT_RDONLY)) {
       goto fail;
     }
 
-    btree_write_header(bt, bt->fd);
+    btree_write_header(bt, bt->fd, psize);
+  }
+
+  /* The key order is fixed when the file is created. */
+  if (F_ISSET(flags, BT_CASEFOLD) && !F_ISSET(bt->head.flags, BT_CASEFOLD)) {
+    errno = EINVAL;
+    goto fail;
   }
+  bt->flags |= bt->head.flags & BT_CASEFOLD;
 
   if (btree_read_meta(bt, NULL) != 0) {
     goto fail;
   }
 
+  pthread_mutexattr_init(&attr);
+  pthread_mutexattr_settype(&attr, PTHREAD_MUTEX_RECURSIVE);
+  pthread_mutex_init(&bt->mu, &attr);
+  pthread_mutexattr_destroy(&attr);
+
   return bt;
 
 fail:
@@ -940,7 +1324,8 @@ fail:
   return NULL;
 }
 
-struct btree *btree_open(const char *path, unsigned int flags, mode_t mode) {
+struct btree *btree_open(const char *path, unsigned int flags, mode_t mode,
+                         unsigned int psize) {
   int fd, oflags;
   struct btree *bt;
 
@@ -954,8 +1339,11 @@ struct btree *btree_open(const char *path, unsigned int flags, mode_t mode) {
     return NULL;
   }
 
-  if ((bt = btree_open_fd(fd, flags)) == NULL) {
+  if ((bt = btree_open_fd(fd, flags, psize)) == NULL) {
+    /* Preserve the cause for the caller. */
+    int err = errno;
     close(fd);
+    errno = err;
   } else {
     bt->path = strdup(path);
   }
@@ -965,19 +1353,54 @@ struct btree *btree_open(const char *path, unsigned int flags, mode_t mode) {
 
 static void btree_ref(struct btree *bt) { bt->ref++; }
 
-void btree_close(struct btree *bt) {
+static struct btree *btree_enter(struct btree *bt) {
+  pthread_mutex_lock(&bt->mu);
+  btree_ref(bt);
+
+  return bt;
+}
+
+static void btree_leave(struct btree **btp) {
+  struct btree *bt = *btp;
+  int last = --bt->ref == 0;
+
+  pthread_mutex_unlock(&bt->mu);
+  if (last) {
+    btree_free(bt);
+  }
+}
+
+/* Drop a reference to bt, freeing it along with the last one. Fails if closing
+ * the file does, but bt is freed all the same.
+ */
+int btree_close(struct btree *bt) {
+  int last;
+
   if (bt == NULL) {
-    return;
+    return BT_SUCCESS;
   }
 
-  if (--bt->ref == 0) {
-    close(bt->fd);
-    mpage_flush(bt);
-    free(bt->lru_queue);
-    free(bt->path);
-    free(bt->page_cache);
-    free(bt);
+  pthread_mutex_lock(&bt->mu);
+  last = --bt->ref == 0;
+  pthread_mutex_unlock(&bt->mu);
+
+  return last ? btree_free(bt) : BT_SUCCESS;
+}
+
+static int btree_free(struct btree *bt) {
+  int rc = BT_SUCCESS;
+
+  if (close(bt->fd) != 0) {
+    rc = BT_FAIL;
   }
+  mpage_flush(bt);
+  pthread_mutex_destroy(&bt->mu);
+  free(bt->lru_queue);
+  free(bt->path);
+  free(bt->page_cache);
+  free(bt);
+
+  return rc;
 }
 
 /* Search for key within a leaf page, using binary search.
@@ -1041,7 +1464,7 @@ static void cursor_pop_page(struct cursor *cursor) {
 
   top = CURSOR_TOP(cursor);
   CURSOR_POP(cursor);
-  top->mpage->ref--;
+  __atomic_sub_fetch(&top->mpage->ref, 1, __ATOMIC_ACQ_REL);
 
   free(top);
 }
@@ -1053,7 +1476,7 @@ static struct ppage *cursor_push_page(struct cursor *cursor, struct mpage *mp) {
     return NULL;
   }
   ppage->mpage = mp;
-  mp->ref++;
+  __atomic_add_fetch(&mp->ref, 1, __ATOMIC_RELAXED);
   CURSOR_PUSH(cursor, ppage);
   return ppage;
 }
@@ -1095,6 +1518,10 @@ static void find_common_prefix(struct btree *bt, struct mpage *mp) {
 
   mp->prefix.len = 0;
 
+  if (!BT_PREFIXED(bt)) {
+    return;
+  }
+
   lp = mp;
   while (lp->parent != NULL) {
     if (lp->parent_index > 0) {
@@ -1179,15 +1606,12 @@ static int btree_search_page_root(struct btree *bt, struct mpage *root,
   return BT_SUCCESS;
 }
 
-/* Search for the page a given key should be in.
- * Stores a pointer to the found page in *mpp.
- * If key is NULL, search for the lowest page (used by btree_cursor_first).
- * If cursor is non-null, pushes parent pages on the cursor stack.
- * If modify is true, visited pages are updated with new page numbers.
+/* Reads the root page, of txn if given, otherwise of the last committed
+ * revision, into *mpp. If modify is true the root is updated with a new page
+ * number.
  */
-static int btree_search_page(struct btree *bt, struct btree_txn *txn,
-                             struct btval *key, struct cursor *cursor,
-                             int modify, struct mpage **mpp) {
+static int btree_root_page(struct btree *bt, struct btree_txn *txn,
+                           int modify, struct mpage **mpp) {
   int rc;
   pgno_t root;
   struct mpage *mp;
@@ -1222,13 +1646,33 @@ static int btree_search_page(struct btree *bt, struct btree_txn *txn,
     return BT_FAIL;
   }
 
-  if (modify && !mp->dirty) {
+  if (modify && (!mp->dirty || mp->frozen)) {
     if ((mp = mpage_touch(bt, mp)) == NULL) {
       return BT_FAIL;
     }
     txn->root = mp->pgno;
   }
 
+  *mpp = mp;
+  return BT_SUCCESS;
+}
+
+/* Search for the page a given key should be in.
+ * Stores a pointer to the found page in *mpp.
+ * If key is NULL, search for the lowest page (used by btree_cursor_first).
+ * If cursor is non-null, pushes parent pages on the cursor stack.
+ * If modify is true, visited pages are updated with new page numbers.
+ */
+static int btree_search_page(struct btree *bt, struct btree_txn *txn,
+                             struct btval *key, struct cursor *cursor,
+                             int modify, struct mpage **mpp) {
+  int rc;
+  struct mpage *mp;
+
+  if ((rc = btree_root_page(bt, txn, modify, &mp)) != BT_SUCCESS) {
+    return rc;
+  }
+
   return btree_search_page_root(bt, mp, key, cursor, modify, mpp);
 }
 
@@ -1257,7 +1701,7 @@ static int btree_read_data(struct btree *bt, struct mpage *mp,
         data->data = NODEDATA(leaf);
         data->free_data = 0;
         data->mp = mp;
-        mp->ref++;
+        __atomic_add_fetch(&mp->ref, 1, __ATOMIC_RELAXED);
       }
     }
     return BT_SUCCESS;
@@ -1292,6 +1736,16 @@ static int btree_read_data(struct btree *bt, struct mpage *mp,
 
 int btree_txn_get(struct btree *bt, struct btree_txn *txn, struct btval *key,
                   struct btval *data) {
+  return btree_txn_get_lazy(bt, txn, key, data, NULL);
+}
+
+/* Like btree_txn_get, but if pgno is not NULL a value stored on overflow pages
+ * is not read. Instead only data->size is set, and *pgno is set to the first
+ * overflow page, to be read with btree_read_overflow. For any other value
+ * *pgno is set to 0.
+ */
+int btree_txn_get_lazy(struct btree *bt, struct btree_txn *txn,
+                       struct btval *key, struct btval *data, uint32_t *pgno) {
   int rc, exact;
   struct node *leaf;
   struct mpage *mp;
@@ -1308,6 +1762,7 @@ int btree_txn_get(struct btree *bt, struct btree_txn *txn, struct btval *key,
     }
     bt = txn->bt;
   }
+  BT_ENTER(bt);
 
   if (key->size == 0 || key->size > MAXKEYSIZE) {
     errno = EINVAL;
@@ -1319,7 +1774,14 @@ int btree_txn_get(struct btree *bt, struct btree_txn *txn, struct btval *key,
   }
 
   leaf = btree_search_node(bt, mp, key, &exact, NULL);
-  if (leaf && exact) {
+  if (leaf && exact && pgno != NULL && F_ISSET(leaf->flags, F_BIGDATA)) {
+    memset(data, 0, sizeof(*data));
+    data->size = leaf->n_dsize;
+    memmove(pgno, NODEDATA(leaf), sizeof(*pgno));
+  } else if (leaf && exact) {
+    if (pgno != NULL) {
+      *pgno = 0;
+    }
     rc = btree_read_data(bt, mp, leaf, data);
   } else {
     errno = ENOENT;
@@ -1330,6 +1792,40 @@ int btree_txn_get(struct btree *bt, struct btree_txn *txn, struct btval *key,
   return rc;
 }
 
+/* Sets found[i] to whether keys[i] exists, for each of the n keys, without
+ * reading any of the values.
+ */
+int btree_txn_exists(struct btree *bt, struct btree_txn *txn,
+                     struct btval *keys, size_t n, int *found) {
+  int exact;
+  size_t i;
+  struct mpage *mp;
+  BT_ENTER(bt);
+
+  for (i = 0; i < n; i++) {
+    if (keys[i].size == 0 || keys[i].size > MAXKEYSIZE) {
+      errno = EINVAL;
+      return BT_FAIL;
+    }
+
+    found[i] = 0;
+    if (btree_search_page(bt, txn, &keys[i], NULL, 0, &mp) != BT_SUCCESS) {
+      if (errno == ENOENT) {
+        continue; /* empty tree */
+      }
+      mpage_prune(bt);
+      return BT_FAIL;
+    }
+
+    if (btree_search_node(bt, mp, &keys[i], &exact, NULL) != NULL && exact) {
+      found[i] = 1;
+    }
+  }
+
+  mpage_prune(bt);
+  return BT_SUCCESS;
+}
+
 static int btree_sibling(struct cursor *cursor, int move_right) {
   int rc;
   struct node *indx;
@@ -1367,6 +1863,11 @@ static int btree_sibling(struct cursor *cursor, int move_right) {
   cursor_push_page(cursor, mp);
   find_common_prefix(cursor->bt, mp);
 
+  /* Moving left lands on the last node of the page. */
+  if (!move_right) {
+    CURSOR_TOP(cursor)->ki = NUMKEYS(mp) - 1;
+  }
+
   return BT_SUCCESS;
 }
 
@@ -1390,7 +1891,7 @@ static int bt_set_key(struct btree *bt, struct mpage *mp, struct node *node,
     key->data = NODEKEY(node);
     key->free_data = 0;
     key->mp = mp;
-    mp->ref++;
+    __atomic_add_fetch(&mp->ref, 1, __ATOMIC_RELAXED);
   }
 
   return 0;
@@ -1434,20 +1935,58 @@ static int btree_cursor_next(struct cursor *cursor, struct btval *key,
   return BT_SUCCESS;
 }
 
-static int btree_cursor_set(struct cursor *cursor, struct btval *key,
-                            struct btval *data, int *exactp) {
-  int rc;
-  struct node *leaf;
-  struct mpage *mp;
+static int btree_cursor_prev(struct cursor *cursor, struct btval *key,
+                             struct btval *data) {
   struct ppage *top;
+  struct mpage *mp;
+  struct node *leaf;
 
-  rc = btree_search_page(cursor->bt, cursor->txn, key, cursor, 0, &mp);
-  if (rc != BT_SUCCESS) {
-    return rc;
+  if (cursor->eof) {
+    errno = ENOENT;
+    return BT_FAIL;
   }
 
   top = CURSOR_TOP(cursor);
-  leaf = btree_search_node(cursor->bt, mp, key, exactp, &top->ki);
+  mp = top->mpage;
+
+  if (top->ki == 0) {
+    if (btree_sibling(cursor, 0) != BT_SUCCESS) {
+      cursor->eof = 1;
+      return BT_FAIL;
+    }
+    top = CURSOR_TOP(cursor);
+    mp = top->mpage;
+  } else {
+    top->ki--;
+  }
+
+  leaf = NODEPTR(mp, top->ki);
+
+  if (data && btree_read_data(cursor->bt, mp, leaf, data) != BT_SUCCESS) {
+    return BT_FAIL;
+  }
+
+  if (bt_set_key(cursor->bt, mp, leaf, key) != 0) {
+    return BT_FAIL;
+  }
+
+  return BT_SUCCESS;
+}
+
+static int btree_cursor_set(struct cursor *cursor, struct btval *key,
+                            struct btval *data, int *exactp) {
+  int rc;
+  struct node *leaf;
+  struct mpage *mp;
+  struct ppage *top;
+
+  rc = btree_search_page(cursor->bt, cursor->txn, key, cursor, 0, &mp);
+  if (rc != BT_SUCCESS) {
+    return rc;
+  }
+
+  top = CURSOR_TOP(cursor);
+  leaf = btree_search_node(cursor->bt, mp, key, exactp, &top->ki);
   if (exactp != NULL && !*exactp) {
     /* BT_CURSOR_EXACT specified and not an exact match. */
     errno = ENOENT;
@@ -1504,10 +2043,118 @@ static int btree_cursor_first(struct cursor *cursor, struct btval *key,
   return BT_SUCCESS;
 }
 
+static int btree_cursor_last(struct cursor *cursor, struct btval *key,
+                             struct btval *data) {
+  int rc;
+  struct mpage *mp, *parent;
+  struct node *leaf;
+  struct ppage *top;
+
+  rc = btree_root_page(cursor->bt, cursor->txn, 0, &mp);
+  if (rc != BT_SUCCESS) {
+    return rc;
+  }
+
+  if (cursor_push_page(cursor, mp) == NULL) {
+    return BT_FAIL;
+  }
+
+  /* Descend along the last node of each branch page. */
+  while (IS_BRANCH(mp)) {
+    top = CURSOR_TOP(cursor);
+    top->ki = NUMKEYS(mp) - 1;
+
+    parent = mp;
+    if ((mp = btree_get_mpage(cursor->bt, NODEPGNO(NODEPTR(mp, top->ki)))) ==
+        NULL) {
+      return BT_FAIL;
+    }
+    mp->parent = parent;
+    mp->parent_index = top->ki;
+    find_common_prefix(cursor->bt, mp);
+
+    if (cursor_push_page(cursor, mp) == NULL) {
+      return BT_FAIL;
+    }
+  }
+
+  if (!IS_LEAF(mp)) {
+    return BT_FAIL;
+  }
+
+  if (NUMKEYS(mp) == 0) {
+    errno = ENOENT;
+    return BT_FAIL;
+  }
+
+  top = CURSOR_TOP(cursor);
+  top->ki = NUMKEYS(mp) - 1;
+  leaf = NODEPTR(mp, top->ki);
+  cursor->initialized = 1;
+  cursor->eof = 0;
+
+  if (data && btree_read_data(cursor->bt, mp, leaf, data) != BT_SUCCESS) {
+    return BT_FAIL;
+  }
+
+  if (bt_set_key(cursor->bt, mp, leaf, key) != 0) {
+    return BT_FAIL;
+  }
+
+  return BT_SUCCESS;
+}
+
+static int btree_cursor_current(struct cursor *cursor, struct btval *key,
+                                struct btval *data) {
+  struct ppage *top;
+  struct mpage *mp;
+  struct node *leaf;
+
+  top = CURSOR_TOP(cursor);
+  if (!cursor->initialized || cursor->eof || cursor->deleted || top == NULL ||
+      top->ki >= NUMKEYS(top->mpage)) {
+    errno = ENOENT;
+    return BT_FAIL;
+  }
+
+  mp = top->mpage;
+  leaf = NODEPTR(mp, top->ki);
+
+  if (data && btree_read_data(cursor->bt, mp, leaf, data) != BT_SUCCESS) {
+    return BT_FAIL;
+  }
+
+  if (bt_set_key(cursor->bt, mp, leaf, key) != 0) {
+    return BT_FAIL;
+  }
+
+  return BT_SUCCESS;
+}
+
+/* Stores the size of the data of the entry the cursor is on in *dsize,
+ * without reading it from any overflow pages.
+ */
+int btree_cursor_dsize(struct cursor *cursor, size_t *dsize) {
+  struct ppage *top;
+  BT_ENTER(cursor->bt);
+
+  top = CURSOR_TOP(cursor);
+  if (!cursor->initialized || cursor->eof || cursor->deleted || top == NULL ||
+      top->ki >= NUMKEYS(top->mpage)) {
+    errno = ENOENT;
+    return BT_FAIL;
+  }
+
+  *dsize = NODEDSZ(NODEPTR(top->mpage, top->ki));
+
+  return BT_SUCCESS;
+}
+
 int btree_cursor_get(struct cursor *cursor, struct btval *key,
                      struct btval *data, enum cursor_op op) {
   int rc;
   int exact = 0;
+  BT_ENTER(cursor->bt);
 
   switch (op) {
   case BT_CURSOR:
@@ -1515,6 +2162,8 @@ int btree_cursor_get(struct cursor *cursor, struct btval *key,
     while (CURSOR_TOP(cursor) != NULL) {
       cursor_pop_page(cursor);
     }
+    cursor->initialized = 0;
+    cursor->deleted = 0;
     if (key == NULL || key->size == 0 || key->size > MAXKEYSIZE) {
       errno = EINVAL;
       rc = BT_FAIL;
@@ -1527,6 +2176,10 @@ int btree_cursor_get(struct cursor *cursor, struct btval *key,
   case BT_NEXT:
     if (!cursor->initialized) {
       rc = btree_cursor_first(cursor, key, data);
+    } else if (cursor->deleted) {
+      /* Already on the entry that followed the deleted one. */
+      cursor->deleted = 0;
+      rc = btree_cursor_current(cursor, key, data);
     } else {
       rc = btree_cursor_next(cursor, key, data);
     }
@@ -1535,8 +2188,32 @@ int btree_cursor_get(struct cursor *cursor, struct btval *key,
     while (CURSOR_TOP(cursor) != NULL) {
       cursor_pop_page(cursor);
     }
+    cursor->initialized = 0;
+    cursor->deleted = 0;
     rc = btree_cursor_first(cursor, key, data);
     break;
+  case BT_CURRENT:
+    rc = btree_cursor_current(cursor, key, data);
+    break;
+  case BT_PREV:
+    if (cursor->initialized && !(cursor->deleted && cursor->eof)) {
+      /* After a delete the cursor is on the entry that followed the
+       * deleted one, so stepping back from it returns the one before.
+       */
+      cursor->deleted = 0;
+      rc = btree_cursor_prev(cursor, key, data);
+      break;
+    }
+    /* Not positioned yet, or the last entry was deleted. */
+    /* FALLTHROUGH */
+  case BT_LAST:
+    while (CURSOR_TOP(cursor) != NULL) {
+      cursor_pop_page(cursor);
+    }
+    cursor->initialized = 0;
+    cursor->deleted = 0;
+    rc = btree_cursor_last(cursor, key, data);
+    break;
   default:
     rc = BT_FAIL;
     break;
@@ -1547,6 +2224,68 @@ int btree_cursor_get(struct cursor *cursor, struct btval *key,
   return rc;
 }
 
+/* Deletes the entry the cursor is on. The pages on the cursor stack may be
+ * replaced by the delete, so the cursor is then repositioned by key on the
+ * entry that followed, which BT_NEXT returns next. Until then the cursor is
+ * between entries and BT_CURRENT fails with ENOENT.
+ */
+int btree_cursor_del(struct cursor *cursor) {
+  struct btval key, next;
+  int rc;
+  BT_ENTER(cursor->bt);
+
+  if (cursor->txn == NULL || F_ISSET(cursor->txn->flags, BT_TXN_RDONLY)) {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
+  memset(&next, 0, sizeof(next));
+  if (btree_cursor_current(cursor, &next, NULL) != BT_SUCCESS) {
+    return BT_FAIL;
+  }
+
+  /* Dirty pages are modified in place, so the key must be copied first. */
+  memset(&key, 0, sizeof(key));
+  key.size = next.size;
+  if ((key.data = malloc(key.size)) == NULL) {
+    btval_reset(&next);
+    return BT_FAIL;
+  }
+  memcpy(key.data, next.data, key.size);
+  key.free_data = 1;
+  btval_reset(&next);
+
+  while (CURSOR_TOP(cursor) != NULL) {
+    cursor_pop_page(cursor);
+  }
+  cursor->initialized = 0;
+
+  if ((rc = btree_txn_del(cursor->bt, cursor->txn, &key, NULL)) !=
+      BT_SUCCESS) {
+    btval_reset(&key);
+    return rc;
+  }
+
+  next = key;
+  next.mp = NULL;
+  next.free_data = 0;
+  if (btree_cursor_set(cursor, &next, NULL, NULL) == BT_SUCCESS) {
+    btval_reset(&next);
+  } else {
+    /* Either the last entry was deleted, or the cursor can't be placed. */
+    if (errno != ENOENT) {
+      rc = BT_FAIL;
+    }
+    cursor->initialized = 1;
+    cursor->eof = 1;
+  }
+  cursor->deleted = 1;
+
+  btval_reset(&key);
+
+  return rc;
+}
+
 static struct mpage *btree_new_page(struct btree *bt, uint32_t flags) {
   struct mpage *mp;
 
@@ -1621,7 +2360,11 @@ static int btree_write_overflow_data(struct btree *bt, struct page *p,
     if (sz > max) {
       sz = max;
     }
-    memmove(p->ptrs, (char *)data->data + done, sz);
+    if (data->data == NULL) { /* reserved */
+      memset(p->ptrs, 0, sz);
+    } else {
+      memmove(p->ptrs, (char *)data->data + done, sz);
+    }
     done += sz;
   }
 
@@ -1693,6 +2436,8 @@ static int btree_add_node(struct btree *bt, struct mpage *mp, indx_t indx,
     if (ofp == NULL) {
       if (F_ISSET(flags, F_BIGDATA)) {
         memmove(node->data + key->size, data->data, sizeof(pgno_t));
+      } else if (data->data == NULL) { /* reserved */
+        memset(node->data + key->size, 0, data->size);
       } else {
         memmove(node->data + key->size, data->data, data->size);
       }
@@ -1757,6 +2502,7 @@ struct cursor *btree_txn_cursor_open(struct btree *bt, struct btree_txn *txn) {
     }
     bt = txn->bt;
   }
+  BT_ENTER(bt);
 
   if ((cursor = calloc(1, sizeof(*cursor))) != NULL) {
     SLIST_INIT(&cursor->stack);
@@ -1770,6 +2516,8 @@ struct cursor *btree_txn_cursor_open(struct btree *bt, struct btree_txn *txn) {
 
 void btree_cursor_close(struct cursor *cursor) {
   if (cursor != NULL) {
+    BT_ENTER(cursor->bt);
+
     while (!CURSOR_EMPTY(cursor)) {
       cursor_pop_page(cursor);
     }
@@ -1891,6 +2639,20 @@ static int btree_move_node(struct btree *bt, struct mpage *src, indx_t srcindx,
     memmove(&dst->prefix, &tmpkey, sizeof(tmpkey));
   }
 
+  if (dstindx == 0 && IS_BRANCH(dst) && dst->parent != NULL) {
+    /* Node 0 moves up to index 1 and loses its implicit key. Give it
+     * the old parent separator so the bounds (and thus the prefix) of
+     * the page it points to stay the same.
+     */
+    expand_prefix(bt, dst->parent, dst->parent_index, &tmpkey);
+    key.size = tmpkey.len;
+    key.data = tmpkey.str;
+    remove_prefix(bt, &key, dst->prefix.len);
+    if (btree_update_key(bt, dst, 0, &key) != BT_SUCCESS) {
+      return BT_FAIL;
+    }
+  }
+
   if (srcindx == 0 && IS_BRANCH(src)) {
     struct mpage *low;
 
@@ -2179,6 +2941,7 @@ int btree_txn_del(struct btree *bt, struct btree_txn *txn, struct btval *key,
     }
     bt = txn->bt;
   }
+  BT_ENTER(bt);
 
   if (key->size == 0 || key->size > MAXKEYSIZE) {
     errno = EINVAL;
@@ -2235,13 +2998,15 @@ done:
 static void bt_reduce_separator(struct btree *bt, struct node *min,
                                 struct btval *sep) {
   size_t n = 0;
+  int fold;
   char *p1;
   char *p2;
 
+  fold = F_ISSET(bt->flags, BT_CASEFOLD);
   p1 = (char *)NODEKEY(min);
   p2 = (char *)sep->data;
 
-  while (*p1 == *p2) {
+  while (fold ? ASCII_TOLOWER(*p1) == ASCII_TOLOWER(*p2) : *p1 == *p2) {
     p1++;
     p2++;
     n++;
@@ -2260,7 +3025,8 @@ static void bt_reduce_separator(struct btree *bt, struct node *min,
  */
 static int btree_split(struct btree *bt, struct mpage **mpp,
                        unsigned int *newindxp, struct btval *newkey,
-                       struct btval *newdata, pgno_t newpgno) {
+                       struct btval *newdata, pgno_t newpgno,
+                       unsigned int putflags) {
   uint8_t flags;
   int rc = BT_SUCCESS, ins_new = 0;
   indx_t newindx;
@@ -2310,6 +3076,13 @@ static int btree_split(struct btree *bt, struct mpage **mpp,
   mp->page->upper = bt->head.psize;
 
   split_indx = NUMKEYSP(copy) / 2 + 1;
+  if (F_ISSET(putflags, BT_APPEND) && newindx == NUMKEYSP(copy)) {
+    /* Appending in order: leave the left page 90% full rather than half
+     * full. The rest is headroom for separators and prefixes that grow
+     * when the page is later rebalanced.
+     */
+    split_indx = newindx - (newindx + 9) / 10;
+  }
 
   /* First find the separating key between the split pages. */
   memset(&sepkey, 0, sizeof(sepkey));
@@ -2323,7 +3096,7 @@ static int btree_split(struct btree *bt, struct mpage **mpp,
     sepkey.data = NODEKEY(node);
   }
 
-  if (IS_LEAF(mp)) {
+  if (IS_LEAF(mp) && bt->cmp == NULL) {
     /* Find the smallest separator. */
     /* Ref: Prefix B-trees, R. Bayer, K. Unterauer, 1977 */
     node = NODEPTRP(copy, split_indx - 1);
@@ -2340,7 +3113,7 @@ static int btree_split(struct btree *bt, struct mpage **mpp,
   /* Copy separator key to the parent. */
   if (SIZELEFT(pright->parent) < bt_branch_size(bt, &sepkey)) {
     rc = btree_split(bt, &pright->parent, &pright->parent_index, &sepkey, NULL,
-                     pright->pgno);
+                     pright->pgno, putflags);
 
     /* Right page might now have changed parent.
      * Check if left page also changed parent.
@@ -2430,9 +3203,98 @@ static int btree_split(struct btree *bt, struct mpage **mpp,
   return rc;
 }
 
+/* Returns true if mp is the rightmost page on its level. */
+static int btree_is_last(struct mpage *mp) {
+  for (; mp->parent != NULL; mp = mp->parent) {
+    if (mp->parent_index + 1u != NUMKEYS(mp->parent)) {
+      return 0;
+    }
+  }
+  return 1;
+}
+
+/* Points data at the value of key, just put with BT_RESERVE, for the caller
+ * to fill in. A value on overflow pages isn't contiguous, so data is pointed
+ * at a buffer instead, which is copied to the pages on commit.
+ */
+static int btree_reserve(struct btree *bt, struct btree_txn *txn,
+                         struct btval *key, struct btval *data) {
+  int exact;
+  struct mpage *mp;
+  struct node *leaf;
+  struct reservation *reserved;
+
+  if (btree_search_page(bt, txn, key, NULL, 0, &mp) != BT_SUCCESS) {
+    return BT_FAIL;
+  }
+
+  leaf = btree_search_node(bt, mp, key, &exact, NULL);
+  if (leaf == NULL || !exact) {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
+  if (!F_ISSET(leaf->flags, F_BIGDATA)) {
+    data->data = NODEDATA(leaf);
+    return BT_SUCCESS;
+  }
+
+  reserved = realloc(txn->reserved,
+                     (txn->nreserved + 1) * sizeof(*txn->reserved));
+  if (reserved == NULL) {
+    return BT_FAIL;
+  }
+  txn->reserved = reserved;
+
+  reserved = &txn->reserved[txn->nreserved];
+  memset(reserved, 0, sizeof(*reserved));
+  if ((reserved->data.data = calloc(1, data->size)) == NULL) {
+    return BT_FAIL;
+  }
+  reserved->data.size = data->size;
+  reserved->data.free_data = 1;
+  memmove(&reserved->pgno, NODEDATA(leaf), sizeof(reserved->pgno));
+  txn->nreserved++;
+
+  data->data = reserved->data.data;
+  return BT_SUCCESS;
+}
+
+/* Copies the values reserved on overflow pages to the pages, which are still
+ * dirty. Pages left behind by a later put or delete of the same key are
+ * filled in too, harmlessly.
+ */
+static int btree_fill_reserved(struct btree_txn *txn) {
+  unsigned int i;
+  size_t done, sz, max;
+  pgno_t pgno;
+  struct mpage *mp;
+  struct btval *data;
+
+  max = txn->bt->head.psize - PAGEHDRSZ;
+
+  for (i = 0; i < txn->nreserved; i++) {
+    data = &txn->reserved[i].data;
+    pgno = txn->reserved[i].pgno;
+    for (done = 0; done < data->size; done += sz) {
+      if ((mp = btree_get_mpage(txn->bt, pgno)) == NULL) {
+        return BT_FAIL;
+      }
+      sz = data->size - done;
+      if (sz > max) {
+        sz = max;
+      }
+      memmove(mp->page->ptrs, (char *)data->data + done, sz);
+      pgno = mp->page->p_next_pgno;
+    }
+  }
+
+  return BT_SUCCESS;
+}
+
 int btree_txn_put(struct btree *bt, struct btree_txn *txn, struct btval *key,
-                  struct btval *data) {
-  int rc = BT_SUCCESS, exact, close_txn = 0;
+                  struct btval *data, unsigned int flags) {
+  int rc = BT_SUCCESS, exact, close_txn = 0, replaced = 0;
   unsigned int ki;
   struct node *leaf;
   struct mpage *mp;
@@ -2455,12 +3317,19 @@ int btree_txn_put(struct btree *bt, struct btree_txn *txn, struct btval *key,
     }
     bt = txn->bt;
   }
+  BT_ENTER(bt);
 
   if (key->size == 0 || key->size > MAXKEYSIZE) {
     errno = EINVAL;
     return BT_FAIL;
   }
 
+  /* A reserved value is filled in before the transaction commits. */
+  if (F_ISSET(flags, BT_RESERVE) && (txn == NULL || data->data != NULL)) {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
   if (txn == NULL) {
     close_txn = 1;
     if ((txn = btree_txn_begin(bt, 0)) == NULL) {
@@ -2471,8 +3340,19 @@ int btree_txn_put(struct btree *bt, struct btree_txn *txn, struct btval *key,
   rc = btree_search_page(bt, txn, key, NULL, 1, &mp);
   if (rc == BT_SUCCESS) {
     leaf = btree_search_node(bt, mp, key, &exact, &ki);
+    if (F_ISSET(flags, BT_APPEND) && (leaf != NULL || !btree_is_last(mp))) {
+      errno = ERANGE;
+      rc = BT_FAIL;
+      goto done;
+    }
     if (leaf && exact) {
+      if (F_ISSET(flags, BT_NOOVERWRITE)) {
+        errno = EEXIST;
+        rc = BT_FAIL;
+        goto done;
+      }
       btree_del_node(bt, mp, ki);
+      replaced = 1;
     }
     if (leaf == NULL) { /* append if not found */
       ki = NUMKEYS(mp);
@@ -2496,16 +3376,20 @@ int btree_txn_put(struct btree *bt, struct btree_txn *txn, struct btval *key,
   xkey.size = key->size;
 
   if (SIZELEFT(mp) < bt_leaf_size(bt, key, data)) {
-    rc = btree_split(bt, &mp, &ki, &xkey, data, P_INVALID);
+    rc = btree_split(bt, &mp, &ki, &xkey, data, P_INVALID, flags);
   } else {
     /* There is room already in this leaf page. */
     remove_prefix(bt, &xkey, mp->prefix.len);
     rc = btree_add_node(bt, mp, ki, &xkey, data, 0, 0);
   }
 
+  if (rc == BT_SUCCESS && F_ISSET(flags, BT_RESERVE)) {
+    rc = btree_reserve(bt, txn, key, data);
+  }
+
   if (rc != BT_SUCCESS) {
     txn->flags |= BT_TXN_ERROR;
-  } else {
+  } else if (!replaced) {
     bt->meta.entries++;
   }
 
@@ -2521,8 +3405,27 @@ done:
   return rc;
 }
 
+/* Puts each of the n key/value pairs in turn, stopping at the first failure,
+ * whose index is stored in *failed.
+ */
+int btree_txn_put_many(struct btree *bt, struct btree_txn *txn,
+                       struct btval *keys, struct btval *data, size_t n,
+                       unsigned int flags, size_t *failed) {
+  size_t i;
+
+  for (i = 0; i < n; i++) {
+    if (btree_txn_put(bt, txn, &keys[i], &data[i], flags) != BT_SUCCESS) {
+      *failed = i;
+      return BT_FAIL;
+    }
+  }
+
+  return BT_SUCCESS;
+}
+
 static pgno_t btree_compact_tree(struct btree *bt, pgno_t pgno,
-                                 struct btree *btc) {
+                                 struct btree *btc,
+                                 struct compact_progress *cp) {
   ssize_t rc;
   indx_t i;
   pgno_t *pnext, next;
@@ -2530,14 +3433,22 @@ static pgno_t btree_compact_tree(struct btree *bt, pgno_t pgno,
   struct page *p;
   struct mpage *mp;
 
-  /* Get the page and make a copy of it. */
-  if ((mp = btree_get_mpage(bt, pgno)) == NULL) {
-    return P_INVALID;
-  }
+  /* Get the page and make a copy of it. The lock is only held while doing
+   * so, to let a backup run alongside writers.
+   */
   if ((p = malloc(bt->head.psize)) == NULL) {
     return P_INVALID;
   }
-  memmove(p, mp->page, bt->head.psize);
+  {
+    BT_ENTER(bt);
+
+    if ((mp = btree_get_mpage(bt, pgno)) == NULL) {
+      free(p);
+      return P_INVALID;
+    }
+    memmove(p, mp->page, bt->head.psize);
+    mpage_prune(bt);
+  }
 
   /* Go through all nodes in the (copied) page and update the
    * page pointers.
@@ -2545,7 +3456,7 @@ static pgno_t btree_compact_tree(struct btree *bt, pgno_t pgno,
   if (F_ISSET(p->flags, P_BRANCH)) {
     for (i = 0; i < NUMKEYSP(p); i++) {
       node = NODEPTRP(p, i);
-      node->n_pgno = btree_compact_tree(bt, node->n_pgno, btc);
+      node->n_pgno = btree_compact_tree(bt, node->n_pgno, btc, cp);
       if (node->n_pgno == P_INVALID) {
         free(p);
         return P_INVALID;
@@ -2556,7 +3467,7 @@ static pgno_t btree_compact_tree(struct btree *bt, pgno_t pgno,
       node = NODEPTRP(p, i);
       if (F_ISSET(node->flags, F_BIGDATA)) {
         memmove(&next, NODEDATA(node), sizeof(next));
-        next = btree_compact_tree(bt, next, btc);
+        next = btree_compact_tree(bt, next, btc, cp);
         if (next == P_INVALID) {
           free(p);
           return P_INVALID;
@@ -2567,7 +3478,7 @@ static pgno_t btree_compact_tree(struct btree *bt, pgno_t pgno,
   } else if (F_ISSET(p->flags, P_OVERFLOW)) {
     pnext = &p->p_next_pgno;
     if (*pnext > 0) {
-      *pnext = btree_compact_tree(bt, *pnext, btc);
+      *pnext = btree_compact_tree(bt, *pnext, btc, cp);
       if (*pnext == P_INVALID) {
         free(p);
         return P_INVALID;
@@ -2581,17 +3492,34 @@ static pgno_t btree_compact_tree(struct btree *bt, pgno_t pgno,
   if (rc != (ssize_t)bt->head.psize) {
     return P_INVALID;
   }
-  mpage_prune(bt);
+
+  if (++cp->copied % BT_PROGRESS_PAGES == 0 && cp->fn != NULL) {
+    /* The page counts in the meta page are only a guide. */
+    cp->fn(cp->copied, cp->copied > cp->total ? cp->copied : cp->total,
+           cp->ctx);
+  }
+
   return pgno;
 }
 
 int btree_compact(struct btree *bt) {
+  return btree_compact_progress(bt, NULL, NULL);
+}
+
+/* Like btree_compact, but calls progress, if not NULL, every
+ * BT_PROGRESS_PAGES pages copied and once more when the tree has been
+ * copied, with the number of pages copied and the number to copy.
+ */
+int btree_compact_progress(struct btree *bt, bt_progress_func progress,
+                           void *ctx) {
   char *compact_path = NULL;
   size_t compact_path_size;
   struct btree *btc;
   struct btree_txn *txn, *txnc = NULL;
+  struct compact_progress cp;
   int fd;
   pgno_t root;
+  BT_ENTER(bt);
 
   if (bt->path == NULL) {
     errno = EINVAL;
@@ -2616,9 +3544,11 @@ int btree_compact(struct btree *bt) {
     return BT_FAIL;
   }
 
-  if ((btc = btree_open_fd(fd, 0)) == NULL) {
+  if ((btc = btree_open_fd(fd, bt->flags & BT_CASEFOLD, bt->head.psize)) ==
+      NULL) {
     goto failed;
   }
+  btree_set_cmp(btc, bt->cmp, bt->cmp_ctx);
   memmove(&btc->meta, &bt->meta, sizeof(bt->meta));
   btc->meta.revisions = 0;
 
@@ -2626,8 +3556,14 @@ int btree_compact(struct btree *bt) {
     goto failed;
   }
 
+  memset(&cp, 0, sizeof(cp));
+  cp.fn = progress;
+  cp.ctx = ctx;
+  cp.total = (uint64_t)bt->meta.branch_pages + bt->meta.leaf_pages +
+             bt->meta.overflow_pages;
+
   if (bt->meta.root != P_INVALID) {
-    root = btree_compact_tree(bt, bt->meta.root, btc);
+    root = btree_compact_tree(bt, bt->meta.root, btc, &cp);
     if (root == P_INVALID) {
       goto failed;
     }
@@ -2636,6 +3572,10 @@ int btree_compact(struct btree *bt) {
     }
   }
 
+  if (progress != NULL) {
+    progress(cp.copied, cp.copied, ctx);
+  }
+
   fsync(fd);
 
   if (rename(compact_path, bt->path) != 0) {
@@ -2648,6 +3588,10 @@ int btree_compact(struct btree *bt) {
   if (btree_write_meta(bt, P_INVALID, BT_TOMBSTONE) != BT_SUCCESS) {
     goto failed;
   }
+  /* Keep the tombstone in bt->meta, which aborting would otherwise undo, so
+   * this handle's next transaction fails with ESTALE too.
+   */
+  txn->flags |= BT_TXN_COMMITTED;
 
   btree_txn_abort(txn);
   btree_txn_abort(txnc);
@@ -2666,6 +3610,392 @@ failed:
   return BT_FAIL;
 }
 
+/* Writes the revision txn reads to a new file at path, copying only the pages
+ * reachable from its root as btree_compact does. The copy is written to a
+ * temporary file beside path and renamed into place once synced, so path
+ * either holds a complete backup or is left as it was. The lock on bt is only
+ * taken a page at a time, so writes carry on meanwhile, which is safe as they
+ * never touch the pages of an earlier revision.
+ */
+int btree_txn_backup(struct btree_txn *txn, const char *path) {
+  struct btree *bt = txn->bt;
+  char *backup_path = NULL;
+  size_t backup_path_size;
+  struct btree *btc = NULL;
+  struct btree_txn *txnc = NULL;
+  struct compact_progress cp;
+  struct mpage *mp;
+  int fd, err;
+  pgno_t root;
+
+  backup_path_size = strlen(path) + strlen(".backup.XXXXXX") + 1;
+  if ((backup_path = malloc(backup_path_size)) == NULL) {
+    return BT_FAIL;
+  }
+  snprintf(backup_path, backup_path_size, "%s.backup.XXXXXX", path);
+
+  fd = mkstemp(backup_path);
+  if (fd == -1) {
+    free(backup_path);
+    return BT_FAIL;
+  }
+
+  if ((btc = btree_open_fd(fd, btree_get_flags(bt) & BT_CASEFOLD,
+                           bt->head.psize)) == NULL) {
+    close(fd);
+    goto failed;
+  }
+  btree_set_cmp(btc, bt->cmp, bt->cmp_ctx);
+
+  if (txn->meta_pgno != 0) {
+    BT_ENTER(bt);
+
+    if ((mp = btree_get_mpage(bt, txn->meta_pgno)) == NULL) {
+      goto failed;
+    }
+    if (!btree_is_meta_page(mp->page)) {
+      errno = EBADMSG;
+      goto failed;
+    }
+    memmove(&btc->meta, METADATA(mp->page), sizeof(btc->meta));
+    btc->meta.revisions = 0;
+  }
+
+  if ((txnc = btree_txn_begin(btc, 0)) == NULL) {
+    goto failed;
+  }
+
+  memset(&cp, 0, sizeof(cp));
+
+  if (txn->root != P_INVALID) {
+    root = btree_compact_tree(bt, txn->root, btc, &cp);
+    if (root == P_INVALID) {
+      goto failed;
+    }
+    if (btree_write_meta(btc, root, 0) != BT_SUCCESS) {
+      goto failed;
+    }
+  }
+
+  if (fsync(btc->fd) != 0 || rename(backup_path, path) != 0) {
+    goto failed;
+  }
+
+  btree_txn_abort(txnc);
+  btree_close(btc);
+  free(backup_path);
+  return BT_SUCCESS;
+
+failed:
+  /* Preserve the cause for the caller. */
+  err = errno;
+  btree_txn_abort(txnc);
+  btree_close(btc);
+  unlink(backup_path);
+  free(backup_path);
+  errno = err;
+  return BT_FAIL;
+}
+
 void btree_set_cache_size(struct btree *bt, unsigned int cache_size) {
+  BT_ENTER(bt);
+
   bt->max_cache = cache_size;
-}
\ No newline at end of file
+}
+
+/* Take an exclusive flock on the file, failing with EWOULDBLOCK if another
+ * handle holds one, and keep it until the handle is closed. Write
+ * transactions then neither take nor release one of their own.
+ */
+int btree_lock(struct btree *bt) {
+  BT_ENTER(bt);
+
+  if (flock(bt->fd, LOCK_EX | LOCK_NB) != 0) {
+    return BT_FAIL;
+  }
+  bt->flags |= BT_LOCKED;
+
+  return BT_SUCCESS;
+}
+
+/* Turn the fsync on commit on or off, as BT_NOSYNC does at open. */
+void btree_set_sync(struct btree *bt, int enabled) {
+  BT_ENTER(bt);
+
+  if (enabled) {
+    bt->flags &= ~BT_NOSYNC;
+  } else {
+    bt->flags |= BT_NOSYNC;
+  }
+}
+
+/* Order keys with cmp instead of bytewise. It must be set before the first
+ * transaction, and every time the file is opened, as the order is not recorded
+ * in the file. Separators are not shortened, since a truncated key need not
+ * sort between its neighbours in an arbitrary order.
+ */
+void btree_set_cmp(struct btree *bt, bt_cmp_func cmp, void *ctx) {
+  BT_ENTER(bt);
+
+  bt->cmp = cmp;
+  bt->cmp_ctx = ctx;
+}
+
+struct btree_cache_pool *btree_cache_pool_new(size_t max) {
+  struct btree_cache_pool *pool;
+
+  if ((pool = calloc(1, sizeof(*pool))) == NULL) {
+    return NULL;
+  }
+  pool->max = max;
+
+  return pool;
+}
+
+void btree_cache_pool_free(struct btree_cache_pool *pool) { free(pool); }
+
+size_t btree_cache_pool_size(struct btree_cache_pool *pool) {
+  return __atomic_load_n(&pool->size, __ATOMIC_RELAXED);
+}
+
+/* Makes bt count its cache against pool instead of its own max_cache. When
+ * the pool is over budget, a btree evicts its own least recently used pages,
+ * so the btrees doing the most work are the ones that give up memory.
+ */
+void btree_set_cache_pool(struct btree *bt, struct btree_cache_pool *pool) {
+  size_t cached = (size_t)bt->cache_size * bt->head.psize;
+  BT_ENTER(bt);
+
+  if (bt->pool != NULL) {
+    __atomic_sub_fetch(&bt->pool->size, cached, __ATOMIC_RELAXED);
+  }
+  bt->pool = pool;
+  if (bt->pool != NULL) {
+    __atomic_add_fetch(&bt->pool->size, cached, __ATOMIC_RELAXED);
+  }
+
+  mpage_prune(bt);
+}
+
+/* Returns the root page of the tree as seen by txn, or 0 if it is empty. */
+pgno_t btree_txn_root(struct btree_txn *txn) {
+  if (txn->root == P_INVALID) {
+    return 0;
+  }
+
+  return txn->root;
+}
+
+int btree_page_info(struct btree *bt, pgno_t pgno,
+                    struct btree_page_info *info) {
+  struct mpage *mp;
+  BT_ENTER(bt);
+
+  if ((mp = btree_get_mpage(bt, pgno)) == NULL) {
+    return BT_FAIL;
+  }
+
+  memset(info, 0, sizeof(*info));
+  info->pgno = pgno;
+  info->capacity = bt->head.psize - PAGEHDRSZ;
+
+  if (IS_BRANCH(mp) || IS_LEAF(mp)) {
+    info->type = IS_BRANCH(mp) ? BT_PAGE_BRANCH : BT_PAGE_LEAF;
+    info->nkeys = NUMKEYS(mp);
+    info->used = info->capacity - SIZELEFT(mp);
+  } else if (IS_OVERFLOW(mp)) {
+    info->type = BT_PAGE_OVERFLOW;
+    info->used = info->capacity;
+    info->next_pgno = mp->page->p_next_pgno;
+  } else if (F_ISSET(mp->page->flags, P_META)) {
+    info->type = BT_PAGE_META;
+    info->used = sizeof(struct bt_meta);
+  } else if (F_ISSET(mp->page->flags, P_HEAD)) {
+    info->type = BT_PAGE_HEAD;
+    info->used = sizeof(struct bt_head);
+  } else {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
+  mpage_prune(bt);
+  return BT_SUCCESS;
+}
+
+int btree_page_node(struct btree *bt, pgno_t pgno, unsigned int indx,
+                    struct btree_node_info *info) {
+  struct mpage *mp;
+  struct node *node;
+  BT_ENTER(bt);
+
+  if ((mp = btree_get_mpage(bt, pgno)) == NULL) {
+    return BT_FAIL;
+  }
+
+  if ((!IS_BRANCH(mp) && !IS_LEAF(mp)) || indx >= NUMKEYS(mp)) {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
+  memset(info, 0, sizeof(*info));
+  node = NODEPTR(mp, indx);
+  info->key.data = NODEKEY(node);
+  info->key.size = node->ksize;
+  info->key.mp = mp;
+  __atomic_add_fetch(&mp->ref, 1, __ATOMIC_RELAXED);
+
+  if (IS_BRANCH(mp)) {
+    info->pgno = NODEPGNO(node);
+  } else {
+    info->dsize = NODEDSZ(node);
+    if (F_ISSET(node->flags, F_BIGDATA)) {
+      memmove(&info->pgno, NODEDATA(node), sizeof(info->pgno));
+    }
+  }
+
+  return BT_SUCCESS;
+}
+
+uint32_t btree_txn_revision(struct btree_txn *txn) { return txn->revision; }
+
+/* Returns the size the file will grow to if txn is committed now. */
+uint64_t btree_txn_size(struct btree_txn *txn) {
+  return (uint64_t)(txn->next_pgno + 1) * txn->bt->head.psize;
+}
+
+/* Moves a read-only txn back to the commit before the one it currently sees,
+ * by scanning backwards for the previous valid meta page. Fails with ENOENT
+ * once there is no earlier commit left in the file.
+ */
+int btree_txn_prev(struct btree_txn *txn) {
+  struct btree *bt = txn->bt;
+  struct mpage *mp;
+  struct bt_meta *meta;
+  pgno_t pgno;
+  int rc = BT_FAIL;
+  BT_ENTER(bt);
+
+  if (!F_ISSET(txn->flags, BT_TXN_RDONLY)) {
+    errno = EINVAL;
+    return BT_FAIL;
+  }
+
+  errno = ENOENT;
+  for (pgno = txn->meta_pgno; pgno > 1;) {
+    --pgno;
+    if ((mp = btree_get_mpage(bt, pgno)) == NULL ||
+        !btree_is_meta_page(mp->page)) {
+      continue;
+    }
+
+    meta = METADATA(mp->page);
+    txn->root = meta->root;
+    txn->meta_pgno = pgno;
+    txn->revision = meta->revisions;
+    rc = BT_SUCCESS;
+    break;
+  }
+
+  if (rc != BT_SUCCESS) {
+    errno = ENOENT;
+  }
+  mpage_prune(bt);
+  return rc;
+}
+
+/* Fills stat from the meta page txn reads from, after checking its hash
+ * again. Fails with EBADMSG if it is no longer a valid meta page.
+ */
+int btree_txn_stat(struct btree_txn *txn, struct btree_stat *stat) {
+  struct btree *bt = txn->bt;
+  struct mpage *mp;
+  struct bt_meta *meta;
+  BT_ENTER(bt);
+
+  memset(stat, 0, sizeof(*stat));
+  stat->psize = bt->head.psize;
+  stat->file_pages = txn->meta_pgno + 1;
+  if (txn->meta_pgno == 0) {
+    return BT_SUCCESS;
+  }
+
+  if ((mp = btree_get_mpage(bt, txn->meta_pgno)) == NULL) {
+    return BT_FAIL;
+  }
+  if (!btree_is_meta_page(mp->page)) {
+    errno = EBADMSG;
+    mpage_prune(bt);
+    return BT_FAIL;
+  }
+
+  meta = METADATA(mp->page);
+  stat->depth = meta->depth;
+  stat->entries = meta->entries;
+  stat->branch_pages = meta->branch_pages;
+  stat->leaf_pages = meta->leaf_pages;
+  stat->overflow_pages = meta->overflow_pages;
+  stat->revisions = meta->revisions;
+  stat->created_at = meta->created_at;
+
+  mpage_prune(bt);
+  return BT_SUCCESS;
+}
+
+/* Sets chunk to the part of an overflow value stored on page pgno, given that
+ * remaining bytes of the value are still to be read. The chunk references the
+ * page, and *next is set to the page holding the rest of the value.
+ */
+int btree_read_overflow(struct btree *bt, uint32_t pgno, size_t remaining,
+                        struct btval *chunk, uint32_t *next) {
+  struct mpage *mp;
+  size_t max = bt->head.psize - PAGEHDRSZ;
+  BT_ENTER(bt);
+
+  if ((mp = btree_get_mpage(bt, pgno)) == NULL) {
+    return BT_FAIL;
+  }
+
+  if (!IS_OVERFLOW(mp)) {
+    errno = EBADMSG;
+    return BT_FAIL;
+  }
+
+  memset(chunk, 0, sizeof(*chunk));
+  chunk->data = mp->page->ptrs;
+  chunk->size = remaining < max ? remaining : max;
+  chunk->mp = mp;
+  __atomic_add_fetch(&mp->ref, 1, __ATOMIC_RELAXED);
+  *next = mp->page->p_next_pgno;
+
+  mpage_prune(bt);
+  return BT_SUCCESS;
+}
+
+int btree_stat(struct btree *bt, struct btree_stat *stat) {
+  BT_ENTER(bt);
+
+  /* Pick up commits made through other handles. */
+  if (btree_read_meta(bt, NULL) != BT_SUCCESS) {
+    return BT_FAIL;
+  }
+
+  btree_stat_cached(bt, stat);
+  return BT_SUCCESS;
+}
+
+/* Like btree_stat, but as of the meta page last read or written through bt,
+ * without reading the file.
+ */
+void btree_stat_cached(struct btree *bt, struct btree_stat *stat) {
+  BT_ENTER(bt);
+
+  stat->psize = bt->head.psize;
+  stat->depth = bt->meta.depth;
+  stat->entries = bt->meta.entries;
+  stat->branch_pages = bt->meta.branch_pages;
+  stat->leaf_pages = bt->meta.leaf_pages;
+  stat->overflow_pages = bt->meta.overflow_pages;
+  stat->revisions = bt->meta.revisions;
+  stat->file_pages = bt->size / bt->head.psize;
+  stat->created_at = bt->meta.created_at;
+}
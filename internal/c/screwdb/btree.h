@@ -34,6 +34,7 @@
 #ifndef _btree_h_
 #define _btree_h_
 
+#include <stdint.h>
 #include <sys/types.h>
 
 struct mpage;
@@ -47,49 +48,140 @@ struct btval {
   struct mpage *mp; /* ref'd memory page */
 };
 
-typedef int (*bt_cmp_func)(const struct btval *a, const struct btval *b);
+typedef int (*bt_cmp_func)(const struct btval *a, const struct btval *b,
+                           void *ctx);
 typedef void (*bt_prefix_func)(const struct btval *a, const struct btval *b,
                                struct btval *sep);
+typedef void (*bt_progress_func)(uint64_t copied, uint64_t total, void *ctx);
 
 enum cursor_op {
   BT_CURSOR,       /* cursor operations */
   BT_CURSOR_EXACT, /* position at given key */
   BT_FIRST,        /* position at key, or fail */
-  BT_NEXT
+  BT_NEXT,
+  BT_CURRENT, /* return the entry at the current position */
+  BT_LAST,
+  BT_PREV
 };
 
-/* return codes */
+/* return codes, errno is set on failure: EBADMSG if the file is corrupt */
 #define BT_FAIL -1
 #define BT_SUCCESS 0
 
 /* btree flags */
 #define BT_NOSYNC 0x02 /* don't fsync after commit */
 #define BT_RDONLY 0x04 /* read only */
+#define BT_CASEFOLD 0x08 /* case insensitive ASCII key order */
 
-struct btree *btree_open(const char *path, unsigned int flags, mode_t mode);
-void btree_close(struct btree *bt);
+/* put flags */
+#define BT_NOOVERWRITE 0x01 /* fail with EEXIST if the key exists */
+#define BT_APPEND 0x02 /* key sorts last, fail with ERANGE otherwise */
+#define BT_RESERVE 0x04 /* zero the value and point data at it to fill in */
+
+struct btree *btree_open_fd(int fd, unsigned int flags, unsigned int psize);
+struct btree *btree_open(const char *path, unsigned int flags, mode_t mode,
+                         unsigned int psize);
+int btree_close(struct btree *bt);
 
 struct btree_txn *btree_txn_begin(struct btree *bt, int rdonly);
 int btree_txn_commit(struct btree_txn *txn);
 void btree_txn_abort(struct btree_txn *txn);
+int btree_txn_savepoint(struct btree_txn *txn);
+int btree_txn_rollback(struct btree_txn *txn);
+int btree_txn_release(struct btree_txn *txn);
 
 int btree_txn_get(struct btree *bt, struct btree_txn *txn, struct btval *key,
                   struct btval *data);
+int btree_txn_exists(struct btree *bt, struct btree_txn *txn,
+                     struct btval *keys, size_t n, int *found);
+int btree_txn_get_lazy(struct btree *bt, struct btree_txn *txn,
+                       struct btval *key, struct btval *data, uint32_t *pgno);
+int btree_read_overflow(struct btree *bt, uint32_t pgno, size_t remaining,
+                        struct btval *chunk, uint32_t *next);
 int btree_txn_put(struct btree *bt, struct btree_txn *txn, struct btval *key,
-                  struct btval *data);
+                  struct btval *data, unsigned int flags);
+int btree_txn_put_many(struct btree *bt, struct btree_txn *txn,
+                       struct btval *keys, struct btval *data, size_t n,
+                       unsigned int flags, size_t *failed);
 int btree_txn_del(struct btree *bt, struct btree_txn *txn, struct btval *key,
                   struct btval *data);
 
 void btree_set_cache_size(struct btree *bt, unsigned int cache_size);
+void btree_set_sync(struct btree *bt, int enabled);
+int btree_lock(struct btree *bt);
+void btree_set_cmp(struct btree *bt, bt_cmp_func cmp, void *ctx);
+
+struct btree_cache_pool;
+
+struct btree_cache_pool *btree_cache_pool_new(size_t max);
+void btree_cache_pool_free(struct btree_cache_pool *pool);
+size_t btree_cache_pool_size(struct btree_cache_pool *pool);
+void btree_set_cache_pool(struct btree *bt, struct btree_cache_pool *pool);
 
 struct cursor *btree_txn_cursor_open(struct btree *bt, struct btree_txn *txn);
 void btree_cursor_close(struct cursor *cursor);
 int btree_cursor_get(struct cursor *cursor, struct btval *key,
                      struct btval *data, enum cursor_op op);
+int btree_cursor_del(struct cursor *cursor);
+int btree_cursor_dsize(struct cursor *cursor, size_t *dsize);
+
+struct btree_stat {
+  unsigned int psize;
+  unsigned int depth;
+  uint64_t entries;
+  uint32_t branch_pages;
+  uint32_t leaf_pages;
+  uint32_t overflow_pages;
+  uint32_t revisions;
+  uint32_t file_pages; /* pages in the file, live or not */
+  time_t created_at;
+};
 
+int btree_stat(struct btree *bt, struct btree_stat *stat);
+void btree_stat_cached(struct btree *bt, struct btree_stat *stat);
 int btree_sync(struct btree *bt);
+int btree_get_fd(struct btree *bt);
+unsigned int btree_get_flags(struct btree *bt);
+unsigned int btree_get_maxkeysize(struct btree *bt);
 int btree_compact(struct btree *bt);
+int btree_txn_backup(struct btree_txn *txn, const char *path);
+int btree_compact_progress(struct btree *bt, bt_progress_func progress,
+                           void *ctx);
 
 int btree_cmp(struct btree *bt, const struct btval *a, const struct btval *b);
 
+void btval_reset(struct btval *btv);
+
+/* page types */
+#define BT_PAGE_HEAD 0
+#define BT_PAGE_META 1
+#define BT_PAGE_BRANCH 2
+#define BT_PAGE_LEAF 3
+#define BT_PAGE_OVERFLOW 4
+
+struct btree_page_info {
+  uint32_t pgno;
+  int type;           /* BT_PAGE_* */
+  unsigned int nkeys; /* number of nodes on branch and leaf pages */
+  size_t capacity;    /* bytes available for content */
+  size_t used;        /* bytes in use, overflow pages always appear full */
+  uint32_t next_pgno; /* next page in an overflow chain, or 0 */
+};
+
+struct btree_node_info {
+  struct btval key; /* as stored, without the page prefix */
+  uint32_t pgno;    /* child page, or first overflow page of a leaf, or 0 */
+  size_t dsize;     /* size of the data of a leaf node */
+};
+
+uint32_t btree_txn_root(struct btree_txn *txn);
+uint32_t btree_txn_revision(struct btree_txn *txn);
+uint64_t btree_txn_size(struct btree_txn *txn);
+int btree_txn_prev(struct btree_txn *txn);
+int btree_txn_stat(struct btree_txn *txn, struct btree_stat *stat);
+int btree_page_info(struct btree *bt, uint32_t pgno,
+                    struct btree_page_info *info);
+int btree_page_node(struct btree *bt, uint32_t pgno, unsigned int indx,
+                    struct btree_node_info *info);
+
 #endif
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import "runtime"
+
+// CachePool is a page cache budget shared by several databases, capping
+// their combined native memory use no matter how many are open.
+//
+// Each database still caches its own pages. Whenever the pool is over budget
+// a database evicts its own least recently used pages, so memory shifts
+// towards the busiest databases, while idle ones keep whatever they had
+// cached until they next do some work. Pages in use by a cursor or an
+// uncommitted write can't be evicted, so the budget may briefly be exceeded.
+type CachePool struct {
+	pool *C.struct_btree_cache_pool
+}
+
+// NewCachePool returns a pool that caps the combined cache of the databases
+// opened with it at bytes.
+func NewCachePool(bytes uint) *CachePool {
+	p := &CachePool{pool: C.btree_cache_pool_new(C.size_t(bytes))}
+	if p.pool == nil {
+		panic("screwdb: out of memory")
+	}
+
+	runtime.SetFinalizer(p, func(p *CachePool) {
+		C.btree_cache_pool_free(p.pool)
+	})
+
+	return p
+}
+
+// Size returns the number of bytes currently cached by all the databases
+// using the pool.
+func (p *CachePool) Size() uint {
+	size := uint(C.btree_cache_pool_size(p.pool))
+	runtime.KeepAlive(p)
+
+	return size
+}
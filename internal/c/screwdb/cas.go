@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"bytes"
+	"errors"
+)
+
+// CompareAndSwap sets key to newValue if its current value is expectedOld,
+// and reports whether it did. A nil expectedOld means the key must not exist,
+// whereas an empty one matches a key holding an empty value. As with any other
+// read and write in a write transaction, no other commit can change key in
+// between.
+func (tx *Tx) CompareAndSwap(key, expectedOld, newValue []byte) (bool, error) {
+	value, err := tx.Get(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return false, err
+	}
+
+	if exists := err == nil; exists != (expectedOld != nil) || !bytes.Equal(value, expectedOld) {
+		return false, nil
+	}
+
+	if err := tx.Put(key, newValue, true); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DeleteIf removes key if its current value is expectedValue, and reports
+// whether it did. A missing key is not an error, it just isn't deleted.
+func (tx *Tx) DeleteIf(key, expectedValue []byte) (bool, error) {
+	value, err := tx.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if !bytes.Equal(value, expectedValue) {
+		return false, nil
+	}
+
+	if err := tx.Delete(key); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
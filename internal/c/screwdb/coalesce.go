@@ -0,0 +1,205 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type coalescer struct {
+	window time.Duration
+	// flushMu is held by Flush, so only one batch is being committed at a
+	// time.
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string][]byte
+	since   time.Time
+	// timer flushes pending once the window has passed since the first put.
+	timer *time.Timer
+	// flushing is the batch Flush is committing, which Get still returns
+	// until the commit succeeds.
+	flushing map[string][]byte
+}
+
+// buffer starts a new batch if there isn't one, along with the timer that
+// flushes it. It must be called with mu held.
+func (c *coalescer) buffer(db *DB) {
+	if c.pending != nil {
+		return
+	}
+
+	c.pending = make(map[string][]byte)
+	c.since = time.Now()
+	c.timer = time.AfterFunc(c.window, func() {
+		if err := db.Flush(); err != nil && !errors.Is(err, ErrClosed) {
+			slog.Warn("screwdb: flushing buffered puts failed", slog.String("path", db.path), slog.Any("error", err))
+		}
+	})
+}
+
+// take removes the pending batch, stopping its timer. It must be called with
+// mu held.
+func (c *coalescer) take() map[string][]byte {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	pending := c.pending
+	c.pending = nil
+
+	return pending
+}
+
+// discard drops any puts still buffered, for Close.
+func (c *coalescer) discard() {
+	c.mu.Lock()
+	c.take()
+	c.mu.Unlock()
+}
+
+// Put sets the value of key in its own transaction, or if the database was
+// opened WithCoalesceWindow, buffers it to be committed along with other puts.
+func (db *DB) Put(key, value []byte) error {
+	if db.coalesce == nil {
+		return db.Update(func(tx *Tx) error {
+			return tx.Put(key, value, true)
+		})
+	}
+
+	// Checked now, as once buffered a put that can't be committed would fail
+	// the flush of every other put along with it.
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if err := db.checkKeySize(key); err != nil {
+		return err
+	}
+
+	if db.bt == nil {
+		return ErrClosed
+	}
+
+	if db.flags&ReadOnly != 0 {
+		return ErrReadOnly
+	}
+
+	c := db.coalesce
+	c.mu.Lock()
+	c.buffer(db)
+	c.pending[string(key)] = bytes.Clone(value)
+	due := time.Since(c.since) >= c.window
+	c.mu.Unlock()
+
+	if due {
+		return db.Flush()
+	}
+
+	return nil
+}
+
+// Get returns a copy of the value of key, including any value buffered by Put
+// that hasn't been flushed yet.
+func (db *DB) Get(key []byte) (value []byte, err error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	if c := db.coalesce; c != nil {
+		c.mu.Lock()
+		value, ok := c.pending[string(key)]
+		if !ok {
+			value, ok = c.flushing[string(key)]
+		}
+		due := c.pending != nil && time.Since(c.since) >= c.window
+		c.mu.Unlock()
+
+		if ok {
+			return bytes.Clone(value), nil
+		}
+
+		if due {
+			if err := db.Flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = db.View(func(tx *Tx) error {
+		value, err = tx.get(key)
+		return err
+	})
+
+	return value, err
+}
+
+// Flush commits any puts buffered by WithCoalesceWindow in one transaction.
+// Get goes on returning the puts until they are committed. If that fails in a
+// way that retrying can fix, as for UpdateRetry, the puts stay buffered, unless
+// they have since been replaced, to be flushed again. Otherwise they are
+// dropped and the error is returned.
+func (db *DB) Flush() error {
+	c := db.coalesce
+	if c == nil {
+		return nil
+	}
+
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	pending := c.take()
+	c.flushing = pending
+	c.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := db.tracedUpdate(context.Background(), "screwdb.Flush", func(tx *Tx) error {
+		for key, value := range pending {
+			if err := tx.Put([]byte(key), value, true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flushing = nil
+	if err != nil && retryable(err) {
+		c.buffer(db)
+		for key, value := range pending {
+			if _, ok := c.pending[key]; !ok {
+				c.pending[key] = value
+			}
+		}
+	}
+
+	return err
+}
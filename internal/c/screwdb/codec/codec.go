@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package codec provides ready-made screwdb.Codec implementations, kept
+// apart from screwdb so that it doesn't depend on encoding/gob and
+// encoding/json.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/dpeckett/screwdb/internal/c/screwdb"
+)
+
+// GobCodec returns a codec that stores values of type T with encoding/gob.
+// Each value carries its own type description, so it decodes on its own, at
+// the cost of some space. Gob encodings don't sort meaningfully, so it is
+// only suited to values.
+func GobCodec[T any]() screwdb.Codec[T] {
+	return gobCodec[T]{}
+}
+
+type gobCodec[T any] struct{}
+
+func (gobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+
+	return v, err
+}
+
+// JSONCodec returns a codec that stores values of type T with encoding/json.
+// As with GobCodec, it is only suited to values.
+func JSONCodec[T any]() screwdb.Codec[T] {
+	return jsonCodec[T]{}
+}
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+
+	return v, err
+}
+
+// BigEndianUint64Codec stores integers as 8 big-endian bytes, so that keys
+// sort numerically under the default bytewise order. Little-endian keys
+// don't: 256 is stored as 00 01 ... and sorts before 1. It is
+// screwdb.Uint64Codec under a name that says so.
+type BigEndianUint64Codec = screwdb.Uint64Codec
@@ -0,0 +1,56 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include <stdint.h>
+// #include "btree.h"
+// int screwdb_compact_progress(struct btree *bt, uintptr_t handle);
+import "C"
+import (
+	"fmt"
+	"runtime/cgo"
+)
+
+// CompactProgress is like Compact, but calls fn as it goes with the number of
+// pages copied to the new file so far and the number it will hold, and once
+// more when every page has been copied, before the new file replaces the old
+// one. It is called every few hundred pages, from the goroutine calling
+// CompactProgress, and must not call back into the database.
+func (db *DB) CompactProgress(fn func(copied, total uint64)) error {
+	if db.bt == nil {
+		return ErrClosed
+	}
+
+	handle := cgo.NewHandle(fn)
+	defer handle.Delete()
+
+	rc, err := C.screwdb_compact_progress(db.bt, C.uintptr_t(handle))
+	if rc != 0 {
+		return fmt.Errorf("compact failed: %w", errnoError(err))
+	}
+
+	db.compacted()
+
+	return nil
+}
+
+//export screwdbCompactProgress
+func screwdbCompactProgress(copied, total C.uint64_t, handle C.uintptr_t) {
+	fn := cgo.Handle(handle).Value().(func(copied, total uint64))
+	fn(uint64(copied), uint64(total))
+}
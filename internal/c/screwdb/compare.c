@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+#include <stdint.h>
+
+#include "_cgo_export.h"
+#include "btree.h"
+
+static int compare(const struct btval *a, const struct btval *b, void *ctx) {
+  return screwdbCompare((struct btval *)a, (struct btval *)b, (uintptr_t)ctx);
+}
+
+void screwdb_set_compare(struct btree *bt, uintptr_t handle) {
+  btree_set_cmp(bt, compare, (void *)handle);
+}
@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include <stdint.h>
+// #include "btree.h"
+// void screwdb_set_compare(struct btree *bt, uintptr_t handle);
+import "C"
+import "runtime/cgo"
+
+// WithCompare orders keys with compare, which returns a negative number, zero
+// or a positive number if a sorts before, the same as, or after b, instead of
+// bytewise. The order isn't recorded in the file, so every open of the
+// database must use the same function, or lookups will silently fail. The
+// function is called from C for every key comparison, so it should be cheap,
+// must not retain a or b, and must not call back into the database. It also
+// sees the keys used internally by SetMeta, which begin with a zero byte, and
+// the prefixes passed to prefix scans such as ListChildren, which only make
+// sense if keys sharing a prefix sort together.
+func WithCompare(compare func(a, b []byte) int) Option {
+	return func(o *options) {
+		o.compare = compare
+	}
+}
+
+// setCompare makes the btree order keys with db.compare. The handle is made
+// once and shared by every btree reopen opens, as transactions still running
+// on the old one go on comparing through it.
+func (db *DB) setCompare() {
+	if db.compareHandle == 0 {
+		db.compareHandle = cgo.NewHandle(db.compare)
+	}
+	C.screwdb_set_compare(db.bt, C.uintptr_t(db.compareHandle))
+}
+
+//export screwdbCompare
+func screwdbCompare(a, b *C.struct_btval, handle C.uintptr_t) C.int {
+	compare := cgo.Handle(handle).Value().(func(a, b []byte) int)
+
+	// Clamp, as converting a large result to a C int could flip its sign.
+	return C.int(min(max(compare(view(a), view(b)), -1), 1))
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// IncrementMany adds each delta to the int64 counter stored under its key and
+// returns the new totals. Counters are stored as 8-byte little-endian values
+// and a missing key counts as zero. Keys are updated in sorted order, and as
+// they share the transaction either every counter is updated or none are.
+func (tx *Tx) IncrementMany(deltas map[string]int64) (map[string]int64, error) {
+	totals := make(map[string]int64, len(deltas))
+	for _, key := range slices.Sorted(maps.Keys(deltas)) {
+		total, err := tx.Increment([]byte(key), deltas[key])
+		if err != nil {
+			return nil, err
+		}
+
+		totals[key] = int64(total)
+	}
+
+	return totals, nil
+}
+
+// GetAndReset returns the value of the int64 counter stored under key and
+// resets it to zero within the same transaction, so no increment made in
+// between can be lost. A missing counter is left missing and reads as zero.
+func (tx *Tx) GetAndReset(key []byte) (prior int64, err error) {
+	value, err := tx.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if len(value) != 8 {
+		return 0, fmt.Errorf("counter %q is %d bytes, expected 8", key, len(value))
+	}
+
+	// Decoded before the Put, which may overwrite a value read
+	// WithZeroCopyReads.
+	prior = int64(binary.LittleEndian.Uint64(value))
+
+	if err := tx.Put(key, make([]byte, 8), true); err != nil {
+		return 0, err
+	}
+
+	return prior, nil
+}
+
+// Increment adds delta to the counter stored under key, an 8-byte
+// little-endian value, and returns the new total. A missing key counts as
+// zero. The read and the write happen in the same transaction, so concurrent
+// increments are never lost.
+func (tx *Tx) Increment(key []byte, delta int64) (uint64, error) {
+	var total uint64
+
+	value, err := tx.Get(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return 0, err
+	} else if err == nil {
+		if len(value) != 8 {
+			return 0, fmt.Errorf("counter %q is %d bytes, expected 8", key, len(value))
+		}
+
+		total = binary.LittleEndian.Uint64(value)
+	}
+
+	total += uint64(delta)
+
+	if err := tx.Put(key, binary.LittleEndian.AppendUint64(nil, total), true); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
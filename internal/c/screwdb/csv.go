@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportCSV writes every entry to w as a CSV record made by encode, in
+// ascending key order, from a single read transaction. The key and value
+// passed to encode alias the btree, so must not be retained. A nil encode
+// uses EncodeBase64Record. As with ExportSorted, metadata set with SetMeta
+// isn't included.
+func (db *DB) ExportCSV(w io.Writer, encode func(k, v []byte) []string) error {
+	if encode == nil {
+		encode = EncodeBase64Record
+	}
+
+	cw := csv.NewWriter(w)
+
+	err := db.View(func(tx *Tx) error {
+		var err error
+		scanErr := tx.scan(nil, nil, func(key, value *C.struct_btval) bool {
+			err = cw.Write(encode(view(key), view(value)))
+			return err == nil
+		})
+		if err != nil {
+			return fmt.Errorf("export failed: %w", err)
+		}
+
+		return scanErr
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// ImportCSV reads CSV records from r, turns each into an entry with decode,
+// and puts them in a single write transaction, overwriting existing keys. If a
+// record can't be read or decoded, nothing is written. A nil decode uses
+// DecodeBase64Record.
+func (db *DB) ImportCSV(r io.Reader, decode func(record []string) (k, v []byte, err error)) error {
+	if decode == nil {
+		decode = DecodeBase64Record
+	}
+
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+
+	return db.Update(func(tx *Tx) error {
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("import failed: %w", err)
+			}
+
+			key, value, err := decode(record)
+			if err != nil {
+				line, _ := cr.FieldPos(0)
+				return fmt.Errorf("import failed: line %d: %w", line, err)
+			}
+
+			if err := tx.Put(key, value, true); err != nil {
+				return fmt.Errorf("import failed: %w", err)
+			}
+		}
+	})
+}
+
+// EncodeBase64Record makes a CSV record of the key and value, each encoded as
+// standard base64.
+func EncodeBase64Record(k, v []byte) []string {
+	return []string{base64.StdEncoding.EncodeToString(k), base64.StdEncoding.EncodeToString(v)}
+}
+
+// DecodeBase64Record decodes a record made by EncodeBase64Record.
+func DecodeBase64Record(record []string) (k, v []byte, err error) {
+	if len(record) != 2 {
+		return nil, nil, fmt.Errorf("record has %d fields, want 2", len(record))
+	}
+
+	if k, err = base64.StdEncoding.DecodeString(record[0]); err != nil {
+		return nil, nil, fmt.Errorf("decode key failed: %w", err)
+	}
+
+	if v, err = base64.StdEncoding.DecodeString(record[1]); err != nil {
+		return nil, nil, fmt.Errorf("decode value failed: %w", err)
+	}
+
+	return k, v, nil
+}
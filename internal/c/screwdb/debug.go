@@ -0,0 +1,206 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+var pageTypes = map[C.int]string{
+	C.BT_PAGE_HEAD:     "head",
+	C.BT_PAGE_META:     "meta",
+	C.BT_PAGE_BRANCH:   "branch",
+	C.BT_PAGE_LEAF:     "leaf",
+	C.BT_PAGE_OVERFLOW: "overflow",
+}
+
+// WalkTree calls fn for every page of the tree, in depth first order starting
+// from the root at level 0. The overflow pages holding a large value are
+// reported after the leaf that references them, one level below it. The walk
+// runs in its own read transaction and stops at the first error fn returns.
+func (db *DB) WalkTree(fn func(level int, pageNo uint64, pageType string, entries int, fillPct float64) error) error {
+	return db.View(func(tx *Tx) error {
+		root := C.btree_txn_root(tx.tx)
+		if root == 0 {
+			return nil
+		}
+
+		return tx.walk(root, 0, fn)
+	})
+}
+
+func (tx *Tx) walk(pgno C.uint32_t, level int, fn func(int, uint64, string, int, float64) error) error {
+	info, err := tx.pageInfo(pgno)
+	if err != nil {
+		return err
+	}
+
+	fillPct := 100 * float64(info.used) / float64(info.capacity)
+	if err := fn(level, uint64(pgno), pageTypes[info._type], int(info.nkeys), fillPct); err != nil {
+		return err
+	}
+
+	if info._type != C.BT_PAGE_BRANCH && info._type != C.BT_PAGE_LEAF {
+		return nil
+	}
+
+	for i := C.uint(0); i < info.nkeys; i++ {
+		var node C.struct_btree_node_info
+		rc, err := C.btree_page_node(tx.bt, pgno, i, &node)
+		if rc != 0 {
+			return fmt.Errorf("page node failed: %w", errnoError(err))
+		}
+		C.btval_reset(&node.key)
+
+		if node.pgno == 0 {
+			continue
+		}
+
+		if info._type == C.BT_PAGE_BRANCH {
+			err = tx.walk(node.pgno, level+1, fn)
+		} else {
+			err = tx.walkOverflow(node.pgno, uint64(node.dsize), level+1, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tx *Tx) walkOverflow(pgno C.uint32_t, size uint64, level int, fn func(int, uint64, string, int, float64) error) error {
+	for pgno != 0 {
+		info, err := tx.pageInfo(pgno)
+		if err != nil {
+			return err
+		}
+
+		if info._type != C.BT_PAGE_OVERFLOW {
+			return fmt.Errorf("page %d is not an overflow page", pgno)
+		}
+
+		used := min(size, uint64(info.capacity))
+		size -= used
+
+		if err := fn(level, uint64(pgno), pageTypes[info._type], 0, 100*float64(used)/float64(info.capacity)); err != nil {
+			return err
+		}
+
+		pgno = info.next_pgno
+	}
+
+	return nil
+}
+
+func (tx *Tx) pageInfo(pgno C.uint32_t) (*C.struct_btree_page_info, error) {
+	var info C.struct_btree_page_info
+	rc, err := C.btree_page_info(tx.bt, pgno, &info)
+	if rc != 0 {
+		return nil, fmt.Errorf("page info failed: %w", errnoError(err))
+	}
+
+	return &info, nil
+}
+
+// DumpPages writes a human readable description of every page in the file to
+// w, for diagnosing corruption: its number, type and free space, followed by
+// the keys on branch and leaf pages along with the page each one links to.
+// Keys are shown as stored, so without any prefix the page shares between
+// them. Pages of earlier revisions are included, and a page that isn't one of
+// any type is reported as invalid rather than failing the dump.
+func (db *DB) DumpPages(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	err := db.View(func(tx *Tx) error {
+		var st C.struct_btree_stat
+		rc, err := C.btree_txn_stat(tx.tx, &st)
+		if rc != 0 {
+			return fmt.Errorf("dump failed: %w", errnoError(err))
+		}
+
+		for pgno := C.uint32_t(0); pgno < C.uint32_t(st.file_pages); pgno++ {
+			if err := tx.dumpPage(bw, pgno); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// dumpPage describes page pgno. Errors writing to w are left for the caller to
+// pick up when it flushes.
+func (tx *Tx) dumpPage(w *bufio.Writer, pgno C.uint32_t) error {
+	info, err := tx.pageInfo(pgno)
+	if errors.Is(err, syscall.EINVAL) {
+		fmt.Fprintf(w, "page %d: invalid\n", pgno)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("page %d: %w", pgno, err)
+	}
+
+	fmt.Fprintf(w, "page %d: %s, %d bytes free", pgno, pageTypes[info._type], info.capacity-info.used)
+	switch info._type {
+	case C.BT_PAGE_BRANCH, C.BT_PAGE_LEAF:
+		fmt.Fprintf(w, ", %d keys", info.nkeys)
+	case C.BT_PAGE_OVERFLOW:
+		if info.next_pgno != 0 {
+			fmt.Fprintf(w, ", next page %d", info.next_pgno)
+		}
+	}
+	w.WriteByte('\n')
+
+	if info._type != C.BT_PAGE_BRANCH && info._type != C.BT_PAGE_LEAF {
+		return nil
+	}
+
+	for i := C.uint(0); i < info.nkeys; i++ {
+		var node C.struct_btree_node_info
+		rc, err := C.btree_page_node(tx.bt, pgno, i, &node)
+		if rc != 0 {
+			return fmt.Errorf("page node failed: %w", errnoError(err))
+		}
+
+		fmt.Fprintf(w, "  %q", view(&node.key))
+		C.btval_reset(&node.key)
+
+		switch {
+		case info._type == C.BT_PAGE_BRANCH:
+			fmt.Fprintf(w, " -> page %d", node.pgno)
+		case node.pgno != 0:
+			fmt.Fprintf(w, ", %d bytes on overflow page %d", node.dsize, node.pgno)
+		default:
+			fmt.Fprintf(w, ", %d bytes", node.dsize)
+		}
+		w.WriteByte('\n')
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Dump writes a snapshot of every entry to w, in key order, from a single
+// read transaction. Each entry is written as the key length as a uvarint, the
+// key, the value length as a uvarint, and the value, with nothing before the
+// first entry or after the last, so a dump of an empty database is empty. As
+// with ExportSorted, metadata set with SetMeta isn't included.
+func (db *DB) Dump(w io.Writer) error {
+	return db.ExportSorted(w, ExportVarintPrefixed)
+}
+
+// Load reads entries written by Dump from r and puts them in a single write
+// transaction, overwriting existing keys. If r is malformed or ends partway
+// through an entry, nothing is written.
+func (db *DB) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	return db.Update(func(tx *Tx) error {
+		var key, value bytes.Buffer
+		for {
+			if _, err := br.Peek(1); err == io.EOF {
+				return nil
+			}
+
+			key.Reset()
+			if err := readVarintPrefixed(br, &key, uint64(db.maxKeySize)); err != nil {
+				return fmt.Errorf("load failed: %w", err)
+			}
+
+			value.Reset()
+			if err := readVarintPrefixed(br, &value, 0); err != nil {
+				return fmt.Errorf("load failed: %w", err)
+			}
+
+			if err := tx.Put(key.Bytes(), value.Bytes(), true); err != nil {
+				return fmt.Errorf("load failed: %w", err)
+			}
+		}
+	})
+}
+
+// readVarintPrefixed reads a uvarint length and that many bytes into buf. A
+// non-zero limit rejects longer fields before reading them.
+func readVarintPrefixed(br *bufio.Reader, buf *bytes.Buffer, limit uint64) error {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if limit > 0 && n > limit {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLarge, n, limit)
+	}
+
+	// Copy rather than allocating n up front, so a corrupt length fails at the
+	// end of the stream rather than with a huge allocation.
+	if _, err := io.CopyN(buf, br, int64(n)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+var (
+	// ErrKeyNotFound is returned by Tx.Get when the key doesn't exist, and by
+	// cursor methods when there is no entry to return: the database is empty,
+	// the cursor has run past the last key, or Seek found no matching key.
+	ErrKeyNotFound = errors.New("screwdb: key not found")
+	// ErrNotFound is an alias of ErrKeyNotFound.
+	//
+	// Deprecated: Use ErrKeyNotFound.
+	ErrNotFound = ErrKeyNotFound
+	// ErrAssertionFailed is returned by Update and Tx.Commit when a predicate
+	// registered with Tx.Assert does not hold at commit time.
+	ErrAssertionFailed = errors.New("screwdb: assertion failed")
+	// ErrReservedKey is returned when a key falls within the namespace
+	// reserved for internal use, such as the metadata stored by DB.SetMeta.
+	ErrReservedKey = errors.New("screwdb: reserved key")
+	// ErrClosed is returned when the database is used after Close.
+	ErrClosed = errors.New("screwdb: database closed")
+	// ErrTxnInProgress is returned by Close while a transaction is running.
+	ErrTxnInProgress = errors.New("screwdb: transaction in progress")
+	// ErrTxnConflict is returned by Update when another handle or process
+	// has a write transaction in progress, and by Begin when any write
+	// transaction, including one through the same DB, is. Nothing was written
+	// and the Update can be retried.
+	ErrTxnConflict = errors.New("screwdb: transaction conflict")
+	// ErrLocked is returned by Open when another writable handle, in this
+	// process or another, already holds the lock on the file.
+	ErrLocked = errors.New("screwdb: database locked")
+	// ErrReadOnly is returned by Update and Begin when the database was opened
+	// with ReadOnly, and when a write fails because the file can't be written.
+	ErrReadOnly = errors.New("screwdb: database is read only")
+	// ErrNoSpace is returned when a write fails because the disk is full, a
+	// quota has been reached, or the file has grown as large as the file
+	// system allows.
+	ErrNoSpace = errors.New("screwdb: no space left")
+	// ErrCorrupted is returned when the file holds something no commit could
+	// have written, such as a page that isn't where it says it is.
+	ErrCorrupted = errors.New("screwdb: database corrupted")
+	// ErrTxnDone is returned when a transaction is used after it has been
+	// committed or aborted.
+	ErrTxnDone = errors.New("screwdb: transaction already committed or aborted")
+	// ErrEmptyKey is returned when a key is empty. The btree can't store an
+	// empty key, so every operation taking one refuses it up front.
+	ErrEmptyKey = errors.New("screwdb: empty key")
+	// ErrKeyTooLarge is returned by Tx.Put when the key is longer than
+	// DB.MaxKeySize. The error wraps it along with the two sizes.
+	ErrKeyTooLarge = errors.New("screwdb: key too large")
+	// ErrBufferTooSmall is returned by Tx.GetInto when the value doesn't fit
+	// in the buffer. The error wraps it along with the two sizes.
+	ErrBufferTooSmall = errors.New("screwdb: buffer too small")
+	// ErrDecodeFailed is returned by Typed and TypedCursor when a stored key
+	// or value can't be decoded with its codec. The error wraps it along with
+	// the codec's error.
+	ErrDecodeFailed = errors.New("screwdb: decode failed")
+	// ErrKeyOutOfOrder is returned by Tx.Append when the key doesn't sort
+	// after every key already in the database.
+	ErrKeyOutOfOrder = errors.New("screwdb: key out of order")
+	// ErrStopIteration can be returned by the function passed to
+	// Tx.ForEach and Tx.ForEachRange to stop without an error.
+	ErrStopIteration = errors.New("screwdb: stop iteration")
+	// ErrRevisionNotFound is returned by DB.ViewRevision when the requested
+	// revision is no longer on disk, or hasn't been committed yet.
+	ErrRevisionNotFound = errors.New("screwdb: revision not found")
+	// ErrSizeLimitExceeded is returned by Update when committing would grow
+	// the file past the limit set with WithMaxFileSize.
+	ErrSizeLimitExceeded = errors.New("screwdb: file size limit exceeded")
+)
+
+// errnoError matches err, the errno set by a failed btree call, to
+// ErrReadOnly, ErrNoSpace or ErrCorrupted, keeping the errno in the chain so
+// errors.As still finds it. Any other errno is returned as is. ENOENT is left
+// to callers, as what is missing depends on the call.
+func errnoError(err error) error {
+	var sentinel error
+	switch {
+	case err == nil:
+		return syscall.EIO
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EROFS), errors.Is(err, syscall.EBADF):
+		sentinel = ErrReadOnly
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EFBIG):
+		sentinel = ErrNoSpace
+	case errors.Is(err, syscall.EBADMSG):
+		sentinel = ErrCorrupted
+	default:
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", sentinel, err)
+}
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// ExportFormat is the encoding ExportSorted writes entries in.
+type ExportFormat int
+
+const (
+	// ExportLengthPrefixed writes each entry as a 4 byte big endian key
+	// length, the key, a 4 byte big endian value length, and the value.
+	ExportLengthPrefixed ExportFormat = iota
+	// ExportHexCSV writes each entry as a line holding the hex encoded key
+	// and value separated by a comma.
+	ExportHexCSV
+	// ExportVarintPrefixed writes each entry as the key length as a uvarint,
+	// the key, the value length as a uvarint, and the value. It is the format
+	// written by Dump.
+	ExportVarintPrefixed
+)
+
+// ExportSorted writes every entry to w in ascending key order, from a single
+// read transaction. Entries are streamed straight from the btree, so memory
+// use doesn't depend on the size of the database.
+func (db *DB) ExportSorted(w io.Writer, format ExportFormat) error {
+	var write func(bw *bufio.Writer, key, value []byte) error
+	switch format {
+	case ExportLengthPrefixed:
+		write = writeLengthPrefixed
+	case ExportHexCSV:
+		write = writeHexCSV
+	case ExportVarintPrefixed:
+		write = writeVarintPrefixed
+	default:
+		return fmt.Errorf("unknown export format: %d", format)
+	}
+
+	bw := bufio.NewWriter(w)
+
+	err := db.View(func(tx *Tx) error {
+		var err error
+		scanErr := tx.scan(nil, nil, func(key, value *C.struct_btval) bool {
+			err = write(bw, view(key), view(value))
+			return err == nil
+		})
+		if err != nil {
+			return fmt.Errorf("export failed: %w", err)
+		}
+
+		return scanErr
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func writeLengthPrefixed(bw *bufio.Writer, key, value []byte) error {
+	for _, b := range [][]byte{key, value} {
+		if _, err := bw.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b)))); err != nil {
+			return err
+		}
+
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeVarintPrefixed(bw *bufio.Writer, key, value []byte) error {
+	for _, b := range [][]byte{key, value} {
+		if _, err := bw.Write(binary.AppendUvarint(nil, uint64(len(b)))); err != nil {
+			return err
+		}
+
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeHexCSV(bw *bufio.Writer, key, value []byte) error {
+	enc := hex.NewEncoder(bw)
+	if _, err := enc.Write(key); err != nil {
+		return err
+	}
+
+	if err := bw.WriteByte(','); err != nil {
+		return err
+	}
+
+	if _, err := enc.Write(value); err != nil {
+		return err
+	}
+
+	return bw.WriteByte('\n')
+}
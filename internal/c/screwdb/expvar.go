@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"expvar"
+	"fmt"
+	"sync/atomic"
+)
+
+// metrics counts operations once RegisterExpvar has been called.
+type metrics struct {
+	puts    atomic.Uint64
+	gets    atomic.Uint64
+	deletes atomic.Uint64
+	commits atomic.Uint64
+	aborts  atomic.Uint64
+	// entries and depth are as of the last commit, as expvar variables are
+	// read from other goroutines, which can't use the btree.
+	entries atomic.Uint64
+	depth   atomic.Uint64
+}
+
+// RegisterExpvar publishes a map of metrics as the expvar variable prefix:
+// the number of puts, gets and deletes made and write transactions committed
+// and aborted since the first call, along with the entries and depth Stat
+// reports, as of the last commit through this handle. It fails if a variable
+// called prefix is already published, as expvar variables can't be removed.
+// Until it is called nothing is counted.
+func (db *DB) RegisterExpvar(prefix string) error {
+	if expvar.Get(prefix) != nil {
+		return fmt.Errorf("expvar %q is already published", prefix)
+	}
+
+	st, err := db.Stat()
+	if err != nil {
+		return err
+	}
+
+	m := db.metrics.Load()
+	if m == nil {
+		m = &metrics{}
+		m.entries.Store(st.Entries)
+		m.depth.Store(uint64(st.Depth))
+		db.metrics.Store(m)
+	}
+
+	vars := new(expvar.Map)
+	for name, counter := range map[string]*atomic.Uint64{
+		"puts":    &m.puts,
+		"gets":    &m.gets,
+		"deletes": &m.deletes,
+		"commits": &m.commits,
+		"aborts":  &m.aborts,
+		"entries": &m.entries,
+		"depth":   &m.depth,
+	} {
+		vars.Set(name, expvar.Func(func() any {
+			return counter.Load()
+		}))
+	}
+	expvar.Publish(prefix, vars)
+
+	return nil
+}
+
+// committed counts a commit, which left the tree as st describes.
+func (m *metrics) committed(st *C.struct_btree_stat) {
+	m.commits.Add(1)
+	m.entries.Store(uint64(st.entries))
+	m.depth.Store(uint64(st.depth))
+}
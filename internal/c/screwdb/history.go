@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// VersionedValue is a value of a key along with the revision that wrote it.
+type VersionedValue struct {
+	Revision uint64
+	Value    []byte
+}
+
+// History returns up to maxVersions of the most recent values of key, newest
+// first. Nothing is overwritten in place, so every commit since the file was
+// created (or last compacted) is still on disk, and History recovers older
+// values by stepping back through them one meta page at a time. This reads the
+// file backwards until enough versions have been found, so it gets slower the
+// further back it has to go. Rewriting a key with an identical value does not
+// create a new version, and periods where the key was deleted are skipped.
+func (db *DB) History(key []byte, maxVersions int) ([]VersionedValue, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	var versions []VersionedValue
+
+	err := db.View(func(tx *Tx) error {
+		var present bool
+		for maxVersions > 0 {
+			value, err := tx.get(key)
+			if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				return err
+			}
+
+			revision := uint64(C.btree_txn_revision(tx.tx))
+			switch {
+			case err != nil:
+				present = false
+			case present && bytes.Equal(value, versions[len(versions)-1].Value):
+				// Still the same version, it was written further back.
+				versions[len(versions)-1].Revision = revision
+			case len(versions) == maxVersions:
+				return nil
+			default:
+				versions = append(versions, VersionedValue{Revision: revision, Value: value})
+				present = true
+			}
+
+			rc, err := C.btree_txn_prev(tx.tx)
+			if rc != 0 {
+				if errors.Is(err, syscall.ENOENT) {
+					return nil
+				}
+
+				return fmt.Errorf("transaction rewind failed: %w", errnoError(err))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// Revision returns the revision of the most recent commit, including any
+// writes still buffered by WithCoalesceWindow. Every commit increments it.
+// Compacting keeps only the latest commit and numbers it 1, so revisions from
+// before a compaction may later be reused.
+func (db *DB) Revision() (uint64, error) {
+	if err := db.Flush(); err != nil {
+		return 0, err
+	}
+
+	var revision uint64
+	err := db.View(func(tx *Tx) error {
+		revision = uint64(C.btree_txn_revision(tx.tx))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, nil
+}
+
+// ViewRevision is like View, but fn sees the database as it was when rev was
+// committed. Like History, it steps back one commit at a time to get there.
+// It returns ErrRevisionNotFound if rev is newer than the latest commit or is
+// no longer on disk, for instance because the database has been compacted
+// since.
+func (db *DB) ViewRevision(rev uint64, fn func(*Tx) error) error {
+	tx, err := db.begin(context.Background(), true)
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+
+	for uint64(C.btree_txn_revision(tx.tx)) > rev {
+		rc, err := C.btree_txn_prev(tx.tx)
+		if rc != 0 {
+			if errors.Is(err, syscall.ENOENT) {
+				break
+			}
+
+			return fmt.Errorf("transaction rewind failed: %w", errnoError(err))
+		}
+	}
+
+	if uint64(C.btree_txn_revision(tx.tx)) != rev {
+		return fmt.Errorf("%w: %d", ErrRevisionNotFound, rev)
+	}
+
+	return fn(tx)
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
+
+// ListChildren returns the distinct keys one level below prefix, like ls
+// lists a directory: for keys under prefix, each is cut off at the first sep
+// after the prefix. So with the keys "a/b/c", "a/b/d" and "a/e", the children
+// of "a/" are "a/b" and "a/e". Children are returned in order, without
+// duplicates. Rather than visiting every descendant, it seeks straight past
+// each child's subtree once the child has been found.
+func (tx *Tx) ListChildren(prefix, sep []byte) ([][]byte, error) {
+	c, err := tx.Cursor()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var children [][]byte
+	pos := prefix
+	for {
+		op := C.enum_cursor_op(C.BT_CURSOR)
+		if len(pos) == 0 {
+			op, pos = C.BT_FIRST, nil
+		}
+
+		cKey, err := c.fetch(pos, op, nil)
+		if errors.Is(err, ErrKeyNotFound) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		key := goBytes(&cKey)
+		if len(key) < len(prefix) || tx.db.Compare(key[:len(prefix)], prefix) != 0 {
+			break
+		}
+
+		child := key
+		if i := bytes.Index(key[len(prefix):], sep); len(sep) > 0 && i >= 0 {
+			child = key[:len(prefix)+i]
+
+			// Skip everything under child+sep.
+			pos = prefixEnd(append(child[:len(child):len(child)], sep...))
+			if pos == nil {
+				children = append(children, child)
+				break
+			}
+		} else {
+			// The smallest key after this one.
+			pos = append(key[:len(key):len(key)], 0)
+		}
+
+		children = append(children, child)
+	}
+
+	// A child that is also a key can be separated from its subtree by keys
+	// such as "a/b-x", which sort between "a/b" and "a/b/".
+	slices.SortFunc(children, tx.db.Compare)
+
+	return slices.CompactFunc(children, func(a, b []byte) bool {
+		return tx.db.Compare(a, b) == 0
+	}), nil
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
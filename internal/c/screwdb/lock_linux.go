@@ -0,0 +1,37 @@
+//go:build linux
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import "syscall"
+
+// fOFDSetlk is F_OFD_SETLK, which takes a lock owned by the open file
+// description rather than by the process, so it excludes other handles in
+// this process as well, and isn't dropped when some other descriptor for the
+// file is closed. It doesn't interact with the flock taken by write
+// transactions.
+const fOFDSetlk = 37
+
+// lockBtree takes a write lock on the whole of the file bt has open, failing
+// with EAGAIN or EACCES if another handle holds one.
+func lockBtree(bt *C.struct_btree) error {
+	return syscall.FcntlFlock(uintptr(C.btree_get_fd(bt)), fOFDSetlk, &syscall.Flock_t{Type: syscall.F_WRLCK})
+}
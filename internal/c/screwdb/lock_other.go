@@ -0,0 +1,36 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+
+// lockBtree takes a write lock on the file bt has open, failing with EAGAIN if
+// another handle holds one. Without open file description locks it's a flock,
+// which, unlike a process owned fcntl lock, excludes other handles in this
+// process too and survives them closing the file. It is the same lock write
+// transactions take, so bt's own keep it rather than taking and releasing it.
+func lockBtree(bt *C.struct_btree) error {
+	if rc, err := C.btree_lock(bt); rc != 0 {
+		return err
+	}
+
+	return nil
+}
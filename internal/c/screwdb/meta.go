@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import "bytes"
+
+// reservedPrefix marks keys that belong to screwdb rather than the user. It
+// sorts before almost every user key and contains no ASCII letters, so it
+// can't collide with a user key under any collation.
+const reservedPrefix = "\x00\xff\xfe\x00"
+
+var metaPrefix = []byte(reservedPrefix + "meta/")
+
+// SetMeta stores a DB-level metadata value, such as a schema version, under
+// key. Metadata lives in a reserved namespace, apart from the user keyspace,
+// and is never returned by cursors or range scans.
+func (db *DB) SetMeta(key, value []byte) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.put(append(metaPrefix[:len(metaPrefix):len(metaPrefix)], key...), value, true)
+	})
+}
+
+// GetMeta returns the metadata value stored under key by SetMeta.
+func (db *DB) GetMeta(key []byte) (value []byte, err error) {
+	err = db.View(func(tx *Tx) error {
+		value, err = tx.get(append(metaPrefix[:len(metaPrefix):len(metaPrefix)], key...))
+		return err
+	})
+
+	return value, err
+}
+
+func isReserved(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(reservedPrefix))
+}
@@ -0,0 +1,258 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include <stdlib.h>
+// #include "btree.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"unsafe"
+)
+
+// Has reports whether key exists. Its value is never read, so checking a key
+// with a large value costs no more than one with a small value.
+func (tx *Tx) Has(key []byte) (bool, error) {
+	if tx.tx == nil {
+		return false, ErrTxnDone
+	}
+
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+
+	cKey := C.struct_btval{
+		data: C.CBytes(key),
+		size: C.ulong(len(key)),
+	}
+	defer C.free(unsafe.Pointer(cKey.data))
+
+	var found C.int
+	rc, err := C.btree_txn_exists(tx.bt, tx.tx, &cKey, 1, &found)
+	if rc != 0 {
+		return false, fmt.Errorf("exists failed: %w", errnoError(err))
+	}
+
+	return found != 0, nil
+}
+
+// MultiExists reports, in the same order as keys, whether each key exists.
+// The whole batch is looked up in a single call into the btree and no values
+// are read.
+func (tx *Tx) MultiExists(keys [][]byte) ([]bool, error) {
+	if tx.tx == nil {
+		return nil, ErrTxnDone
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var size int
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		size += len(key)
+	}
+
+	// Copy every key into one C allocation, alongside the btvals that point
+	// into it and the results.
+	cKeys := unsafe.Slice((*C.struct_btval)(C.calloc(C.size_t(len(keys)), C.sizeof_struct_btval)), len(keys))
+	defer C.free(unsafe.Pointer(&cKeys[0]))
+
+	data := (*byte)(C.malloc(C.size_t(max(size, 1))))
+	defer C.free(unsafe.Pointer(data))
+
+	found := unsafe.Slice((*C.int)(C.calloc(C.size_t(len(keys)), C.sizeof_int)), len(keys))
+	defer C.free(unsafe.Pointer(&found[0]))
+
+	buf := unsafe.Slice(data, max(size, 1))
+	var off int
+	for i, key := range keys {
+		copy(buf[off:], key)
+		cKeys[i].data = unsafe.Pointer(&buf[off])
+		cKeys[i].size = C.ulong(len(key))
+		off += len(key)
+	}
+
+	rc, err := C.btree_txn_exists(tx.bt, tx.tx, &cKeys[0], C.size_t(len(keys)), &found[0])
+	if rc != 0 {
+		return nil, fmt.Errorf("exists failed: %w", errnoError(err))
+	}
+
+	exists := make([]bool, len(keys))
+	for i := range found {
+		exists[i] = found[i] != 0
+	}
+
+	return exists, nil
+}
+
+// GetMany returns, in the same order as keys, a copy of the value of each
+// key, or nil for a key that doesn't exist. The keys are looked up in sorted
+// order with a single cursor, and a key that sorts before the entry the cursor
+// is already on is answered without seeking, so clustered keys are cheaper to
+// fetch than with Get.
+func (tx *Tx) GetMany(keys [][]byte) ([][]byte, error) {
+	if tx.tx == nil {
+		return nil, ErrTxnDone
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var size int
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		size += len(key)
+	}
+
+	// Copy every key into one C allocation so sorting them doesn't copy a
+	// key per comparison.
+	cKeys := unsafe.Slice((*C.struct_btval)(C.calloc(C.size_t(len(keys)), C.sizeof_struct_btval)), len(keys))
+	defer C.free(unsafe.Pointer(&cKeys[0]))
+
+	data := (*byte)(C.malloc(C.size_t(max(size, 1))))
+	defer C.free(unsafe.Pointer(data))
+
+	buf := unsafe.Slice(data, max(size, 1))
+	var off int
+	for i, key := range keys {
+		copy(buf[off:], key)
+		cKeys[i].data = unsafe.Pointer(&buf[off])
+		cKeys[i].size = C.ulong(len(key))
+		off += len(key)
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return int(C.btree_cmp(tx.bt, &cKeys[a], &cKeys[b]))
+	})
+
+	c, err := tx.Cursor()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// cur is the entry the cursor is on, the first not less than the last
+	// key sought.
+	var cur C.struct_btval
+	var curValue []byte
+	defer C.btval_reset(&cur)
+
+	values := make([][]byte, len(keys))
+	for _, i := range order {
+		if cur.data == nil || C.btree_cmp(tx.bt, &cur, &cKeys[i]) < 0 {
+			var cValue C.struct_btval
+			cKey, err := c.fetch(keys[i], C.BT_CURSOR, &cValue)
+			if errors.Is(err, ErrKeyNotFound) {
+				// Every remaining key sorts after the last key.
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			C.btval_reset(&cur)
+			cur, curValue = cKey, goBytes(&cValue)
+		}
+
+		if C.btree_cmp(tx.bt, &cur, &cKeys[i]) == 0 {
+			values[i] = slices.Clone(curValue)
+		}
+	}
+
+	return values, nil
+}
+
+// PutBatch sets the value of each of keys to the value at the same index in
+// values, overwriting any existing values. The pairs are copied into C memory
+// in one allocation and put in a single call into the btree, so loading many
+// small entries costs far less than calling Put for each. It stops at the
+// first failure, returning an error naming its index.
+func (tx *Tx) PutBatch(keys, values [][]byte) error {
+	if tx.tx == nil {
+		return ErrTxnDone
+	}
+
+	if len(keys) != len(values) {
+		return fmt.Errorf("put batch failed: %d keys but %d values", len(keys), len(values))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var size int
+	for i, key := range keys {
+		if err := checkKey(key); err != nil {
+			return fmt.Errorf("put %d failed: %w", i, err)
+		}
+		if err := tx.db.checkKeySize(key); err != nil {
+			return fmt.Errorf("put %d failed: %w", i, err)
+		}
+		size += len(key) + len(values[i])
+	}
+
+	btvals := unsafe.Slice((*C.struct_btval)(C.calloc(C.size_t(2*len(keys)), C.sizeof_struct_btval)), 2*len(keys))
+	defer C.free(unsafe.Pointer(&btvals[0]))
+	cKeys, cValues := btvals[:len(keys)], btvals[len(keys):]
+
+	data := C.malloc(C.size_t(max(size, 1)))
+	defer C.free(data)
+
+	buf := unsafe.Slice((*byte)(data), max(size, 1))
+	var off int
+	for i := range keys {
+		cKeys[i].data = unsafe.Add(data, off)
+		cKeys[i].size = C.ulong(copy(buf[off:], keys[i]))
+		off += len(keys[i])
+
+		cValues[i].data = unsafe.Add(data, off)
+		cValues[i].size = C.ulong(copy(buf[off:], values[i]))
+		off += len(values[i])
+	}
+
+	var failed C.size_t
+	rc, err := C.btree_txn_put_many(tx.bt, tx.tx, &cKeys[0], &cValues[0], C.size_t(len(keys)), 0, &failed)
+	if rc != 0 {
+		for i := range int(failed) {
+			tx.written += int64(len(keys[i]) + len(values[i]))
+		}
+
+		return fmt.Errorf("put %d failed: %w", failed, errnoError(err))
+	}
+	tx.written += int64(size)
+
+	if m := tx.db.metrics.Load(); m != nil {
+		m.puts.Add(uint64(len(keys)))
+	}
+	if tx.span != nil {
+		tx.span.puts += len(keys)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import "fmt"
+
+// BeginNested starts a transaction nested in a write transaction, whose
+// changes can be committed into or discarded from the parent without ending
+// it. The btree has a single write transaction at a time, so a nested
+// transaction is a savepoint in its parent rather than a transaction of its
+// own: Commit keeps its changes as part of the parent, to be written when the
+// parent commits (or discarded if it aborts), and Abort returns the parent to
+// where it was when BeginNested was called, undoing every put and delete since
+// while keeping those made before. Nested transactions can themselves be
+// nested.
+//
+// The parent must not be used until the nested transaction is committed or
+// aborted, and cursors opened in the nested transaction, and values returned
+// by GetRef, must not be used after it ends. Commit fails with
+// ErrTxnInProgress on a transaction with an open nested transaction, while
+// Abort aborts it along with the parent.
+func (tx *Tx) BeginNested() (*Tx, error) {
+	if tx.tx == nil {
+		return nil, ErrTxnDone
+	}
+
+	if tx.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	if tx.child != nil {
+		return nil, ErrTxnInProgress
+	}
+
+	rc, err := C.btree_txn_savepoint(tx.tx)
+	if rc != 0 {
+		return nil, fmt.Errorf("nested transaction begin failed: %w", errnoError(err))
+	}
+
+	tx.child = &Tx{
+		db:       tx.db,
+		bt:       tx.bt,
+		tx:       tx.tx,
+		ctx:      tx.ctx,
+		zeroCopy: tx.zeroCopy,
+		parent:   tx,
+		span:     tx.span,
+	}
+
+	return tx.child, nil
+}
+
+// commitNested keeps the changes of a nested transaction as part of its
+// parent. Assertions are left for the parent to check when it commits.
+func (tx *Tx) commitNested() error {
+	rc, err := C.btree_txn_release(tx.tx)
+	if rc != 0 {
+		tx.abortNested()
+
+		return fmt.Errorf("nested transaction commit failed: %w", errnoError(err))
+	}
+
+	p := tx.parent
+	p.assertions = append(p.assertions, tx.assertions...)
+	p.written += tx.written
+	p.pinned = append(p.pinned, tx.pinned...)
+	tx.pinned = nil
+	tx.endNested()
+
+	return nil
+}
+
+// abortNested returns the parent to the savepoint the nested transaction was
+// begun at.
+func (tx *Tx) abortNested() error {
+	tx.release()
+	rc, err := C.btree_txn_rollback(tx.tx)
+	tx.endNested()
+	if rc != 0 {
+		return fmt.Errorf("nested transaction abort failed: %w", errnoError(err))
+	}
+
+	return nil
+}
+
+func (tx *Tx) endNested() {
+	tx.parent.child = nil
+	tx.tx = nil
+}
@@ -0,0 +1,200 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	minPageSize = 4096
+	maxPageSize = 32 * 1024
+)
+
+// Collation determines the order of keys, and which keys are considered equal.
+type Collation int
+
+const (
+	// Binary orders keys bytewise. This is the default.
+	Binary Collation = iota
+	// CaseInsensitiveASCII orders and matches keys ignoring the case of ASCII
+	// letters, so "Alice" and "alice" are the same key.
+	CaseInsensitiveASCII
+)
+
+// Option configures how a database is opened.
+type Option func(*options)
+
+type options struct {
+	collation   Collation
+	syncPolicy  SyncPolicy
+	maxFileSize int64
+	cachePool   *CachePool
+	zeroCopy    bool
+	compare     func(a, b []byte) int
+	cacheSize   uint
+	pageSize    uint
+	noLock      bool
+
+	coalesceWindow time.Duration
+	tracerProvider trace.TracerProvider
+}
+
+func newOptions(opts []Option) *options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &o
+}
+
+// validate checks for options that can't be honoured.
+func (o *options) validate() error {
+	if o.pageSize != 0 && (o.pageSize < minPageSize || o.pageSize > maxPageSize || o.pageSize&(o.pageSize-1) != 0) {
+		return fmt.Errorf("page size %d is not a power of two between %d and %d", o.pageSize, minPageSize, maxPageSize)
+	}
+
+	return nil
+}
+
+// btreeFlags returns the flags to open the btree with.
+func (o *options) btreeFlags(flags Flags) Flags {
+	if o.collation == CaseInsensitiveASCII {
+		flags |= C.BT_CASEFOLD
+	}
+
+	if o.syncPolicy != (SyncPolicy{}) {
+		// The policy decides when to sync instead of every commit.
+		flags |= NoSync
+	}
+
+	return flags
+}
+
+// WithCollation sets the key order of a newly created database. The collation
+// is recorded in the file, so subsequent opens pick it up automatically, but
+// an existing database can't be switched to a different collation.
+func WithCollation(collation Collation) Option {
+	return func(o *options) {
+		o.collation = collation
+	}
+}
+
+// SyncPolicy batches the fsyncs that would otherwise happen on every commit.
+// Commits made since the last sync may be lost in a crash, and as with NoSync,
+// the file may be left referencing pages that never made it to disk.
+type SyncPolicy struct {
+	commits int
+	bytes   int64
+}
+
+// EveryN syncs after every n commits.
+func EveryN(n int) SyncPolicy {
+	return SyncPolicy{commits: n}
+}
+
+// EveryBytes syncs once roughly n bytes of keys and values have been
+// committed since the last sync.
+func EveryBytes(n int64) SyncPolicy {
+	return SyncPolicy{bytes: n}
+}
+
+// WithSyncPolicy replaces the fsync on every commit with the given policy.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+	}
+}
+
+// WithMaxFileSize makes Update fail with ErrSizeLimitExceeded, instead of
+// committing, when a transaction containing a Put would grow the file past n
+// bytes. Transactions that only delete are always allowed, so space can still
+// be reclaimed by deleting and then compacting.
+func WithMaxFileSize(n int64) Option {
+	return func(o *options) {
+		o.maxFileSize = n
+	}
+}
+
+// WithCachePool makes the database count its page cache against a budget
+// shared with the other databases using pool, instead of its own cache size.
+func WithCachePool(pool *CachePool) Option {
+	return func(o *options) {
+		o.cachePool = pool
+	}
+}
+
+// WithZeroCopyReads makes Tx.Get return slices that alias the page cache (or,
+// for values stored on overflow pages, the buffer they were read into),
+// instead of copies. The slices are only valid until the function passed to
+// View or Update returns, and in Update only until the next write, which may
+// rewrite the page they alias: using one after that, or modifying it at any
+// time, is undefined behaviour. Every page a value is read from stays cached
+// until the transaction ends, regardless of the cache size.
+func WithZeroCopyReads() Option {
+	return func(o *options) {
+		o.zeroCopy = true
+	}
+}
+
+// WithCoalesceWindow makes DB.Put buffer writes in memory, keeping only the
+// latest value of each key, and commit them together in one transaction once
+// the window has passed since the first buffered write. The buffer is flushed
+// by a timer once the window has passed, logging any failure, and by Update,
+// Flush and Close. Buffered puts are lost in a crash, or if a flush fails with
+// an error that retrying can't fix. DB.Get sees buffered values, but View does
+// not.
+func WithCoalesceWindow(window time.Duration) Option {
+	return func(o *options) {
+		o.coalesceWindow = window
+	}
+}
+
+// WithCacheSize sets the maximum number of pages cached, as SetCacheSize
+// does, but from the start.
+func WithCacheSize(cacheSize uint) Option {
+	return func(o *options) {
+		o.cacheSize = cacheSize
+	}
+}
+
+// WithPageSize sets the page size of a newly created database, which must be
+// a power of two between 4 and 32 KiB. By default it is the block size of the
+// file system. The page size of an existing database can't be changed, so
+// the option is ignored.
+func WithPageSize(pageSize uint) Option {
+	return func(o *options) {
+		o.pageSize = pageSize
+	}
+}
+
+// WithoutLock makes Open skip the write lock it otherwise takes on the file,
+// so that several writable handles, in this process or another, can share it.
+// Write transactions are exclusive regardless, so the handles take turns, with
+// Update failing with ErrTxnConflict while another has one open.
+func WithoutLock() Option {
+	return func(o *options) {
+		o.noLock = true
+	}
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"fmt"
+	"syscall"
+)
+
+// Preallocate reserves disk space for the file to grow to size bytes, so the
+// pages later commits append land in space allocated up front, in as few
+// extents as the filesystem manages, instead of the file being extended a few
+// pages at a time. The space is reserved past the end of the file, and shows
+// in Stat's AllocatedBytes, leaving its size, as FileSize reports it,
+// unchanged: the btree appends pages and looks for its latest meta page at the
+// end of the file, so padding the file out would corrupt it. It does nothing
+// if the file is already that large, and fails with an error matching
+// errors.ErrUnsupported where the platform or filesystem can't reserve space,
+// or ErrNoSpace if the disk is full.
+func (db *DB) Preallocate(size int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.bt == nil {
+		return ErrClosed
+	}
+
+	if db.flags&ReadOnly != 0 {
+		return ErrReadOnly
+	}
+
+	fd := int(C.btree_get_fd(db.bt))
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("stat failed: %w", errnoError(err))
+	}
+
+	if size <= st.Size {
+		return nil
+	}
+
+	if err := reserve(fd, st.Size, size-st.Size); err != nil {
+		return fmt.Errorf("preallocate failed: %w", errnoError(err))
+	}
+
+	return nil
+}
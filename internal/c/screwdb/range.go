@@ -0,0 +1,443 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include <stdlib.h>
+// #include "btree.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"iter"
+	"unsafe"
+)
+
+// RangeHashes yields every key in [lo, hi) along with a 64-bit FNV-1a hash of
+// its value. Values are hashed in place and never copied into Go memory, so
+// replicas can cheaply compare their contents and only fetch the values that
+// differ. A nil lo starts at the first key and a nil hi continues to the last.
+// Errors are reported by tx.Err.
+func (tx *Tx) RangeHashes(lo, hi []byte) iter.Seq2[[]byte, uint64] {
+	return func(yield func([]byte, uint64) bool) {
+		err := tx.scan(lo, hi, func(key, value *C.struct_btval) bool {
+			h := fnv.New64a()
+			_, _ = h.Write(view(value))
+
+			return yield(C.GoBytes(key.data, C.int(key.size)), h.Sum64())
+		})
+		tx.setErr(err)
+	}
+}
+
+// All yields every entry in the database, in order. The cursor behind it is
+// closed once the loop ends, including when the caller breaks out early.
+// Errors are reported by tx.Err.
+func (tx *Tx) All() iter.Seq2[[]byte, []byte] {
+	return tx.Range(nil, nil)
+}
+
+// Range yields every entry in [start, end), in order, with the same bounds as
+// CountRange: it seeks to the first key not less than start and stops at the
+// first key not less than end, both as ordered by the database, including a
+// comparator set WithCompare. Errors are reported by tx.Err.
+func (tx *Tx) Range(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		err := tx.scan(start, end, func(key, value *C.struct_btval) bool {
+			return yield(C.GoBytes(key.data, C.int(key.size)), C.GoBytes(value.data, C.int(value.size)))
+		})
+		tx.setErr(err)
+	}
+}
+
+// AllReverse is like All, but yields the entries from the last key down to
+// the first.
+func (tx *Tx) AllReverse() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		tx.setErr(tx.scanReverse(func(key, value *C.struct_btval) bool {
+			return yield(C.GoBytes(key.data, C.int(key.size)), C.GoBytes(value.data, C.int(value.size)))
+		}))
+	}
+}
+
+// Prefix yields every entry whose key starts with prefix, in order, including
+// one whose key is prefix itself. It seeks straight to prefix and stops at the
+// first key without it, so costs nothing for the rest of the database. An
+// empty prefix yields every entry. Errors are reported by tx.Err.
+func (tx *Tx) Prefix(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		err := tx.scanPrefix(prefix, func(key, value *C.struct_btval) bool {
+			return yield(C.GoBytes(key.data, C.int(key.size)), C.GoBytes(value.data, C.int(value.size)))
+		})
+		tx.setErr(err)
+	}
+}
+
+// Keys yields every key in the database, in order, without ever reading the
+// values. The cursor behind it is closed once the loop ends, including when
+// the caller breaks out early. Errors are reported by tx.Err.
+func (tx *Tx) Keys() iter.Seq[[]byte] {
+	return tx.KeysRange(nil, nil)
+}
+
+// KeysRange is like Keys, but only yields the keys in [start, end), with the
+// same bounds as CountRange.
+func (tx *Tx) KeysRange(start, end []byte) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		err := tx.scanKeys(start, end, func(key *C.struct_btval) bool {
+			return yield(C.GoBytes(key.data, C.int(key.size)))
+		})
+		tx.setErr(err)
+	}
+}
+
+// StreamRange calls send for every entry in [lo, hi), in order, one at a time,
+// so a slow consumer naturally paces the scan. A nil lo starts at the first
+// key and a nil hi continues to the last. If send returns an error the scan
+// stops straight away and StreamRange returns that error.
+func (tx *Tx) StreamRange(lo, hi []byte, send func(key, value []byte) error) error {
+	var err error
+	scanErr := tx.scan(lo, hi, func(key, value *C.struct_btval) bool {
+		err = send(C.GoBytes(key.data, C.int(key.size)), C.GoBytes(value.data, C.int(value.size)))
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return scanErr
+}
+
+// ForEach calls fn for every entry in the database, in order, stopping at the
+// first error fn returns and returning it, unless it is ErrStopIteration,
+// which just stops. The key and value are copies fn can keep.
+func (tx *Tx) ForEach(fn func(key, value []byte) error) error {
+	return tx.ForEachRange(nil, nil, fn)
+}
+
+// ForEachRange is like ForEach, but only over the entries in [start, end),
+// with the same bounds as CountRange.
+func (tx *Tx) ForEachRange(start, end []byte, fn func(key, value []byte) error) error {
+	err := tx.StreamRange(start, end, fn)
+	if errors.Is(err, ErrStopIteration) {
+		return nil
+	}
+
+	return err
+}
+
+// CountRange returns the number of keys in [start, end): start is inclusive
+// and end exclusive, so a range with start >= end is empty. An empty start
+// counts from the first key and a nil end to the last. Values are never
+// copied into Go memory.
+func (tx *Tx) CountRange(start, end []byte) (uint64, error) {
+	var n uint64
+	err := tx.scanKeys(start, end, func(*C.struct_btval) bool {
+		n++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// DeleteRange deletes every key in [start, end), with the same bounds as
+// CountRange, and returns how many were deleted. The keys are deleted through
+// a single cursor as it moves along the range, rather than looked up again one
+// at a time.
+func (tx *Tx) DeleteRange(start, end []byte) (uint64, error) {
+	c, err := tx.Cursor()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	var cEnd C.struct_btval
+	if end != nil {
+		cEnd.data = C.CBytes(end)
+		cEnd.size = C.ulong(len(end))
+		defer C.free(cEnd.data)
+	}
+
+	op := C.enum_cursor_op(C.BT_CURSOR)
+	if len(start) == 0 {
+		op, start = C.BT_FIRST, nil
+	}
+
+	var n uint64
+	for {
+		if err := tx.ctx.Err(); err != nil {
+			return n, err
+		}
+
+		cKey, err := c.fetch(start, op, nil)
+		if errors.Is(err, ErrKeyNotFound) {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		op, start = C.BT_NEXT, nil
+
+		more := end == nil || C.btree_cmp(tx.bt, &cKey, &cEnd) < 0
+		C.btval_reset(&cKey)
+		if !more {
+			return n, nil
+		}
+
+		// The cursor moves on to the following key, which BT_NEXT returns.
+		if err := c.Delete(); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// RangeEmpty reports whether [lo, hi) contains no keys. It only seeks to lo
+// and inspects the first key found, so it costs the same as a single lookup
+// regardless of how many keys the range holds.
+func (tx *Tx) RangeEmpty(lo, hi []byte) (bool, error) {
+	empty := true
+	err := tx.scanKeys(lo, hi, func(*C.struct_btval) bool {
+		empty = false
+		return false
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return empty, nil
+}
+
+// CompactRange rewrites every entry in [lo, hi) into fresh pages appended to
+// the end of the file, leaving the range stored contiguously rather than
+// scattered across the pages of many earlier commits. A nil lo starts at the
+// first key and a nil hi continues to the last. As nothing is overwritten
+// in place this doesn't shrink the file, Compact is still needed to reclaim
+// space, and the rewritten pages are held in memory until the commit.
+func (db *DB) CompactRange(lo, hi []byte) error {
+	return db.Update(func(tx *Tx) error {
+		var err error
+		scanErr := tx.scan(lo, hi, func(key, value *C.struct_btval) bool {
+			// The cursor holds references to the pages it is on, so they
+			// are copied rather than modified in place, and the scan keeps
+			// seeing the range as it was.
+			rc, putErr := C.btree_txn_put(tx.bt, tx.tx, key, value, 0)
+			if rc != 0 {
+				err = fmt.Errorf("put failed: %w", errnoError(putErr))
+				return false
+			}
+
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		return scanErr
+	})
+}
+
+// TrimToCount deletes the smallest keys until at most keep remain, and
+// returns how many were deleted. With keys that sort in time order this keeps
+// the newest entries. The keys are counted by scanning them all.
+func (tx *Tx) TrimToCount(keep uint64) (deleted uint64, err error) {
+	count, err := tx.CountRange(nil, nil)
+	if err != nil || count <= keep {
+		return 0, err
+	}
+
+	// Delete in batches rather than under an open cursor.
+	const batchSize = 1024
+	for deleted < count-keep {
+		var keys [][]byte
+		err := tx.scanKeys(nil, nil, func(key *C.struct_btval) bool {
+			keys = append(keys, C.GoBytes(key.data, C.int(key.size)))
+			return len(keys) < batchSize && uint64(len(keys)) < count-keep-deleted
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		for _, key := range keys {
+			if err := tx.delete(key, nil); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// MissingFromSet returns the keys starting with prefix that are not in have,
+// in order. It scans the prefix in a single transaction, so the result is
+// consistent even while other writers are busy.
+func (tx *Tx) MissingFromSet(prefix []byte, have map[string]struct{}) ([][]byte, error) {
+	var missing [][]byte
+	err := tx.scanPrefix(prefix, func(key, _ *C.struct_btval) bool {
+		if _, ok := have[string(view(key))]; !ok {
+			missing = append(missing, C.GoBytes(key.data, C.int(key.size)))
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return missing, nil
+}
+
+// scanPrefix is like scan, but over every key starting with prefix, as judged
+// by the collation of the database.
+func (tx *Tx) scanPrefix(prefix []byte, fn func(key, value *C.struct_btval) bool) error {
+	var cPrefix C.struct_btval
+	if len(prefix) > 0 {
+		cPrefix.data = C.CBytes(prefix)
+		cPrefix.size = C.ulong(len(prefix))
+		defer C.free(cPrefix.data)
+	}
+
+	return tx.scan(prefix, nil, func(key, value *C.struct_btval) bool {
+		if key.size < cPrefix.size {
+			return false
+		}
+
+		head := C.struct_btval{data: key.data, size: cPrefix.size}
+		if cPrefix.size > 0 && C.btree_cmp(tx.bt, &head, &cPrefix) != 0 {
+			return false
+		}
+
+		return fn(key, value)
+	})
+}
+
+// scan calls fn for every entry in [lo, hi), in order, until fn returns
+// false. A nil (or empty) lo starts at the first key and a nil hi continues to
+// the last. The key and value are released as soon as fn returns.
+func (tx *Tx) scan(lo, hi []byte, fn func(key, value *C.struct_btval) bool) error {
+	return tx.iterate(lo, hi, true, fn)
+}
+
+// scanKeys is like scan, but never reads values.
+func (tx *Tx) scanKeys(lo, hi []byte, fn func(key *C.struct_btval) bool) error {
+	return tx.iterate(lo, hi, false, func(key, _ *C.struct_btval) bool {
+		return fn(key)
+	})
+}
+
+func (tx *Tx) iterate(lo, hi []byte, values bool, fn func(key, value *C.struct_btval) bool) error {
+	c, err := tx.Cursor()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var cHi C.struct_btval
+	if hi != nil {
+		cHi.data = C.CBytes(hi)
+		cHi.size = C.ulong(len(hi))
+		defer C.free(cHi.data)
+	}
+
+	op := C.enum_cursor_op(C.BT_CURSOR)
+	if len(lo) == 0 {
+		op, lo = C.BT_FIRST, nil
+	}
+
+	var cValue C.struct_btval
+	value := &cValue
+	if !values {
+		value = nil
+	}
+
+	for {
+		if err := tx.ctx.Err(); err != nil {
+			return err
+		}
+
+		cKey, err := c.fetch(lo, op, value)
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				return nil
+			}
+
+			return err
+		}
+		op, lo = C.BT_NEXT, nil
+
+		more := hi == nil || C.btree_cmp(tx.bt, &cKey, &cHi) < 0
+		if more {
+			more = fn(&cKey, &cValue)
+		}
+
+		C.btval_reset(&cKey)
+		C.btval_reset(&cValue)
+
+		if !more {
+			return nil
+		}
+	}
+}
+
+// scanReverse is like scan over every entry, but from the last key down to
+// the first.
+func (tx *Tx) scanReverse(fn func(key, value *C.struct_btval) bool) error {
+	c, err := tx.Cursor()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for op := C.enum_cursor_op(C.BT_LAST); ; op = C.BT_PREV {
+		if err := tx.ctx.Err(); err != nil {
+			return err
+		}
+
+		var cValue C.struct_btval
+		cKey, err := c.fetch(nil, op, &cValue)
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				return nil
+			}
+
+			return err
+		}
+
+		more := fn(&cKey, &cValue)
+
+		C.btval_reset(&cKey)
+		C.btval_reset(&cValue)
+
+		if !more {
+			return nil
+		}
+	}
+}
+
+// view returns a slice aliasing the memory of v, without copying it. It must
+// not be used after v is released.
+func view(v *C.struct_btval) []byte {
+	if v.size == 0 {
+		return nil
+	}
+
+	return unsafe.Slice((*byte)(v.data), v.size)
+}
@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	retryMinBackoff = time.Millisecond
+	retryMaxBackoff = 100 * time.Millisecond
+)
+
+// UpdateRetry is like Update, but runs fn again in a fresh transaction, up to
+// maxAttempts times in all (and always at least once), when the transaction
+// fails in a way that retrying can fix: another writer holds the write lock
+// (ErrTxnConflict), or a write was interrupted. It waits between attempts,
+// doubling the wait each time, with some jitter so that writers retrying
+// together drift apart. An error returned by fn is never retried, nor is any
+// other error, such as ErrCorrupted or ErrNoSpace. Once out of attempts it
+// returns the last error.
+func (db *DB) UpdateRetry(fn func(*Tx) error, maxAttempts int) error {
+	if err := db.Flush(); err != nil {
+		return err
+	}
+
+	backoff := retryMinBackoff
+	for attempt := 1; ; attempt++ {
+		var fnFailed bool
+		err := db.tracedUpdate(context.Background(), "screwdb.Update", func(tx *Tx) error {
+			err := fn(tx)
+			fnFailed = err != nil
+
+			return err
+		}, attribute.Int("screwdb.attempt", attempt))
+		if err == nil || fnFailed || !retryable(err) || attempt >= maxAttempts {
+			return err
+		}
+
+		time.Sleep(backoff/2 + rand.N(backoff))
+		backoff = min(2*backoff, retryMaxBackoff)
+	}
+}
+
+// retryable reports whether a transaction that failed with err might succeed
+// if run again.
+func retryable(err error) bool {
+	return errors.Is(err, ErrTxnConflict) || errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
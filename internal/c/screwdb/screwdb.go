@@ -24,226 +24,1543 @@ package screwdb
 // #include "btree.h"
 import "C"
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/cgo"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"unsafe"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Flags uint
 
 const (
-	NoSync   Flags = C.BT_NOSYNC
+	NoSync Flags = C.BT_NOSYNC
+	// ReadOnly opens the file O_RDONLY and guarantees it is never written to,
+	// so it is safe for read only media. Write transactions fail with
+	// ErrReadOnly.
 	ReadOnly Flags = C.BT_RDONLY
 )
 
 type DB struct {
-	bt *C.struct_btree
+	// mu guards bt, which reopen replaces, while transactions begin.
+	mu    sync.Mutex
+	bt    *C.struct_btree
+	flags Flags
+	// path is empty for a database opened with OpenFD.
+	path string
+	// created is set if Open created the file.
+	created  bool
+	opts     *options
+	casefold bool
+	// maxKeySize is fixed by the page size.
+	maxKeySize int
+	zeroCopy   bool
+	active     atomic.Int64
+	coalesce   *coalescer
+
+	compare       func(a, b []byte) int
+	compareHandle cgo.Handle
+
+	maxFileSize int64
+	// cachePool is kept alive for as long as the btree refers to it.
+	cachePool *CachePool
+
+	syncMu        sync.Mutex
+	syncPolicy    SyncPolicy
+	unsyncedTxns  int
+	unsyncedBytes int64
+
+	compactor *autoCompactor
+	// metrics is nil until RegisterExpvar is called.
+	metrics atomic.Pointer[metrics]
+	// tracer is nil unless opened WithTracerProvider.
+	tracer trace.Tracer
+	// entries is the number of entries as of the last commit through this
+	// handle, or as of Open, for Len.
+	entries atomic.Uint64
+	// locked is set if Open took the write lock on the file, which is held
+	// until the btree closes it, and is taken again on a compacted file.
+	locked bool
+	// writeMu is held for the life of a write transaction, so that writers
+	// through this handle take turns rather than conflicting.
+	writeMu sync.Mutex
 }
 
-func Open(path string, flags Flags, mode os.FileMode) (*DB, error) {
+// Open opens the database in the file at path, creating it with mode if need
+// be. Unless flags includes ReadOnly, or WithoutLock is passed, it takes a
+// write lock on the file, held until Close, and fails with ErrLocked while
+// another handle, in this process or another, holds it.
+func Open(path string, flags Flags, mode os.FileMode, opts ...Option) (*DB, error) {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A file opened ReadOnly is never created, Open fails instead.
+	var created bool
+	if flags&ReadOnly == 0 {
+		_, err := os.Stat(path)
+		created = errors.Is(err, fs.ErrNotExist)
+	}
+
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
-	bt, err := C.btree_open(cpath, C.uint(flags), C.mode_t(mode))
+	bt, err := C.btree_open(cpath, C.uint(o.btreeFlags(flags)), C.mode_t(mode), C.uint(o.pageSize))
 	if bt == nil {
-		return nil, fmt.Errorf("open failed: %w", err)
+		// Match os.Open so errors.Is works with the io/fs sentinels.
+		return nil, &fs.PathError{Op: "open", Path: path, Err: errnoError(err)}
+	}
+
+	locked := flags&ReadOnly == 0 && !o.noLock
+	if locked {
+		if err := lock(bt, path); err != nil {
+			C.btree_close(bt)
+			return nil, err
+		}
+	}
+
+	if created && flags&NoSync == 0 {
+		// Without syncing its directory entry a new file, and everything
+		// later committed to it, can be lost in a crash.
+		if err := syncCreated(int(C.btree_get_fd(bt)), path); err != nil {
+			C.btree_close(bt)
+			return nil, err
+		}
 	}
 
-	return &DB{bt}, nil
+	db := newDB(bt, flags, o)
+	db.path = path
+	db.created = created
+	db.locked = locked
+
+	return db, nil
 }
 
-func (db *DB) Close() error {
+// OpenMemory opens a new, empty database that is never visible in the file
+// system, for tests and caches that don't need to outlive the process. It is
+// backed by an unlinked temporary file, so pages that don't fit in the cache
+// spill to disk rather than memory, and the space is freed on Close. Commits
+// are never synced, as there is nothing to recover after a crash. The
+// database can't be compacted.
+func OpenMemory(flags Flags, opts ...Option) (*DB, error) {
+	f, err := os.CreateTemp("", "screwdb-*.db")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := os.Remove(f.Name()); err != nil {
+		return nil, err
+	}
+
+	return OpenFD(f.Fd(), flags|NoSync, opts...)
+}
+
+// OpenFD opens the database in the file open as fd, which must have been
+// opened for reading, and for writing too unless flags includes ReadOnly.
+// The database works on a duplicate of fd, so the caller still owns fd and
+// must close it as usual, while Close only closes the duplicate. The two share
+// the open file description though, so opening the database for writing sets
+// O_APPEND on fd as well. Unlike Open, a new file isn't synced, as its
+// directory entry is the caller's business, the file isn't locked, and the
+// database can't be compacted as its path isn't known.
+func OpenFD(fd uintptr, flags Flags, opts ...Option) (*DB, error) {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		return nil, fmt.Errorf("open failed: %w", errnoError(err))
+	}
+
+	bt, err := C.btree_open_fd(C.int(dup), C.uint(o.btreeFlags(flags)), C.uint(o.pageSize))
+	if bt == nil {
+		syscall.Close(dup)
+
+		return nil, fmt.Errorf("open failed: %w", errnoError(err))
+	}
+
+	return newDB(bt, flags, o), nil
+}
+
+// newDB wraps a newly opened btree.
+func newDB(bt *C.struct_btree, flags Flags, o *options) *DB {
+	setCache(bt, o)
+
+	casefold := C.btree_get_flags(bt)&C.BT_CASEFOLD != 0
+
+	db := &DB{bt: bt, flags: flags, opts: o, casefold: casefold, maxKeySize: int(C.btree_get_maxkeysize(bt)), zeroCopy: o.zeroCopy, maxFileSize: o.maxFileSize, cachePool: o.cachePool, syncPolicy: o.syncPolicy}
+	if o.coalesceWindow > 0 {
+		db.coalesce = &coalescer{window: o.coalesceWindow}
+	}
+	if o.compare != nil {
+		db.compare = o.compare
+		db.setCompare()
+	}
+	if o.tracerProvider != nil {
+		db.tracer = o.tracerProvider.Tracer(tracerName)
+	}
+
+	// The btree counts reserved keys as entries, Len doesn't.
+	var reserved uint64
+	if tx, err := db.begin(context.Background(), true); err == nil {
+		reserved, _ = tx.reservedEntries()
+		tx.Abort()
+	}
+
+	var st C.struct_btree_stat
+	C.btree_stat_cached(bt, &st)
+	db.entries.Store(uint64(st.entries) - min(reserved, uint64(st.entries)))
+
+	return db
+}
+
+func setCache(bt *C.struct_btree, o *options) {
+	if o.cacheSize > 0 {
+		C.btree_set_cache_size(bt, C.uint(o.cacheSize))
+	}
+	if o.cachePool != nil {
+		C.btree_set_cache_pool(bt, o.cachePool.pool)
+	}
+}
+
+// reopen replaces the btree with one on the file now at the path, after
+// Compact, through this or another handle, replaced the file the btree has
+// open. It does nothing and returns false unless err says the file was
+// replaced. Transactions already running hold their own reference to the old
+// btree, so keep reading the old file until they end. It must be called with
+// mu held.
+func (db *DB) reopen(err error) bool {
+	if !errors.Is(err, syscall.ESTALE) || db.path == "" {
+		return false
+	}
+
+	cpath := C.CString(db.path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	bt, _ := C.btree_open(cpath, C.uint(db.opts.btreeFlags(db.flags)), 0, C.uint(db.opts.pageSize))
+	if bt == nil {
+		return false
+	}
+	if db.locked && lock(bt, db.path) != nil {
+		// Another handle opened the compacted file first.
+		C.btree_close(bt)
+		return false
+	}
+	setCache(bt, db.opts)
+
 	C.btree_close(db.bt)
+	db.bt = bt
+	if db.compare != nil {
+		db.setCompare()
+	}
 
-	return nil
+	return true
 }
 
+// Close flushes any buffered puts and closes the database. If the flush fails
+// the database is closed all the same, the puts are lost and the error is
+// returned. It returns ErrTxnInProgress, leaving the database open, if a View
+// or Update is still running. Closing a closed database does nothing, while
+// most other methods return ErrClosed.
+func (db *DB) Close() error {
+	if db.bt == nil {
+		return nil
+	}
+
+	if db.ActiveTxns() > 0 {
+		return ErrTxnInProgress
+	}
+
+	// The database is closed even if the flush fails, as otherwise a put
+	// that can never be committed would keep it open.
+	flushErr := db.Flush()
+
+	if db.compactor != nil {
+		db.compactor.stop()
+		db.compactor = nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// A transaction may have begun while flushing.
+	if db.ActiveTxns() > 0 {
+		return errors.Join(flushErr, ErrTxnInProgress)
+	}
+
+	if db.coalesce != nil {
+		db.coalesce.discard()
+	}
+
+	rc, err := C.btree_close(db.bt)
+	db.bt = nil
+	if db.compare != nil {
+		db.compareHandle.Delete()
+	}
+	if rc != 0 {
+		return errors.Join(flushErr, fmt.Errorf("close failed: %w", errnoError(err)))
+	}
+
+	return flushErr
+}
+
+// ActiveTxns returns the number of View and Update calls currently running.
+func (db *DB) ActiveTxns() int {
+	return int(db.active.Load())
+}
+
+// Ping checks that the database is usable by beginning and aborting a read
+// transaction, which rereads the latest meta page if the file has grown, or
+// reopens the file if it has been compacted. It never writes, making it
+// suitable for readiness probes.
+func (db *DB) Ping() error {
+	return db.View(func(*Tx) error {
+		return nil
+	})
+}
+
+// Flags returns the flags the database was opened with, with NoSync as last
+// set by SetSync.
+func (db *DB) Flags() Flags {
+	return db.flags
+}
+
+// Path returns the absolute path of the file, or "" for a database opened
+// with OpenFD or OpenMemory.
+func (db *DB) Path() string {
+	return db.path
+}
+
+// IsNew reports whether Open created the file, rather than opening one that
+// already existed, for one-time initialization. It is always false for a
+// database opened with OpenFD or OpenMemory.
+func (db *DB) IsNew() bool {
+	return db.created
+}
+
+// MaxKeySize returns the length of the longest key that can be stored, which
+// depends on the page size.
+func (db *DB) MaxKeySize() int {
+	return db.maxKeySize
+}
+
+// SetCacheSize sets the maximum number of pages cached. It has no effect on a
+// database opened WithCachePool.
 func (db *DB) SetCacheSize(cacheSize uint) {
+	if db.bt == nil {
+		return
+	}
+
 	C.btree_set_cache_size(db.bt, C.uint(cacheSize))
+	db.opts.cacheSize = cacheSize
 }
 
+// SetSync turns the fsync on every commit on or off, as opening with or
+// without NoSync does. With it off, commits are much cheaper, but a crash can
+// lose those made since the last Sync, and as the kernel is free to reorder
+// writes, may leave a meta page referencing pages that never reached the
+// disk. A burst of Updates can be written with it off, made durable with
+// Sync, and then syncing turned back on. It has no effect on a database
+// opened WithSyncPolicy, whose policy decides when to sync, or ReadOnly.
+func (db *DB) SetSync(enabled bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.bt == nil || db.syncPolicy != (SyncPolicy{}) || db.flags&ReadOnly != 0 {
+		return
+	}
+
+	var sync C.int
+	if enabled {
+		sync = 1
+		db.flags &^= NoSync
+	} else {
+		db.flags |= NoSync
+	}
+
+	C.btree_set_sync(db.bt, sync)
+}
+
+// Sync flushes every committed transaction to disk. Unlike the fsync on
+// commit, it isn't skipped when syncing is off.
 func (db *DB) Sync() error {
-	rc, err := C.btree_sync(db.bt)
-	if rc != 0 {
-		return fmt.Errorf("sync failed: %w", err)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.bt == nil {
+		return ErrClosed
 	}
 
+	if db.flags&ReadOnly != 0 {
+		return nil
+	}
+
+	if err := syscall.Fsync(int(C.btree_get_fd(db.bt))); err != nil {
+		return fmt.Errorf("sync failed: %w", errnoError(err))
+	}
+
+	return nil
+}
+
+// committed records a successful commit of n bytes against the sync policy,
+// forcing an fsync once either threshold is reached.
+func (db *DB) committed(n int64) error {
+	if db.syncPolicy == (SyncPolicy{}) {
+		return nil
+	}
+
+	db.syncMu.Lock()
+	defer db.syncMu.Unlock()
+
+	db.unsyncedTxns++
+	db.unsyncedBytes += n
+
+	if (db.syncPolicy.commits <= 0 || db.unsyncedTxns < db.syncPolicy.commits) &&
+		(db.syncPolicy.bytes <= 0 || db.unsyncedBytes < db.syncPolicy.bytes) {
+		return nil
+	}
+
+	// The file is opened NoSync, so btree_sync would be a no-op.
+	if err := syscall.Fsync(int(C.btree_get_fd(db.bt))); err != nil {
+		return fmt.Errorf("sync failed: %w", errnoError(err))
+	}
+
+	db.unsyncedTxns, db.unsyncedBytes = 0, 0
+
 	return nil
 }
 
+// Compact rewrites the file keeping only the pages of the latest revision,
+// which drops the revisions before it. Transactions already running keep
+// reading the old file, while those that begin afterwards read the new one.
 func (db *DB) Compact() error {
+	if db.bt == nil {
+		return ErrClosed
+	}
+
 	rc, err := C.btree_compact(db.bt)
 	if rc != 0 {
-		return fmt.Errorf("compact failed: %w", err)
+		return fmt.Errorf("compact failed: %w", errnoError(err))
 	}
 
+	db.compacted()
+
 	return nil
 }
 
+// compacted moves the handle on to the file Compact replaced its own with
+// straight away, so it takes the lock on the new file before another handle
+// can open it.
+func (db *DB) compacted() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.reopen(syscall.ESTALE)
+}
+
+// Compare orders a and b the way the database orders keys, returning a
+// negative number, zero or a positive number if a sorts before, the same as,
+// or after b. It is implemented in Go, so is cheap enough for sorting.
 func (db *DB) Compare(a, b []byte) int {
-	cA := C.struct_btval{
-		data: C.CBytes(a),
-		size: C.ulong(len(a)),
+	if db.compare != nil {
+		return db.compare(a, b)
 	}
-	defer C.free(unsafe.Pointer(cA.data))
 
-	cB := C.struct_btval{
-		data: C.CBytes(b),
-		size: C.ulong(len(b)),
+	if !db.casefold {
+		return bytes.Compare(a, b)
 	}
 
-	return int(C.btree_cmp(db.bt, &cA, &cB))
+	for i := range min(len(a), len(b)) {
+		if ca, cb := asciiToLower(a[i]), asciiToLower(b[i]); ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
 
+	return len(a) - len(b)
+}
+
+func asciiToLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+
+	return c
 }
 
 type Tx struct {
-	bt *C.struct_btree
-	tx *C.struct_btree_txn
+	db         *DB
+	bt         *C.struct_btree
+	tx         *C.struct_btree_txn
+	ctx        context.Context
+	readOnly   bool
+	assertions []func(*Tx) bool
+	err        error
+	written    int64
+	zeroCopy   bool
+	pinned     []C.struct_btval
+
+	// parent and child link a nested transaction with the one it is nested
+	// in, see BeginNested.
+	parent, child *Tx
+	// span counts operations for tracing, if the transaction is traced.
+	span *txSpan
+
+	// pinner pins the keys and values passed to the btree, which are passed
+	// in key and value, as locals passed to C escape to the heap.
+	pinner     runtime.Pinner
+	key, value C.struct_btval
 }
 
+// View runs fn in a read transaction against the most recently committed
+// snapshot. Commits only ever append to the file, with the meta page written
+// last, so a commit in progress from another handle or process is never
+// visible and can't cause View to fail; there is nothing to retry.
 func (db *DB) View(fn func(*Tx) error) error {
-	tx := &Tx{
-		bt: db.bt,
+	return db.ViewContext(context.Background(), fn)
+}
+
+// ViewContext is like View, but doesn't start the transaction if ctx is
+// already done, and makes ctx available to fn through tx.Context. Scans over
+// the transaction check ctx between entries, stopping with its error once it
+// is done.
+func (db *DB) ViewContext(ctx context.Context, fn func(*Tx) error) error {
+	if db.tracer != nil {
+		return db.traced(ctx, "screwdb.View", fn, db.view)
 	}
 
-	var err error
-	tx.tx, err = C.btree_txn_begin(db.bt, 1)
-	if tx.tx == nil {
-		return fmt.Errorf("transaction begin failed: %w", err)
+	return db.view(ctx, fn)
+}
+
+func (db *DB) view(ctx context.Context, fn func(*Tx) error) error {
+	tx, err := db.begin(ctx, true)
+	if err != nil {
+		return err
 	}
-	defer C.btree_txn_abort(tx.tx)
+	defer tx.Abort()
 
 	return fn(tx)
 }
 
+// Update runs fn in a write transaction and commits it if fn returns nil.
+// Write transactions are exclusive, across processes as well as within one,
+// so a transaction never has to be rolled back because of another writer.
+// Updates through the same DB, from any number of goroutines, wait their turn,
+// while Update fails straight away with ErrTxnConflict if another handle or
+// process has a write transaction open, and can simply be retried. As the
+// wait is on a mutex, fn must not start another write transaction on the same
+// DB, which would wait forever. Views run alongside Updates. Any puts
+// buffered by WithCoalesceWindow are flushed first. If fn panics the
+// transaction is aborted before the panic carries on.
 func (db *DB) Update(fn func(*Tx) error) error {
+	return db.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext is like Update, but as with ViewContext makes ctx available
+// to fn and stops scans once it is done. If ctx is done before the
+// transaction starts, or by the time fn returns, the transaction is aborted
+// and UpdateContext returns the context's error.
+func (db *DB) UpdateContext(ctx context.Context, fn func(*Tx) error) error {
+	if err := db.Flush(); err != nil {
+		return err
+	}
+
+	return db.tracedUpdate(ctx, "screwdb.Update", fn)
+}
+
+func (db *DB) update(ctx context.Context, fn func(*Tx) error) error {
+	tx, err := db.beginWrite(ctx, true)
+	if err != nil {
+		return err
+	}
+	// Once committed this does nothing, but if fn panics the transaction
+	// mustn't be left holding the write lock.
+	defer tx.Abort()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Begin starts a transaction, for when one has to outlive a single function
+// call, such as one spanning several requests. It must be finished with
+// Commit or Abort, as until then it holds on to the pages it has read, a write
+// transaction blocks every other writer, and Close fails. Write transactions
+// fail with ErrReadOnly on a database opened ReadOnly, with ErrTxnConflict
+// while another is open, rather than waiting for it as Update does, and flush
+// any puts buffered by WithCoalesceWindow first. View and Update are usually
+// easier to get right.
+func (db *DB) Begin(readOnly bool) (*Tx, error) {
+	if readOnly {
+		return db.begin(context.Background(), true)
+	}
+
+	if err := db.Flush(); err != nil {
+		return nil, err
+	}
+
+	return db.beginWrite(context.Background(), false)
+}
+
+// beginWrite begins a write transaction, first waiting for any other write
+// transaction through this handle to finish, or if wait is false failing with
+// ErrTxnConflict. writeMu is held until the transaction finishes.
+func (db *DB) beginWrite(ctx context.Context, wait bool) (*Tx, error) {
+	if wait {
+		db.writeMu.Lock()
+	} else if !db.writeMu.TryLock() {
+		return nil, ErrTxnConflict
+	}
+
+	tx, err := db.begin(ctx, false)
+	if err != nil {
+		db.writeMu.Unlock()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (db *DB) begin(ctx context.Context, readOnly bool) (*Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.bt == nil {
+		return nil, ErrClosed
+	}
+
+	if !readOnly && db.flags&ReadOnly != 0 {
+		return nil, ErrReadOnly
+	}
+
 	tx := &Tx{
-		bt: db.bt,
+		db:       db,
+		bt:       db.bt,
+		ctx:      ctx,
+		readOnly: readOnly,
+		zeroCopy: db.zeroCopy,
+	}
+
+	var rdonly C.int
+	if readOnly {
+		rdonly = 1
 	}
 
 	var err error
-	tx.tx, err = C.btree_txn_begin(db.bt, 0)
+	tx.tx, err = C.btree_txn_begin(db.bt, rdonly)
+	if tx.tx == nil && db.reopen(err) {
+		tx.bt = db.bt
+		tx.tx, err = C.btree_txn_begin(db.bt, rdonly)
+	}
+	if tx.tx == nil {
+		if !readOnly && errors.Is(err, syscall.EBUSY) {
+			err = ErrTxnConflict
+		}
+
+		return nil, fmt.Errorf("transaction begin failed: %w", errnoError(err))
+	}
+	db.active.Add(1)
+	runtime.SetFinalizer(tx, (*Tx).finalize)
+
+	return tx, nil
+}
+
+// Commit commits a write transaction started with Begin, after checking its
+// assertions, or just ends a read transaction. Either way the transaction is
+// finished, even if Commit fails, and any further use of it fails with
+// ErrTxnDone. The exception is a transaction with a nested transaction still
+// open, for which Commit fails with ErrTxnInProgress and does nothing.
+func (tx *Tx) Commit() error {
 	if tx.tx == nil {
-		return fmt.Errorf("transaction begin failed: %w", err)
+		return ErrTxnDone
+	}
+
+	if tx.child != nil {
+		return ErrTxnInProgress
 	}
 
-	if err = fn(tx); err != nil {
-		C.btree_txn_abort(tx.tx)
+	if tx.parent != nil {
+		return tx.commitNested()
+	}
+
+	if tx.readOnly {
+		return tx.Abort()
+	}
+
+	for _, assertion := range tx.assertions {
+		if !assertion(tx) {
+			tx.Abort()
+
+			return ErrAssertionFailed
+		}
+	}
+
+	if err := tx.ctx.Err(); err != nil {
+		tx.Abort()
 
 		return err
 	}
 
+	if tx.db.maxFileSize > 0 && tx.written > 0 && int64(C.btree_txn_size(tx.tx)) > tx.db.maxFileSize {
+		tx.Abort()
+
+		return ErrSizeLimitExceeded
+	}
+
+	// Counted now, as the committed tree can't be read once the transaction
+	// ends.
+	reserved, err := tx.reservedEntries()
+	if err != nil {
+		tx.Abort()
+
+		return err
+	}
+
+	tx.release()
+
+	// The btree frees the transaction whether or not the commit succeeds.
 	rc, err := C.btree_txn_commit(tx.tx)
+	tx.finish()
 	if rc != 0 {
-		return fmt.Errorf("transaction commit failed: %w", err)
+		tx.ended("aborted")
+		return fmt.Errorf("transaction commit failed: %w", errnoError(err))
+	}
+	tx.ended("committed")
+
+	var st C.struct_btree_stat
+	C.btree_stat_cached(tx.bt, &st)
+	st.entries -= C.uint64_t(min(reserved, uint64(st.entries)))
+	tx.db.entries.Store(uint64(st.entries))
+
+	if m := tx.db.metrics.Load(); m != nil {
+		m.committed(&st)
+	}
+
+	return tx.db.committed(tx.written)
+}
+
+// Abort discards any changes made by the transaction and ends it. It returns
+// ErrTxnDone if the transaction has already been committed or aborted, so
+// is safe to defer.
+func (tx *Tx) Abort() error {
+	if tx.tx == nil {
+		return ErrTxnDone
+	}
+
+	if tx.child != nil {
+		tx.child.Abort()
+	}
+
+	if tx.parent != nil {
+		return tx.abortNested()
+	}
+
+	tx.release()
+	C.btree_txn_abort(tx.tx)
+	tx.finish()
+
+	if m := tx.db.metrics.Load(); m != nil && !tx.readOnly {
+		m.aborts.Add(1)
 	}
+	tx.ended("aborted")
 
 	return nil
 }
 
+// ended records the outcome of a traced write transaction.
+func (tx *Tx) ended(outcome string) {
+	if tx.span != nil && !tx.readOnly {
+		tx.span.outcome = outcome
+	}
+}
+
+// finish marks the transaction done once the btree has freed it.
+func (tx *Tx) finish() {
+	tx.tx = nil
+	tx.db.active.Add(-1)
+	runtime.SetFinalizer(tx, nil)
+
+	if !tx.readOnly {
+		tx.db.writeMu.Unlock()
+	}
+}
+
+// finalize aborts a transaction that became unreachable without being
+// committed or aborted, rather than leaving it to hold the write lock, or the
+// pages it has read, until the process exits.
+func (tx *Tx) finalize() {
+	slog.Warn("screwdb: transaction garbage collected without being committed or aborted")
+	tx.Abort()
+}
+
+// Assert registers a predicate that is evaluated, against the transaction's
+// final state, just before a write transaction commits. If any predicate
+// returns false the transaction is aborted and Update (or Commit) returns
+// ErrAssertionFailed. Assertions registered in a read transaction are never
+// evaluated.
+func (tx *Tx) Assert(fn func(*Tx) bool) {
+	tx.assertions = append(tx.assertions, fn)
+}
+
+// Context returns the context the transaction was started with, or
+// context.Background for View and Update.
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+// Err returns the first error encountered by an iterator over the
+// transaction, or nil if every iteration ran to completion.
+func (tx *Tx) Err() error {
+	return tx.err
+}
+
+func (tx *Tx) setErr(err error) {
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
 func (tx *Tx) Get(key []byte) ([]byte, error) {
-	cKey := C.struct_btval{
-		data: C.CBytes(key),
-		size: C.ulong(len(key)),
+	if err := checkKey(key); err != nil {
+		return nil, err
 	}
-	defer C.free(unsafe.Pointer(cKey.data))
 
-	var cValue C.struct_btval
-	rc, err := C.btree_txn_get(tx.bt, tx.tx, &cKey, &cValue)
+	if !tx.zeroCopy {
+		return tx.get(key)
+	}
+
+	return tx.getRef(key)
+}
+
+// GetRef is like Get, but returns a slice aliasing the page cache (or, for a
+// value stored on overflow pages, the buffer it was read into) instead of a
+// copy, as Get does for a database opened WithZeroCopyReads.
+//
+// The slice is only valid until the transaction ends, and in a write
+// transaction only until the next write, as any put or delete may rewrite the
+// page it aliases, even one to another key. Using it after that, including
+// retaining it anywhere that outlives the transaction, or modifying it at any
+// time, is undefined behaviour and may silently corrupt the database. The page
+// the value was read from stays cached until the transaction ends, regardless
+// of the cache size.
+func (tx *Tx) GetRef(key []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	return tx.getRef(key)
+}
+
+func (tx *Tx) getRef(key []byte) ([]byte, error) {
+	cValue, err := tx.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the value's page cached until the transaction ends.
+	tx.pinned = append(tx.pinned, cValue)
+
+	return view(&cValue), nil
+}
+
+// GetInto copies the value of key into dst and returns its length. If dst is
+// too short it returns the length along with an error wrapping
+// ErrBufferTooSmall, so the caller can grow dst and try again.
+func (tx *Tx) GetInto(key, dst []byte) (int, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+
+	cValue, err := tx.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	defer C.btval_reset(&cValue)
+
+	n := int(cValue.size)
+	if n > len(dst) {
+		return n, fmt.Errorf("%w: %d bytes, buffer is %d", ErrBufferTooSmall, n, len(dst))
+	}
+
+	return copy(dst, view(&cValue)), nil
+}
+
+// get returns a copy of the value of key.
+func (tx *Tx) get(key []byte) ([]byte, error) {
+	cValue, err := tx.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return goBytes(&cValue), nil
+}
+
+// lookup returns the value of key, which must be released with
+// C.btval_reset (or goBytes) once no longer needed.
+func (tx *Tx) lookup(key []byte) (C.struct_btval, error) {
+	if tx.tx == nil {
+		return C.struct_btval{}, ErrTxnDone
+	}
+
+	tx.pin(key, nil)
+	defer tx.unpin()
+
+	rc, err := C.btree_txn_get(tx.bt, tx.tx, &tx.key, &tx.value)
+	if rc != 0 {
+		if errors.Is(err, syscall.ENOENT) {
+			return C.struct_btval{}, ErrKeyNotFound
+		}
+
+		return C.struct_btval{}, fmt.Errorf("get failed: %w", errnoError(err))
+	}
+
+	if m := tx.db.metrics.Load(); m != nil {
+		m.gets.Add(1)
+	}
+	if tx.span != nil {
+		tx.span.gets++
+	}
+
+	return tx.value, nil
+}
+
+// pin points tx.key and tx.value at key and value, pinning their memory so
+// the btree can read it in place. A nil value leaves tx.value zeroed, for the
+// btree to return a value in. They must be passed to C as &tx.key and
+// &tx.value, for cgo to only check the fields rather than all of tx, and once
+// the call returns tx.unpin must be called.
+func (tx *Tx) pin(key, value []byte) {
+	tx.key = tx.pinBytes(key)
+	tx.value = tx.pinBytes(value)
+}
+
+func (tx *Tx) pinBytes(b []byte) C.struct_btval {
+	if len(b) == 0 {
+		return C.struct_btval{}
+	}
+
+	data := unsafe.SliceData(b)
+	tx.pinner.Pin(data)
+
+	return C.struct_btval{data: unsafe.Pointer(data), size: C.ulong(len(b))}
+}
+
+// unpin releases the memory pinned by pin, and zeroes tx.key and tx.value so
+// they don't keep pointing at it.
+func (tx *Tx) unpin() {
+	tx.key, tx.value = C.struct_btval{}, C.struct_btval{}
+	tx.pinner.Unpin()
+}
+
+// release drops the values pinned by Get, which must happen before the
+// transaction is committed or aborted.
+func (tx *Tx) release() {
+	for i := range tx.pinned {
+		C.btval_reset(&tx.pinned[i])
+	}
+	tx.pinned = nil
+}
+
+// Put sets the value of key. If overwrite is false and key already exists,
+// Put fails with an error matching syscall.EEXIST (and fs.ErrExist) and
+// leaves the existing value in place.
+func (tx *Tx) Put(key, value []byte, overwrite bool) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return tx.put(key, value, overwrite)
+}
+
+// Append adds key, which must sort after every key already in the database,
+// failing with ErrKeyOutOfOrder otherwise. Loading sorted input with Append
+// leaves pages 90% full rather than half full, so it is faster than Put and
+// the file ends up smaller.
+func (tx *Tx) Append(key, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	err := tx.putFlags(key, value, C.BT_APPEND)
+	if errors.Is(err, syscall.ERANGE) {
+		return fmt.Errorf("append failed: %w", ErrKeyOutOfOrder)
+	}
+
+	return err
+}
+
+// PutReserve sets the value of key to size zero bytes and returns them, for
+// the caller to fill in place rather than building the value first and
+// copying it in with Put. The slice aliases the page holding the value, so it
+// must be filled before anything else is written in the transaction, which
+// may move the value, and must not be used once the transaction ends. A value
+// too large for a page is instead filled into a buffer copied to its overflow
+// pages on commit.
+func (tx *Tx) PutReserve(key []byte, size int) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	if tx.tx == nil {
+		return nil, ErrTxnDone
+	}
+
+	if err := tx.db.checkKeySize(key); err != nil {
+		return nil, err
+	}
+
+	if size < 0 {
+		return nil, fmt.Errorf("put reserve failed: negative size %d", size)
+	}
+
+	tx.pin(key, nil)
+	defer tx.unpin()
+	tx.value.size = C.ulong(size)
+
+	rc, err := C.btree_txn_put(tx.bt, tx.tx, &tx.key, &tx.value, C.BT_RESERVE)
 	if rc != 0 {
-		return nil, fmt.Errorf("get failed: %w", err)
+		return nil, fmt.Errorf("put failed: %w", errnoError(err))
+	}
+	tx.written += int64(len(key) + size)
+
+	if m := tx.db.metrics.Load(); m != nil {
+		m.puts.Add(1)
+	}
+	if tx.span != nil {
+		tx.span.puts++
 	}
 
-	return C.GoBytes(cValue.data, C.int(cValue.size)), nil
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	return unsafe.Slice((*byte)(tx.value.data), size), nil
 }
 
-func (tx *Tx) Put(key, value []byte) error {
-	cKey := C.struct_btval{
-		data: C.CBytes(key),
-		size: C.ulong(len(key)),
+func (tx *Tx) put(key, value []byte, overwrite bool) error {
+	var flags C.uint
+	if !overwrite {
+		flags |= C.BT_NOOVERWRITE
+	}
+
+	return tx.putFlags(key, value, flags)
+}
+
+func (tx *Tx) putFlags(key, value []byte, flags C.uint) error {
+	if tx.tx == nil {
+		return ErrTxnDone
 	}
-	defer C.free(unsafe.Pointer(cKey.data))
 
-	cValue := C.struct_btval{
-		data: C.CBytes(value),
-		size: C.ulong(len(value)),
+	if err := tx.db.checkKeySize(key); err != nil {
+		return err
 	}
-	defer C.free(unsafe.Pointer(cValue.data))
 
-	rc, err := C.btree_txn_put(tx.bt, tx.tx, &cKey, &cValue)
+	// The btree copies key and value into its pages before returning.
+	tx.pin(key, value)
+	defer tx.unpin()
+
+	rc, err := C.btree_txn_put(tx.bt, tx.tx, &tx.key, &tx.value, flags)
 	if rc != 0 {
-		return fmt.Errorf("put failed: %w", err)
+		return fmt.Errorf("put failed: %w", errnoError(err))
+	}
+	tx.written += int64(len(key) + len(value))
+
+	if m := tx.db.metrics.Load(); m != nil {
+		m.puts.Add(1)
+	}
+	if tx.span != nil {
+		tx.span.puts++
 	}
 
 	return nil
 }
 
+// Delete removes key, failing with ErrKeyNotFound if it doesn't exist.
 func (tx *Tx) Delete(key []byte) error {
-	cKey := C.struct_btval{
-		data: C.CBytes(key),
-		size: C.ulong(len(key)),
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return tx.delete(key, nil)
+}
+
+// DeleteValue removes key and returns the value it held, failing with
+// ErrKeyNotFound if it doesn't exist.
+func (tx *Tx) DeleteValue(key []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	var cValue C.struct_btval
+	if err := tx.delete(key, &cValue); err != nil {
+		return nil, err
 	}
-	defer C.free(unsafe.Pointer(cKey.data))
 
-	rc, err := C.btree_txn_del(tx.bt, tx.tx, &cKey, nil)
+	return goBytes(&cValue), nil
+}
+
+// checkKey returns ErrEmptyKey or ErrReservedKey if key can't be used.
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	if isReserved(key) {
+		return ErrReservedKey
+	}
+
+	return nil
+}
+
+func (db *DB) checkKeySize(key []byte) error {
+	if len(key) > db.maxKeySize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLarge, len(key), db.maxKeySize)
+	}
+
+	return nil
+}
+
+// delete removes key. If value is not nil it is set to the removed value,
+// which must be released with C.btval_reset (or goBytes).
+func (tx *Tx) delete(key []byte, value *C.struct_btval) error {
+	if tx.tx == nil {
+		return ErrTxnDone
+	}
+
+	tx.pin(key, nil)
+	defer tx.unpin()
+
+	rc, err := C.btree_txn_del(tx.bt, tx.tx, &tx.key, value)
 	if rc != 0 {
-		return fmt.Errorf("delete failed: %w", err)
+		if value != nil {
+			C.btval_reset(value)
+		}
+
+		if errors.Is(err, syscall.ENOENT) {
+			return ErrKeyNotFound
+		}
+
+		return fmt.Errorf("delete failed: %w", errnoError(err))
 	}
+	tx.deleted()
 
 	return nil
 }
 
+// deleted counts a delete in the metrics and span. Deletes don't add to
+// written, so a transaction that only deletes is never refused by
+// WithMaxFileSize.
+func (tx *Tx) deleted() {
+	if m := tx.db.metrics.Load(); m != nil {
+		m.deletes.Add(1)
+	}
+	if tx.span != nil {
+		tx.span.deletes++
+	}
+}
+
 type Cursor struct {
 	cursor *C.struct_cursor
+	// tx keeps the transaction reachable for as long as the cursor is, so a
+	// leaked cursor is always finalized before its transaction.
+	tx *Tx
+	// scanned holds the entry Scan last landed on. It is allocated apart
+	// from the cursor, as it is passed to C and the cursor holds Go pointers.
+	scanned *scanned
+	err     error
+}
+
+type scanned struct {
+	key, value C.struct_btval
 }
 
 func (tx *Tx) Cursor() (*Cursor, error) {
+	if tx.tx == nil {
+		return nil, ErrTxnDone
+	}
+
 	cursor, err := C.btree_txn_cursor_open(tx.bt, tx.tx)
 	if cursor == nil {
-		return nil, fmt.Errorf("cursor open failed: %w", err)
+		return nil, fmt.Errorf("cursor open failed: %w", errnoError(err))
 	}
 
-	return &Cursor{cursor}, nil
+	c := &Cursor{cursor: cursor, tx: tx}
+	runtime.SetFinalizer(c, (*Cursor).finalize)
+
+	return c, nil
 }
 
+// Close releases the cursor. Closing it again does nothing.
 func (c *Cursor) Close() {
+	if c.cursor == nil {
+		return
+	}
+
+	if c.scanned != nil {
+		C.btval_reset(&c.scanned.key)
+		C.btval_reset(&c.scanned.value)
+	}
+
 	C.btree_cursor_close(c.cursor)
+	c.cursor = nil
+	runtime.SetFinalizer(c, nil)
+}
+
+func (c *Cursor) finalize() {
+	slog.Warn("screwdb: cursor garbage collected without being closed")
+	c.Close()
 }
 
 func (c *Cursor) First() ([]byte, []byte, error) {
-	var cKey, cValue C.struct_btval
+	cKey, cValue, err := c.get(nil, C.BT_FIRST)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return goBytes(&cKey), goBytes(&cValue), nil
+}
+
+func (c *Cursor) Next() ([]byte, []byte, error) {
+	cKey, cValue, err := c.get(nil, C.BT_NEXT)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return goBytes(&cKey), goBytes(&cValue), nil
+}
+
+// Last positions the cursor on the last entry, and returns it.
+func (c *Cursor) Last() ([]byte, []byte, error) {
+	cKey, cValue, err := c.get(nil, C.BT_LAST)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return goBytes(&cKey), goBytes(&cValue), nil
+}
+
+// Prev moves the cursor back to the entry before the one it is on, and
+// returns it. On a cursor that hasn't been positioned yet it returns the last
+// entry, and after Delete the entry before the deleted one.
+func (c *Cursor) Prev() ([]byte, []byte, error) {
+	cKey, cValue, err := c.get(nil, C.BT_PREV)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return goBytes(&cKey), goBytes(&cValue), nil
+}
+
+// NextSuffix is like Next, but strips the first prefixLen bytes from the
+// returned key without ever copying them out of the btree. It is intended for
+// scans where the caller already knows the prefix shared by every key.
+func (c *Cursor) NextSuffix(prefixLen int) ([]byte, []byte, error) {
+	cKey, cValue, err := c.get(nil, C.BT_NEXT)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer C.btval_reset(&cKey)
+
+	if prefixLen < 0 || prefixLen > int(cKey.size) {
+		C.btval_reset(&cValue)
+		return nil, nil, fmt.Errorf("prefix length %d out of range for key of length %d", prefixLen, cKey.size)
+	}
+
+	suffix := C.GoBytes(unsafe.Add(cKey.data, prefixLen), C.int(int(cKey.size)-prefixLen))
+
+	return suffix, goBytes(&cValue), nil
+}
+
+func (c *Cursor) Seek(key []byte) ([]byte, []byte, error) {
+	if len(key) == 0 {
+		return nil, nil, ErrEmptyKey
+	}
+
+	cKey, cValue, err := c.get(key, C.BT_CURSOR_EXACT)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return goBytes(&cKey), goBytes(&cValue), nil
+}
+
+// SeekRange positions the cursor on the first key not less than key, and
+// returns that entry. It returns ErrKeyNotFound if every key sorts before key.
+func (c *Cursor) SeekRange(key []byte) ([]byte, []byte, error) {
+	if len(key) == 0 {
+		return nil, nil, ErrEmptyKey
+	}
+
+	cKey, cValue, err := c.get(key, C.BT_CURSOR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return goBytes(&cKey), goBytes(&cValue), nil
+}
+
+// SeekCeil positions the cursor on the smallest key not less than key, as
+// SeekRange does, and returns that entry along with whether its key is key.
+func (c *Cursor) SeekCeil(key []byte) (k, v []byte, exact bool, err error) {
+	k, v, err = c.SeekRange(key)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return k, v, c.tx.db.Compare(k, key) == 0, nil
+}
+
+// SeekFloor positions the cursor on the largest key not greater than key, and
+// returns that entry along with whether its key is key. It returns
+// ErrKeyNotFound if every key sorts after key.
+func (c *Cursor) SeekFloor(key []byte) (k, v []byte, exact bool, err error) {
+	k, v, err = c.SeekRange(key)
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		// Every key sorts before key.
+		k, v, err = c.Last()
+	case err == nil && c.tx.db.Compare(k, key) == 0:
+		return k, v, true, nil
+	case err == nil:
+		// Overshot, so step back to the key before.
+		k, v, err = c.Prev()
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return k, v, false, nil
+}
 
-	rc, err := C.btree_cursor_get(c.cursor, &cKey, &cValue, C.BT_FIRST)
+// Current returns the entry the cursor is positioned on, without moving it.
+// It returns ErrKeyNotFound if the cursor isn't positioned on an entry: it
+// hasn't been positioned yet, the last seek failed, or it has run past the
+// last key.
+func (c *Cursor) Current() ([]byte, []byte, error) {
+	cKey, cValue, err := c.get(nil, C.BT_CURRENT)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return goBytes(&cKey), goBytes(&cValue), nil
+}
+
+// Scan advances the cursor to the next entry, or the first if it hasn't been
+// positioned yet, as Next does, and reports whether there was one. Unlike
+// Next it doesn't copy the entry out of the btree: Key and Value return it
+// until the next call to Scan or Close, so stepping through entries with Scan
+// doesn't allocate. Once Scan returns false, Err returns the error that
+// stopped it, or nil if it ran past the last entry.
+func (c *Cursor) Scan() bool {
+	if c.cursor == nil {
+		c.err = fmt.Errorf("cursor get failed: %w", syscall.EINVAL)
+		return false
+	}
+
+	s := c.scanned
+	if s == nil {
+		s = &scanned{}
+		c.scanned = s
+	}
+	C.btval_reset(&s.key)
+	C.btval_reset(&s.value)
+
+	rc, err := C.btree_cursor_get(c.cursor, &s.key, &s.value, C.BT_NEXT)
+	for rc == 0 && isReserved(view(&s.key)) {
+		// Reserved keys are internal, step over them.
+		C.btval_reset(&s.key)
+		C.btval_reset(&s.value)
+		rc, err = C.btree_cursor_get(c.cursor, &s.key, &s.value, C.BT_NEXT)
+	}
 	if rc != 0 {
-		return nil, nil, fmt.Errorf("cursor get failed: %w", err)
+		C.btval_reset(&s.key)
+		C.btval_reset(&s.value)
+
+		if !errors.Is(err, syscall.ENOENT) {
+			c.err = fmt.Errorf("cursor get failed: %w", errnoError(err))
+		}
+
+		return false
 	}
 
-	return C.GoBytes(cKey.data, C.int(cKey.size)), C.GoBytes(cValue.data, C.int(cValue.size)), nil
+	return true
 }
 
-func (c *Cursor) Next() ([]byte, []byte, error) {
-	var cKey, cValue C.struct_btval
+// Key returns the key of the entry Scan last landed on, which must not be
+// modified or used after the next call to Scan or Close.
+func (c *Cursor) Key() []byte {
+	if c.scanned == nil {
+		return nil
+	}
+
+	return view(&c.scanned.key)
+}
 
-	rc, err := C.btree_cursor_get(c.cursor, &cKey, &cValue, C.BT_NEXT)
+// Value returns the value of the entry Scan last landed on, which must not be
+// modified or used after the next call to Scan or Close.
+func (c *Cursor) Value() []byte {
+	if c.scanned == nil {
+		return nil
+	}
+
+	return view(&c.scanned.value)
+}
+
+// Err returns the error that stopped Scan, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Delete deletes the entry the cursor is on, which must be in a write
+// transaction. The cursor is left between entries, so Current returns
+// ErrKeyNotFound and Next returns the entry that followed the deleted one,
+// making it safe to delete entries while stepping through them. It returns
+// ErrKeyNotFound if the cursor isn't positioned on an entry.
+func (c *Cursor) Delete() error {
+	if c.cursor == nil {
+		return fmt.Errorf("cursor delete failed: %w", syscall.EINVAL)
+	}
+
+	if c.tx.tx == nil {
+		return ErrTxnDone
+	}
+
+	rc, err := C.btree_cursor_del(c.cursor)
 	if rc != 0 {
-		return nil, nil, fmt.Errorf("cursor get failed: %w", err)
+		if errors.Is(err, syscall.ENOENT) {
+			return ErrKeyNotFound
+		}
+
+		return fmt.Errorf("cursor delete failed: %w", errnoError(err))
 	}
+	c.tx.deleted()
 
-	return C.GoBytes(cKey.data, C.int(cKey.size)), C.GoBytes(cValue.data, C.int(cValue.size)), nil
+	return nil
 }
 
-func (c *Cursor) Seek(key []byte) ([]byte, []byte, error) {
+// get positions the cursor and returns the key and value it lands on. Both
+// must be released with C.btval_reset (or goBytes) once no longer needed.
+func (c *Cursor) get(key []byte, op C.enum_cursor_op) (C.struct_btval, C.struct_btval, error) {
 	var cValue C.struct_btval
+	cKey, err := c.fetch(key, op, &cValue)
+
+	return cKey, cValue, err
+}
+
+// fetch is like get, but only reads the value into value if it isn't nil, so
+// scans that only need keys never read values from overflow pages.
+func (c *Cursor) fetch(key []byte, op C.enum_cursor_op, value *C.struct_btval) (C.struct_btval, error) {
+	var cKey C.struct_btval
+
+	if key != nil {
+		// The cursor overwrites cKey with the key it lands on.
+		data := C.CBytes(key)
+		defer C.free(data)
+
+		cKey.data = data
+		cKey.size = C.ulong(len(key))
+	}
 
-	cKey := C.struct_btval{
-		data: C.CBytes(key),
-		size: C.ulong(len(key)),
+	step := C.enum_cursor_op(C.BT_NEXT)
+	if op == C.BT_LAST || op == C.BT_PREV {
+		step = C.BT_PREV
 	}
 
-	rc, err := C.btree_cursor_get(c.cursor, &cKey, &cValue, C.BT_CURSOR_EXACT)
+	rc, err := C.btree_cursor_get(c.cursor, &cKey, value, op)
+	for rc == 0 && isReserved(view(&cKey)) {
+		// Reserved keys are internal, step over them.
+		C.btval_reset(&cKey)
+		C.btval_reset(value)
+
+		if op == C.BT_CURSOR_EXACT || op == C.BT_CURRENT {
+			rc, err = -1, syscall.ENOENT
+			break
+		}
+
+		rc, err = C.btree_cursor_get(c.cursor, &cKey, value, step)
+	}
 	if rc != 0 {
-		return nil, nil, fmt.Errorf("cursor get failed: %w", err)
+		C.btval_reset(&cKey)
+		C.btval_reset(value)
+
+		if errors.Is(err, syscall.ENOENT) {
+			return cKey, ErrKeyNotFound
+		}
+
+		return cKey, fmt.Errorf("cursor get failed: %w", errnoError(err))
 	}
 
-	return C.GoBytes(cKey.data, C.int(cKey.size)), C.GoBytes(cValue.data, C.int(cValue.size)), nil
+	return cKey, nil
+}
+
+// goBytes copies v into Go memory and releases it.
+func goBytes(v *C.struct_btval) []byte {
+	b := C.GoBytes(v.data, C.int(v.size))
+	C.btval_reset(v)
+
+	return b
+}
+
+// lock takes the write lock on the file the btree has open, returning
+// ErrLocked if another handle holds it. The lock is released when the btree
+// closes the file.
+func lock(bt *C.struct_btree, path string) error {
+	err := lockBtree(bt)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return ErrLocked
+	} else if err != nil {
+		return &fs.PathError{Op: "lock", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// syncCreated fsyncs a newly created file, then the directory containing it.
+func syncCreated(fd int, path string) error {
+	if err := syscall.Fsync(fd); err != nil {
+		return fmt.Errorf("sync failed: %w", errnoError(err))
+	}
+
+	return syncDir(path)
+}
+
+// syncDir fsyncs the directory containing path, so that a file created or
+// renamed there survives a crash. It is a variable so tests can see it called.
+var syncDir = func(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("sync failed: %w", errnoError(err))
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("sync failed: %w", errnoError(err))
+	}
+
+	return nil
 }
@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+
+// EntrySlice is an in-memory, indexable view of the keys of a range, as
+// returned by Tx.Slice. It implements sort.Interface, ordering keys by the
+// collation of the database, so the sort and search packages can be used over
+// it. Values are fetched lazily, so Value may only be called while the
+// transaction that created the slice is still open.
+type EntrySlice struct {
+	tx   *Tx
+	keys [][]byte
+}
+
+// Slice loads every key in [lo, hi) into memory, in order, and returns them
+// as an EntrySlice. A nil lo starts at the first key and a nil hi continues to
+// the last. The keys are copied out of the btree, so memory use grows with the
+// size of the range, and it is only intended for small ranges. As the slice
+// is taken from a single transaction it is a consistent snapshot.
+func (tx *Tx) Slice(lo, hi []byte) (*EntrySlice, error) {
+	s := &EntrySlice{tx: tx}
+
+	err := tx.scanKeys(lo, hi, func(key *C.struct_btval) bool {
+		s.keys = append(s.keys, C.GoBytes(key.data, C.int(key.size)))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *EntrySlice) Len() int {
+	return len(s.keys)
+}
+
+func (s *EntrySlice) Less(i, j int) bool {
+	return s.tx.db.Compare(s.keys[i], s.keys[j]) < 0
+}
+
+func (s *EntrySlice) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// Key returns the i'th key.
+func (s *EntrySlice) Key(i int) []byte {
+	return s.keys[i]
+}
+
+// Value reads the value of the i'th key from the transaction.
+func (s *EntrySlice) Value(i int) ([]byte, error) {
+	return s.tx.Get(s.keys[i])
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import "context"
+
+// Snapshot is a read only view of the database as of when it was taken, that
+// can be held for as long as needed rather than only for the duration of a
+// View. It is a read transaction underneath, so Close must be called once it
+// is no longer needed: until then Close on the DB fails with
+// ErrTxnInProgress.
+type Snapshot struct {
+	tx *Tx
+}
+
+// Snapshot takes a snapshot of the latest revision.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	tx, err := db.begin(context.Background(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{tx: tx}, nil
+}
+
+// Get returns the value of key as of the snapshot, as Tx.Get does.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	return s.tx.Get(key)
+}
+
+// Has reports whether key existed as of the snapshot.
+func (s *Snapshot) Has(key []byte) (bool, error) {
+	return s.tx.Has(key)
+}
+
+// Cursor opens a cursor over the snapshot, which must be closed before the
+// snapshot is.
+func (s *Snapshot) Cursor() (*Cursor, error) {
+	return s.tx.Cursor()
+}
+
+// Close releases the snapshot. Closing a closed snapshot does nothing.
+func (s *Snapshot) Close() error {
+	if s.tx.tx == nil {
+		return nil
+	}
+
+	return s.tx.Abort()
+}
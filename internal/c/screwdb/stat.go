@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include <stdlib.h>
+// #include "btree.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Stat describes the shape of the tree as of the most recent commit.
+type Stat struct {
+	PageSize      uint
+	Depth         uint
+	Entries       uint64
+	BranchPages   uint64
+	LeafPages     uint64
+	OverflowPages uint64
+	Revisions     uint64
+	// FilePages is the number of pages in the file. As pages are never
+	// overwritten, it includes the old copies left behind by every commit.
+	FilePages uint64
+	// ReclaimablePages is the number of pages in the file that the current
+	// revision no longer refers to, which Compact would drop.
+	ReclaimablePages uint64
+	// AllocatedBytes is the disk space allocated to the file, which includes
+	// any space Preallocate has reserved past its end.
+	AllocatedBytes int64
+}
+
+// Len returns the number of entries, as Stat does, but without reading the
+// file: it is kept up to date by commits through this handle, so doesn't
+// include commits made through another handle or process since Open, or puts
+// still buffered by WithCoalesceWindow. An overwrite doesn't count as a new
+// entry, and an aborted transaction doesn't change it.
+func (db *DB) Len() uint64 {
+	return db.entries.Load()
+}
+
+// Stat returns statistics about the database, including any writes still
+// buffered by WithCoalesceWindow.
+func (db *DB) Stat() (*Stat, error) {
+	if db.bt == nil {
+		return nil, ErrClosed
+	}
+
+	if err := db.Flush(); err != nil {
+		return nil, err
+	}
+
+	var st C.struct_btree_stat
+	var fst syscall.Stat_t
+	db.mu.Lock()
+	rc, err := C.btree_stat(db.bt, &st)
+	if rc != 0 && db.reopen(err) {
+		rc, err = C.btree_stat(db.bt, &st)
+	}
+	if rc == 0 {
+		err = syscall.Fstat(int(C.btree_get_fd(db.bt)), &fst)
+	}
+	db.mu.Unlock()
+	if rc != 0 || err != nil {
+		return nil, fmt.Errorf("stat failed: %w", errnoError(err))
+	}
+
+	var reserved uint64
+	err = db.View(func(tx *Tx) error {
+		reserved, err = tx.reservedEntries()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stat := &Stat{
+		PageSize:      uint(st.psize),
+		Depth:         uint(st.depth),
+		Entries:       uint64(st.entries) - min(reserved, uint64(st.entries)),
+		BranchPages:   uint64(st.branch_pages),
+		LeafPages:     uint64(st.leaf_pages),
+		OverflowPages: uint64(st.overflow_pages),
+		Revisions:     uint64(st.revisions),
+		FilePages:     uint64(st.file_pages),
+		// Blocks are counted in 512 byte units, whatever the filesystem's.
+		AllocatedBytes: int64(fst.Blocks) * 512,
+	}
+
+	// Besides the tree, the header and the latest meta page are live.
+	live := stat.BranchPages + stat.LeafPages + stat.OverflowPages + 2
+	if stat.FilePages > live {
+		stat.ReclaimablePages = stat.FilePages - live
+	}
+
+	return stat, nil
+}
+
+// FileSize returns the size of the file in bytes. After a compaction it's the
+// size of the new file, even while transactions that began before it are
+// still reading the old one.
+func (db *DB) FileSize() (int64, error) {
+	// Pick up the compacted file, if any.
+	if err := db.Ping(); err != nil {
+		return 0, err
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(C.btree_get_fd(db.bt)), &st); err != nil {
+		return 0, fmt.Errorf("stat failed: %w", errnoError(err))
+	}
+
+	return st.Size, nil
+}
+
+// reservedEntries returns the number of keys in the reserved namespace, such
+// as those written by SetMeta, which the btree counts as entries along with
+// the user's.
+func (tx *Tx) reservedEntries() (uint64, error) {
+	cursor, err := C.btree_txn_cursor_open(tx.bt, tx.tx)
+	if cursor == nil {
+		return 0, fmt.Errorf("cursor open failed: %w", errnoError(err))
+	}
+	defer C.btree_cursor_close(cursor)
+
+	prefix := C.CBytes([]byte(reservedPrefix))
+	defer C.free(prefix)
+
+	var n uint64
+	key := C.struct_btval{data: prefix, size: C.ulong(len(reservedPrefix))}
+	for op := C.enum_cursor_op(C.BT_CURSOR); ; op = C.BT_NEXT {
+		rc, err := C.btree_cursor_get(cursor, &key, nil, op)
+		if rc != 0 {
+			if errors.Is(err, syscall.ENOENT) {
+				return n, nil
+			}
+
+			return 0, fmt.Errorf("cursor get failed: %w", errnoError(err))
+		}
+
+		reserved := isReserved(view(&key))
+		C.btval_reset(&key)
+		if !reserved {
+			return n, nil
+		}
+		n++
+	}
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include <stdlib.h>
+// #include "btree.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// WriteValueTo writes the value of key to w and returns the number of bytes
+// written. A value large enough to be stored on overflow pages is written one
+// page at a time, straight from the page cache, so it is never copied into Go
+// memory in full.
+func (tx *Tx) WriteValueTo(key []byte, w io.Writer) (int64, error) {
+	if tx.tx == nil {
+		return 0, ErrTxnDone
+	}
+
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+
+	cKey := C.struct_btval{
+		data: C.CBytes(key),
+		size: C.ulong(len(key)),
+	}
+	defer C.free(cKey.data)
+
+	var cValue C.struct_btval
+	var pgno C.uint32_t
+	rc, err := C.btree_txn_get_lazy(tx.bt, tx.tx, &cKey, &cValue, &pgno)
+	if rc != 0 {
+		if errors.Is(err, syscall.ENOENT) {
+			return 0, ErrKeyNotFound
+		}
+
+		return 0, fmt.Errorf("get failed: %w", errnoError(err))
+	}
+
+	if pgno == 0 {
+		defer C.btval_reset(&cValue)
+
+		n, err := w.Write(view(&cValue))
+		return int64(n), err
+	}
+
+	var written int64
+	for remaining := cValue.size; remaining > 0; {
+		var chunk C.struct_btval
+		rc, err := C.btree_read_overflow(tx.bt, pgno, C.size_t(remaining), &chunk, &pgno)
+		if rc != 0 {
+			return written, fmt.Errorf("overflow read failed: %w", errnoError(err))
+		}
+
+		remaining -= chunk.size
+
+		n, err := w.Write(view(&chunk))
+		C.btval_reset(&chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenSyncsDir(t *testing.T) {
+	var synced []string
+	var failWith error
+
+	orig := syncDir
+	t.Cleanup(func() { syncDir = orig })
+	syncDir = func(path string) error {
+		synced = append(synced, path)
+		if failWith != nil {
+			return failWith
+		}
+
+		return orig(path)
+	}
+
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := Open(path, 0, 0o644)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.Equal(t, []string{path}, synced)
+
+	// An existing file isn't synced again, nor is a new one opened NoSync.
+	db, err = Open(path, 0, 0o644)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = Open(filepath.Join(t.TempDir(), "screwdb_test.db"), NoSync, 0o644)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.Len(t, synced, 1)
+
+	// Open fails if the directory can't be synced.
+	failWith = errors.New("sync failed")
+	_, err = Open(filepath.Join(t.TempDir(), "screwdb_test.db"), 0, 0o644)
+	require.ErrorIs(t, err, failWith)
+}
@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Entry is a key along with the size of its value.
+type Entry struct {
+	Key  []byte
+	Size int
+}
+
+// TopBySize returns the n entries with the largest values, largest first. It
+// scans the keys of the whole database, taking each size from its leaf node,
+// so never reads a value, and only keeps the n largest seen so far.
+func (tx *Tx) TopBySize(n int) ([]Entry, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	c, err := tx.Cursor()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var top entryHeap
+	for op := C.enum_cursor_op(C.BT_FIRST); ; op = C.BT_NEXT {
+		if err := tx.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		cKey, err := c.fetch(nil, op, nil)
+		if errors.Is(err, ErrKeyNotFound) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var dsize C.size_t
+		rc, err := C.btree_cursor_dsize(c.cursor, &dsize)
+		if rc != 0 {
+			C.btval_reset(&cKey)
+			return nil, fmt.Errorf("cursor get failed: %w", errnoError(err))
+		}
+
+		if size := int(dsize); len(top) < n || size > top[0].Size {
+			entry := Entry{Key: C.GoBytes(cKey.data, C.int(cKey.size)), Size: size}
+			if len(top) < n {
+				heap.Push(&top, entry)
+			} else {
+				top[0] = entry
+				heap.Fix(&top, 0)
+			}
+		}
+		C.btval_reset(&cKey)
+	}
+
+	slices.SortStableFunc(top, func(a, b Entry) int {
+		return b.Size - a.Size
+	})
+
+	return top, nil
+}
+
+// entryHeap is a min heap of entries ordered by size.
+type entryHeap []Entry
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h[i].Size < h[j].Size }
+func (h entryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *entryHeap) Push(x any) {
+	*h = append(*h, x.(Entry))
+}
+
+func (h *entryHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return x
+}
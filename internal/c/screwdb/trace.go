@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/dpeckett/screwdb"
+
+// WithTracerProvider traces every View and Update, and their Context
+// variants, as a span started from the context they are given, along with
+// each attempt made by UpdateRetry and each Flush of buffered puts. Each span
+// records the number of gets, puts and deletes made, whether an Update
+// committed or aborted, and the error returned, if any. Without it nothing
+// is traced, at no cost.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracerProvider = tp
+	}
+}
+
+// txSpan counts the operations made in a traced transaction.
+type txSpan struct {
+	gets, puts, deletes int
+	// outcome is set once a write transaction ends.
+	outcome string
+}
+
+// tracedUpdate runs fn in a write transaction, in a span named name with attrs
+// if the DB is traced.
+func (db *DB) tracedUpdate(ctx context.Context, name string, fn func(*Tx) error, attrs ...attribute.KeyValue) error {
+	if db.tracer != nil {
+		return db.traced(ctx, name, fn, db.update, attrs...)
+	}
+
+	return db.update(ctx, fn)
+}
+
+// traced runs fn through run, which runs it in a transaction, in a span
+// named name with attrs.
+func (db *DB) traced(ctx context.Context, name string, fn func(*Tx) error, run func(context.Context, func(*Tx) error) error, attrs ...attribute.KeyValue) error {
+	ctx, span := db.tracer.Start(ctx, name)
+	defer span.End()
+
+	span.SetAttributes(attrs...)
+
+	s := &txSpan{}
+	err := run(ctx, func(tx *Tx) error {
+		tx.span = s
+		return fn(tx)
+	})
+
+	span.SetAttributes(
+		attribute.Int("screwdb.gets", s.gets),
+		attribute.Int("screwdb.puts", s.puts),
+		attribute.Int("screwdb.deletes", s.deletes),
+	)
+	if s.outcome != "" {
+		span.SetAttributes(attribute.String("screwdb.outcome", s.outcome))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
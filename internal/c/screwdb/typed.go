@@ -0,0 +1,232 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// Codec converts between values of type T and the bytes stored in the
+// database. For keys the encoding determines the key order.
+type Codec[T any] interface {
+	Encode(T) ([]byte, error)
+	Decode([]byte) (T, error)
+}
+
+// StringCodec stores strings as their bytes.
+type StringCodec struct{}
+
+func (StringCodec) Encode(s string) ([]byte, error) {
+	return []byte(s), nil
+}
+
+func (StringCodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+// Uint64Codec stores integers as 8 big-endian bytes, so keys sort
+// numerically.
+type Uint64Codec struct{}
+
+func (Uint64Codec) Encode(n uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, n), nil
+}
+
+func (Uint64Codec) Decode(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("uint64 must be 8 bytes, got %d", len(b))
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Typed stores keys of type K and values of type V, encoded with a pair of
+// codecs, in a database.
+type Typed[K, V any] struct {
+	db     *DB
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// NewTyped returns a Typed view of db, which can still be used directly.
+func NewTyped[K, V any](db *DB, keyCodec Codec[K], valueCodec Codec[V]) *Typed[K, V] {
+	return &Typed[K, V]{db: db, keys: keyCodec, values: valueCodec}
+}
+
+// Get returns the value of key, as DB.Get does.
+func (t *Typed[K, V]) Get(key K) (V, error) {
+	var value V
+
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return value, fmt.Errorf("encode key failed: %w", err)
+	}
+
+	v, err := t.db.Get(k)
+	if err != nil {
+		return value, err
+	}
+
+	if value, err = t.values.Decode(v); err != nil {
+		return value, fmt.Errorf("%w: value: %w", ErrDecodeFailed, err)
+	}
+
+	return value, nil
+}
+
+// Put sets the value of key, as DB.Put does.
+func (t *Typed[K, V]) Put(key K, value V) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return fmt.Errorf("encode key failed: %w", err)
+	}
+
+	v, err := t.values.Encode(value)
+	if err != nil {
+		return fmt.Errorf("encode value failed: %w", err)
+	}
+
+	return t.db.Put(k, v)
+}
+
+// All yields every entry in tx, decoded, in order. Iteration stops at the
+// first entry that can't be decoded. Errors are reported by tx.Err.
+func (t *Typed[K, V]) All(tx *Tx) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for k, v := range tx.All() {
+			key, err := t.keys.Decode(k)
+			if err != nil {
+				tx.setErr(fmt.Errorf("%w: key: %w", ErrDecodeFailed, err))
+				return
+			}
+
+			value, err := t.values.Decode(v)
+			if err != nil {
+				tx.setErr(fmt.Errorf("%w: value: %w", ErrDecodeFailed, err))
+				return
+			}
+
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// TypedCursor is a Cursor whose entries are decoded with the codecs of the
+// Typed it was opened from. A stored key or value that can't be decoded is
+// reported as an error wrapping ErrDecodeFailed, so it is told apart from
+// ErrKeyNotFound.
+type TypedCursor[K, V any] struct {
+	c     *Cursor
+	typed *Typed[K, V]
+	err   error
+}
+
+// Cursor opens a cursor over tx, which must be closed before tx ends.
+func (t *Typed[K, V]) Cursor(tx *Tx) (*TypedCursor[K, V], error) {
+	c, err := tx.Cursor()
+	if err != nil {
+		return nil, err
+	}
+
+	return &TypedCursor[K, V]{c: c, typed: t}, nil
+}
+
+// First positions the cursor on the first entry and returns it.
+func (c *TypedCursor[K, V]) First() (K, V, error) {
+	return c.decode(c.c.First())
+}
+
+// Next moves the cursor to the next entry, or the first if it hasn't been
+// positioned yet, and returns it.
+func (c *TypedCursor[K, V]) Next() (K, V, error) {
+	return c.decode(c.c.Next())
+}
+
+// Seek positions the cursor on key and returns its entry, as Cursor.Seek does.
+func (c *TypedCursor[K, V]) Seek(key K) (K, V, error) {
+	k, err := c.typed.keys.Encode(key)
+	if err != nil {
+		return c.decode(nil, nil, fmt.Errorf("encode key failed: %w", err))
+	}
+
+	return c.decode(c.c.Seek(k))
+}
+
+// SeekRange positions the cursor on the first key not less than key, once
+// encoded, and returns that entry, as Cursor.SeekRange does.
+func (c *TypedCursor[K, V]) SeekRange(key K) (K, V, error) {
+	k, err := c.typed.keys.Encode(key)
+	if err != nil {
+		return c.decode(nil, nil, fmt.Errorf("encode key failed: %w", err))
+	}
+
+	return c.decode(c.c.SeekRange(k))
+}
+
+// All yields every entry, decoded, in order, starting over from the first
+// wherever the cursor is. Iteration stops at the first entry that can't be
+// decoded. Errors are reported by Err.
+func (c *TypedCursor[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c.err = nil
+
+		for key, value, err := c.First(); ; key, value, err = c.Next() {
+			if errors.Is(err, ErrKeyNotFound) {
+				return
+			} else if err != nil {
+				c.err = err
+				return
+			}
+
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error that stopped All, if any.
+func (c *TypedCursor[K, V]) Err() error {
+	return c.err
+}
+
+// Close closes the cursor.
+func (c *TypedCursor[K, V]) Close() {
+	c.c.Close()
+}
+
+func (c *TypedCursor[K, V]) decode(k, v []byte, err error) (key K, value V, _ error) {
+	if err != nil {
+		return key, value, err
+	}
+
+	if key, err = c.typed.keys.Decode(k); err != nil {
+		return key, value, fmt.Errorf("%w: key: %w", ErrDecodeFailed, err)
+	}
+
+	if value, err = c.typed.values.Decode(v); err != nil {
+		return key, value, fmt.Errorf("%w: value: %w", ErrDecodeFailed, err)
+	}
+
+	return key, value, nil
+}
@@ -0,0 +1,209 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package screwdb
+
+// #include "btree.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Verify checks the latest revision for inconsistencies, returning an error
+// wrapping ErrCorrupted that describes the first one found. It checks the
+// hash of the meta page, that every page the tree links to is a page of the
+// expected type written before the meta page, that every leaf is at the depth
+// recorded in the meta page, and that the keys are in order and add up to the
+// number of entries recorded. It reads every page of the tree,
+// in a read transaction of its own.
+func (db *DB) Verify() error {
+	return db.View(func(tx *Tx) error {
+		return tx.verify()
+	})
+}
+
+func (tx *Tx) verify() error {
+	var st C.struct_btree_stat
+	rc, err := C.btree_txn_stat(tx.tx, &st)
+	if rc != 0 {
+		return fmt.Errorf("verify failed: %w", errnoError(err))
+	}
+
+	v := verifier{tx: tx, depth: int(st.depth), meta: C.uint32_t(st.file_pages) - 1}
+
+	if root := C.btree_txn_root(tx.tx); root != 0 {
+		if err := v.link(v.meta, root); err != nil {
+			return err
+		}
+
+		if err := v.page(root, 0); err != nil {
+			return err
+		}
+	}
+
+	if v.entries != uint64(st.entries) {
+		return fmt.Errorf("%w: leaves hold %d entries, meta page records %d", ErrCorrupted, v.entries, st.entries)
+	}
+
+	return v.order()
+}
+
+type verifier struct {
+	tx    *Tx
+	depth int
+	// meta is the meta page of the revision, which is written after every
+	// page of the tree.
+	meta    C.uint32_t
+	entries uint64
+}
+
+// link checks that page from can link to page to.
+func (v *verifier) link(from, to C.uint32_t) error {
+	if to == 0 || to >= v.meta {
+		return fmt.Errorf("%w: page %d links to page %d, which isn't before meta page %d", ErrCorrupted, from, to, v.meta)
+	}
+
+	return nil
+}
+
+// page checks the page pgno at level and, recursively, every page below it.
+func (v *verifier) page(pgno C.uint32_t, level int) error {
+	info, err := v.tx.pageInfo(pgno)
+	if err != nil {
+		return v.pageErr(pgno, err)
+	}
+
+	want := C.int(C.BT_PAGE_BRANCH)
+	if level == v.depth-1 {
+		want = C.BT_PAGE_LEAF
+	}
+	if info._type != want {
+		return fmt.Errorf("%w: page %d at level %d is a %s page, want %s", ErrCorrupted, pgno, level, pageTypes[info._type], pageTypes[want])
+	}
+
+	if info._type == C.BT_PAGE_LEAF {
+		v.entries += uint64(info.nkeys)
+	} else if info.nkeys == 0 {
+		return fmt.Errorf("%w: branch page %d is empty", ErrCorrupted, pgno)
+	}
+
+	for i := C.uint(0); i < info.nkeys; i++ {
+		var node C.struct_btree_node_info
+		rc, err := C.btree_page_node(v.tx.bt, pgno, i, &node)
+		if rc != 0 {
+			return v.pageErr(pgno, fmt.Errorf("page node failed: %w", errnoError(err)))
+		}
+		C.btval_reset(&node.key)
+
+		if node.pgno == 0 {
+			continue
+		}
+
+		if err := v.link(pgno, node.pgno); err != nil {
+			return err
+		}
+
+		if info._type == C.BT_PAGE_BRANCH {
+			err = v.page(node.pgno, level+1)
+		} else {
+			err = v.overflow(node.pgno, uint64(node.dsize))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// overflow checks the chain of overflow pages holding a value of size bytes.
+func (v *verifier) overflow(pgno C.uint32_t, size uint64) error {
+	for {
+		info, err := v.tx.pageInfo(pgno)
+		if err != nil {
+			return v.pageErr(pgno, err)
+		}
+
+		if info._type != C.BT_PAGE_OVERFLOW {
+			return fmt.Errorf("%w: page %d is a %s page, want overflow", ErrCorrupted, pgno, pageTypes[info._type])
+		}
+
+		if size <= uint64(info.capacity) {
+			if info.next_pgno != 0 {
+				return fmt.Errorf("%w: overflow page %d continues past the end of its value", ErrCorrupted, pgno)
+			}
+
+			return nil
+		}
+		size -= uint64(info.capacity)
+
+		if info.next_pgno == 0 {
+			return fmt.Errorf("%w: overflow chain ends at page %d, %d bytes short of its value", ErrCorrupted, pgno, size)
+		}
+		if err := v.link(pgno, info.next_pgno); err != nil {
+			return err
+		}
+		pgno = info.next_pgno
+	}
+}
+
+// order checks, with a cursor, that every key sorts after the one before it.
+// This covers the keys of neighbouring leaves as well as those on a page.
+func (v *verifier) order() error {
+	c, err := v.tx.Cursor()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var prev C.struct_btval
+	defer C.btval_reset(&prev)
+
+	for op := C.enum_cursor_op(C.BT_FIRST); ; op = C.BT_NEXT {
+		var key C.struct_btval
+		rc, err := C.btree_cursor_get(c.cursor, &key, nil, op)
+		if rc != 0 {
+			if errors.Is(err, syscall.ENOENT) {
+				return nil
+			}
+
+			return fmt.Errorf("verify failed: %w", errnoError(err))
+		}
+
+		if prev.data != nil && C.btree_cmp(v.tx.bt, &prev, &key) >= 0 {
+			err := fmt.Errorf("%w: key %q doesn't sort after %q", ErrCorrupted, view(&key), view(&prev))
+			C.btval_reset(&key)
+
+			return err
+		}
+
+		C.btval_reset(&prev)
+		prev = key
+	}
+}
+
+// pageErr describes a page that couldn't be read. EINVAL means it isn't a
+// page of any type.
+func (v *verifier) pageErr(pgno C.uint32_t, err error) error {
+	if errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("%w: page %d: %w", ErrCorrupted, pgno, err)
+	}
+
+	return fmt.Errorf("page %d: %w", pgno, err)
+}
@@ -19,15 +19,134 @@ package screwdb_test
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/dpeckett/screwdb/internal/c/screwdb"
+	"github.com/dpeckett/screwdb/internal/c/screwdb/codec"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
+var (
+	fixtureDir   string
+	wordsOnce    sync.Once
+	wordsFixture string
+	wordsErr     error
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	fixtureDir, err = os.MkdirTemp("", "screwdb_test")
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+
+	_ = os.RemoveAll(fixtureDir)
+	os.Exit(code)
+}
+
+// openWordsDB opens a private copy of a database that maps every word in
+// testdata/words.txt to its (little endian uint64) line number.
+func openWordsDB(t *testing.T) *screwdb.DB {
+	wordsOnce.Do(func() {
+		wordsFixture = filepath.Join(fixtureDir, "words.db")
+		wordsErr = loadWords(wordsFixture)
+	})
+	require.NoError(t, wordsErr)
+
+	contents, err := os.ReadFile(wordsFixture)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+	require.NoError(t, os.WriteFile(path, contents, 0o644))
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return db
+}
+
+func loadWords(path string) error {
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.Open("testdata/words.txt")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Each word keeps its line number as its value, but the words are
+	// appended in key order, which is much faster than putting them in file
+	// order.
+	var words [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		words = append(words, []byte(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	order := make([]int, len(words))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return bytes.Compare(words[a], words[b])
+	})
+
+	return db.Update(func(tx *screwdb.Tx) error {
+		for _, i := range order {
+			if err := tx.Append(words[i], wordValue(uint64(i))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func wordValue(i uint64) []byte {
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], i)
+
+	return value[:]
+}
+
 func TestScrewDB(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "screwdb_test.db")
 
@@ -44,7 +163,7 @@ func TestScrewDB(t *testing.T) {
 			var value [8]byte
 			binary.LittleEndian.PutUint64(value[:], i)
 
-			if err := tx.Put([]byte(scanner.Text()), value[:]); err != nil {
+			if err := tx.Put([]byte(scanner.Text()), value[:], true); err != nil {
 				return err
 			}
 		}
@@ -106,3 +225,5111 @@ func TestScrewDB(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, 0, 0o644)
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("hello"), []byte("world"), true)
+	})
+	require.NoError(t, err)
+
+	db.Close()
+
+	// Simulate a commit that was interrupted after some of its pages were
+	// appended, but before the meta page made it to disk.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+
+	_, err = f.Write(make([]byte, 4096))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db, err = screwdb.Open(path, 0, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, "world", string(value))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCursorNextSuffix(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for _, key := range []string{"users/alice", "users/bob", "users/carol"} {
+			if err := tx.Put([]byte(key), []byte(key), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		var suffixes []string
+		for {
+			suffix, value, err := c.NextSuffix(len("users/"))
+			if err != nil {
+				break
+			}
+
+			require.Equal(t, "users/"+string(suffix), string(value))
+			suffixes = append(suffixes, string(suffix))
+		}
+
+		require.Equal(t, []string{"alice", "bob", "carol"}, suffixes)
+
+		_, _, err = c.First()
+		require.NoError(t, err)
+
+		_, _, err = c.NextSuffix(100)
+		require.Error(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestTxAssert(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	balanced := func(tx *screwdb.Tx) bool {
+		a, errA := tx.Get([]byte("a"))
+		b, errB := tx.Get([]byte("b"))
+		return errA == nil && errB == nil && a[0]+b[0] == 10
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		tx.Assert(balanced)
+
+		if err := tx.Put([]byte("a"), []byte{4}, true); err != nil {
+			return err
+		}
+
+		return tx.Put([]byte("b"), []byte{6}, true)
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		tx.Assert(balanced)
+
+		return tx.Put([]byte("a"), []byte{5}, true)
+	})
+	require.ErrorIs(t, err, screwdb.ErrAssertionFailed)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte{4}, value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+
+	path := filepath.Join(dir, "screwdb_test.db")
+
+	db, err := screwdb.Open(path, 0, 0o644)
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("hello"), []byte("world"), true)
+	})
+	require.NoError(t, err)
+
+	db.Close()
+
+	require.NoError(t, os.Chmod(path, 0o444))
+	require.NoError(t, os.Chmod(dir, 0o555))
+	t.Cleanup(func() {
+		_ = os.Chmod(dir, 0o755)
+	})
+
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, "world", string(value))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, screwdb.ReadOnly, db.Flags())
+
+	// Writes are refused before a transaction is begun.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		t.Fatal("update on a read only database")
+		return nil
+	})
+	require.Equal(t, screwdb.ErrReadOnly, err)
+
+	_, err = db.Begin(false)
+	require.Equal(t, screwdb.ErrReadOnly, err)
+	require.Zero(t, db.ActiveTxns())
+
+	require.NoError(t, db.Sync())
+	require.Error(t, db.Compact())
+
+	db.Close()
+
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, before.ModTime(), after.ModTime())
+
+	reread, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, contents, reread)
+
+	// A read only open must not initialize an empty file either.
+	empty := filepath.Join(t.TempDir(), "empty.db")
+	require.NoError(t, os.WriteFile(empty, nil, 0o444))
+
+	_, err = screwdb.Open(empty, screwdb.ReadOnly, 0)
+	require.Error(t, err)
+
+	info, err := os.Stat(empty)
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+}
+
+func TestRangeHashes(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		var keys []string
+		for key, hash := range tx.RangeHashes([]byte("betwit"), []byte("betwixt")) {
+			keys = append(keys, string(key))
+
+			if string(key) == "betwit" {
+				h := fnv.New64a()
+				_, _ = h.Write(wordValue(21629))
+				require.Equal(t, h.Sum64(), hash)
+			}
+		}
+		require.NoError(t, tx.Err())
+
+		require.Equal(t, []string{"betwit", "betwixen"}, keys)
+
+		var n int
+		for range tx.RangeHashes([]byte("zy"), nil) {
+			n++
+		}
+		require.NoError(t, tx.Err())
+		require.NotZero(t, n)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCaseInsensitiveCollation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithCollation(screwdb.CaseInsensitiveASCII))
+	require.NoError(t, err)
+
+	f, err := os.Open("testdata/words.txt")
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Store every other word upper cased, so bytewise and case insensitive
+	// order disagree.
+	words := map[string]string{}
+	err = db.Update(func(tx *screwdb.Tx) error {
+		scanner := bufio.NewScanner(f)
+		for i := 0; scanner.Scan() && i < 20000; i++ {
+			word := scanner.Text()
+			if i%2 == 0 {
+				word = strings.ToUpper(word)
+			}
+
+			if err := tx.Put([]byte(word), []byte(word), true); err != nil {
+				return err
+			}
+			words[strings.ToLower(word)] = word
+		}
+
+		return scanner.Err()
+	})
+	require.NoError(t, err)
+
+	require.Negative(t, db.Compare([]byte("alice"), []byte("BOB")))
+	require.Zero(t, db.Compare([]byte("alice"), []byte("ALICE")))
+
+	require.NoError(t, db.Compact())
+	db.Close()
+
+	// The collation is recorded in the file.
+	db, err = screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		var prev []byte
+		n := 0
+		for {
+			key, _, err := c.Next()
+			if err != nil {
+				break
+			}
+			if prev != nil {
+				require.Negative(t, db.Compare(prev, key), "%q >= %q", prev, key)
+			}
+			prev = key
+			n++
+		}
+		require.Equal(t, len(words), n)
+
+		for lower, word := range words {
+			value, err := tx.Get([]byte(lower))
+			require.NoError(t, err)
+			require.Equal(t, word, string(value))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	binaryPath := filepath.Join(dir, "binary.db")
+
+	binaryDB, err := screwdb.Open(binaryPath, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	binaryDB.Close()
+
+	_, err = screwdb.Open(binaryPath, screwdb.NoSync, 0o644, screwdb.WithCollation(screwdb.CaseInsensitiveASCII))
+	require.Error(t, err)
+}
+
+func TestWalkTree(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("zzz"), make([]byte, 3*4096), true)
+	})
+	require.NoError(t, err)
+
+	seen := map[uint64]bool{}
+	types := map[string]int{}
+	var entries int
+	err = db.WalkTree(func(level int, pageNo uint64, pageType string, n int, fillPct float64) error {
+		require.False(t, seen[pageNo], "page %d visited twice", pageNo)
+		seen[pageNo] = true
+
+		if len(seen) == 1 {
+			require.Equal(t, 0, level)
+			require.Equal(t, "branch", pageType)
+		}
+
+		require.Greater(t, fillPct, 0.0)
+		require.LessOrEqual(t, fillPct, 100.0)
+
+		types[pageType]++
+		if pageType == "leaf" {
+			entries += n
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 235886+1, entries)
+	require.Greater(t, types["branch"], 1)
+	require.GreaterOrEqual(t, types["overflow"], 3)
+
+	stop := errors.New("stop")
+	err = db.WalkTree(func(int, uint64, string, int, float64) error {
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+}
+
+func TestDumpPages(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("key"), []byte("value"), true))
+		return tx.Put([]byte("large"), make([]byte, 3*4096), true)
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, db.DumpPages(&buf))
+
+	dump := buf.String()
+	require.Contains(t, dump, "page 0: head")
+	require.Regexp(t, `page \d+: meta`, dump)
+	require.Regexp(t, `page \d+: leaf, \d+ bytes free, 2 keys`, dump)
+	require.Contains(t, dump, "  \"key\", 5 bytes\n")
+	require.Regexp(t, `  "large", 12288 bytes on overflow page \d+\n`, dump)
+	require.Regexp(t, `page \d+: overflow, 0 bytes free, next page \d+`, dump)
+}
+
+func TestPathIsNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	rel, err := filepath.Rel(wd, path)
+	require.NoError(t, err)
+
+	db, err := screwdb.Open(rel, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	require.True(t, db.IsNew())
+	require.Equal(t, path, db.Path())
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	require.False(t, db.IsNew())
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+	require.False(t, db.IsNew())
+	require.Empty(t, db.Path())
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := screwdb.Open(filepath.Join(dir, "missing", "screwdb_test.db"), 0, 0o644)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	var pathErr *fs.PathError
+	require.ErrorAs(t, err, &pathErr)
+	require.Equal(t, "open", pathErr.Op)
+
+	_, err = screwdb.Open(filepath.Join(dir, "screwdb_test.db"), screwdb.ReadOnly, 0)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks are bypassed when running as root")
+	}
+
+	path := filepath.Join(dir, "locked.db")
+	require.NoError(t, os.WriteFile(path, nil, 0o000))
+
+	_, err = screwdb.Open(path, 0, 0o644)
+	require.ErrorIs(t, err, fs.ErrPermission)
+}
+
+func TestIncrementMany(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("hits"), wordValue(40), true)
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		totals, err := tx.IncrementMany(map[string]int64{"hits": 2, "misses": -3})
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{"hits": 42, "misses": -3}, totals)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("misses"))
+		require.NoError(t, err)
+		require.Equal(t, -3, int(int64(binary.LittleEndian.Uint64(value))))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// A malformed counter must roll back every other delta in the batch.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		if err := tx.Put([]byte("wrong"), []byte("x"), true); err != nil {
+			return err
+		}
+
+		_, err := tx.IncrementMany(map[string]int64{"hits": 1, "wrong": 1})
+		return err
+	})
+	require.Error(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("hits"))
+		require.NoError(t, err)
+		require.Equal(t, wordValue(42), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestIncrement(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 1; i <= 10; i++ {
+		err = db.Update(func(tx *screwdb.Tx) error {
+			total, err := tx.Increment([]byte("hits"), 3)
+			require.NoError(t, err)
+			require.Equal(t, uint64(3*i), total)
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		total, err := tx.Increment([]byte("hits"), -30)
+		require.NoError(t, err)
+		require.Zero(t, total)
+
+		total, err = tx.Increment([]byte("missing"), 5)
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), total)
+
+		value, err := tx.Get([]byte("missing"))
+		require.NoError(t, err)
+		require.Equal(t, wordValue(5), value)
+
+		require.NoError(t, tx.Put([]byte("wrong"), []byte("x"), true))
+		_, err = tx.Increment([]byte("wrong"), 1)
+		require.Error(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestPanicInTxn(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.PanicsWithValue(t, "malformed", func() {
+		_ = db.Update(func(tx *screwdb.Tx) error {
+			require.NoError(t, tx.Put([]byte("key"), []byte("value"), true))
+			panic("malformed")
+		})
+	})
+	require.Zero(t, db.ActiveTxns())
+
+	require.PanicsWithValue(t, "malformed", func() {
+		_ = db.View(func(tx *screwdb.Tx) error {
+			panic("malformed")
+		})
+	})
+	require.Zero(t, db.ActiveTxns())
+
+	// The write lock was released, and the panicking write discarded.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		_, err := tx.Get([]byte("key"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return tx.Put([]byte("other"), []byte("value"), true)
+	})
+	require.NoError(t, err)
+}
+
+func TestViewDuringCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	writer, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	err = writer.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("counter"), wordValue(0), true)
+	})
+	require.NoError(t, err)
+
+	reader, err := screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 1; i <= 500; i++ {
+			err := writer.Update(func(tx *screwdb.Tx) error {
+				// Grow each commit so its pages land in several writes.
+				if err := tx.Put([]byte{byte(i)}, make([]byte, 8192), true); err != nil {
+					return err
+				}
+
+				return tx.Put([]byte("counter"), wordValue(uint64(i)), true)
+			})
+			if err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	var last uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		err := reader.View(func(tx *screwdb.Tx) error {
+			value, err := tx.Get([]byte("counter"))
+			if err != nil {
+				return err
+			}
+
+			current := binary.LittleEndian.Uint64(value)
+			require.GreaterOrEqual(t, current, last)
+			last = current
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, uint64(500), last)
+}
+
+func TestMeta(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SetMeta([]byte("schema_version"), []byte("3")))
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("schema_version"), []byte("user"), true)
+	})
+	require.NoError(t, err)
+
+	value, err := db.GetMeta([]byte("schema_version"))
+	require.NoError(t, err)
+	require.Equal(t, "3", string(value))
+
+	_, err = db.GetMeta([]byte("missing"))
+	require.Error(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		key, value, err := c.First()
+		require.NoError(t, err)
+		require.Equal(t, "schema_version", string(key))
+		require.Equal(t, "user", string(value))
+
+		_, _, err = c.Next()
+		require.Error(t, err)
+
+		var keys []string
+		for key := range tx.RangeHashes(nil, nil) {
+			keys = append(keys, string(key))
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, []string{"schema_version"}, keys)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("\x00\xff\xfe\x00meta/schema_version"), []byte("4"), true)
+	})
+	require.ErrorIs(t, err, screwdb.ErrReservedKey)
+}
+
+func TestEmptyKey(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.ErrorIs(t, db.Put(nil, []byte("value")), screwdb.ErrEmptyKey)
+	_, err = db.Get(nil)
+	require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+
+	for _, key := range [][]byte{nil, {}} {
+		err = db.Update(func(tx *screwdb.Tx) error {
+			require.ErrorIs(t, tx.Put(key, []byte("value"), true), screwdb.ErrEmptyKey)
+			require.ErrorIs(t, tx.Append(key, []byte("value")), screwdb.ErrEmptyKey)
+			_, err := tx.PutReserve(key, 8)
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+			require.ErrorIs(t, tx.PutBatch([][]byte{[]byte("key"), key}, [][]byte{nil, nil}), screwdb.ErrEmptyKey)
+
+			_, err = tx.Get(key)
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+			_, err = tx.GetRef(key)
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+			_, err = tx.GetInto(key, make([]byte, 8))
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+			_, err = tx.Has(key)
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+			_, err = tx.MultiExists([][]byte{key})
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+			_, err = tx.GetMany([][]byte{key})
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+
+			require.ErrorIs(t, tx.Delete(key), screwdb.ErrEmptyKey)
+			_, err = tx.DeleteValue(key)
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+
+			c, err := tx.Cursor()
+			require.NoError(t, err)
+			defer c.Close()
+
+			_, _, err = c.Seek(key)
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+			_, _, err = c.SeekRange(key)
+			require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// Nothing was written by the refused PutBatch.
+	err = db.View(func(tx *screwdb.Tx) error {
+		_, err := tx.Get([]byte("key"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestRange(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		var keys []string
+		for k := range tx.Range([]byte("o"), []byte("p")) {
+			keys = append(keys, string(k))
+		}
+		require.NoError(t, tx.Err())
+		require.Len(t, keys, 7219)
+		require.Equal(t, "o", keys[0])
+		require.True(t, slices.IsSorted(keys))
+		for _, k := range keys {
+			require.True(t, strings.HasPrefix(k, "o"), k)
+		}
+
+		// A nil end continues to the last key.
+		keys = nil
+		for k := range tx.Range([]byte("zythum"), nil) {
+			keys = append(keys, string(k))
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, []string{"zythum"}, keys)
+
+		// Start is inclusive.
+		var values [][]byte
+		for _, v := range tx.Range([]byte("betwit"), []byte("betwixu")) {
+			values = append(values, v)
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, [][]byte{wordValue(21629), wordValue(21630), wordValue(21631)}, values)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The end is compared with the order of the database, not bytewise.
+	numeric, err := screwdb.OpenMemory(0, screwdb.WithCompare(func(a, b []byte) int {
+		na, _ := strconv.Atoi(string(a))
+		nb, _ := strconv.Atoi(string(b))
+		return na - nb
+	}))
+	require.NoError(t, err)
+	defer numeric.Close()
+
+	err = numeric.Update(func(tx *screwdb.Tx) error {
+		for i := range 20 {
+			if err := tx.Put([]byte(strconv.Itoa(i)), nil, true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = numeric.View(func(tx *screwdb.Tx) error {
+		var keys []string
+		for k := range tx.Range([]byte("9"), []byte("12")) {
+			keys = append(keys, string(k))
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, []string{"9", "10", "11"}, keys)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestRangeEmpty(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		for _, tc := range []struct {
+			lo, hi string
+			empty  bool
+		}{
+			{"betwit", "betwixt", false},
+			{"betwitz", "betwixen", true},
+			{"betwixt", "betwixt", true},
+			{"zythum", "", false},
+			{"zythuma", "", true},
+		} {
+			var hi []byte
+			if tc.hi != "" {
+				hi = []byte(tc.hi)
+			}
+
+			empty, err := tx.RangeEmpty([]byte(tc.lo), hi)
+			require.NoError(t, err)
+			require.Equal(t, tc.empty, empty, "[%s, %s)", tc.lo, tc.hi)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestSyncPolicy(t *testing.T) {
+	for name, policy := range map[string]screwdb.SyncPolicy{
+		"EveryN":     screwdb.EveryN(3),
+		"EveryBytes": screwdb.EveryBytes(1024),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+			db, err := screwdb.Open(path, 0, 0o644, screwdb.WithSyncPolicy(policy))
+			require.NoError(t, err)
+
+			for i := uint64(0); i < 10; i++ {
+				err := db.Update(func(tx *screwdb.Tx) error {
+					return tx.Put(wordValue(i), make([]byte, 300), true)
+				})
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, db.Close())
+
+			db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+			require.NoError(t, err)
+			defer db.Close()
+
+			err = db.View(func(tx *screwdb.Tx) error {
+				_, err := tx.Get(wordValue(9))
+				return err
+			})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSetSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, 0, 0o644)
+	require.NoError(t, err)
+
+	db.SetSync(false)
+	require.Equal(t, screwdb.NoSync, db.Flags())
+
+	for i := uint64(0); i < 100; i++ {
+		err := db.Update(func(tx *screwdb.Tx) error {
+			return tx.Put(wordValue(i), wordValue(i), true)
+		})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, db.Sync())
+
+	db.SetSync(true)
+	require.Zero(t, db.Flags())
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put(wordValue(100), wordValue(100), true)
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// A read only database can't have syncing turned on or off.
+	db.SetSync(false)
+	require.Equal(t, screwdb.ReadOnly, db.Flags())
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i <= 100; i++ {
+			value, err := tx.Get(wordValue(i))
+			require.NoError(t, err)
+			require.Equal(t, wordValue(i), value)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCloseWithActiveTxn(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+
+	require.Equal(t, 0, db.ActiveTxns())
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		require.Equal(t, 1, db.ActiveTxns())
+		require.ErrorIs(t, db.Close(), screwdb.ErrTxnInProgress)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 0, db.ActiveTxns())
+	require.NoError(t, db.Close())
+}
+
+func TestCloseTwice(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCompare(bytes.Compare))
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+
+	require.NoError(t, db.Close())
+	require.NoError(t, db.Close())
+
+	_, err = db.Get([]byte("key"))
+	require.ErrorIs(t, err, screwdb.ErrClosed)
+	require.ErrorIs(t, db.Put([]byte("key"), []byte("value")), screwdb.ErrClosed)
+	require.ErrorIs(t, db.Update(func(*screwdb.Tx) error { return nil }), screwdb.ErrClosed)
+	_, err = db.Begin(true)
+	require.ErrorIs(t, err, screwdb.ErrClosed)
+	require.ErrorIs(t, db.Sync(), screwdb.ErrClosed)
+	require.ErrorIs(t, db.Compact(), screwdb.ErrClosed)
+	_, err = db.Stat()
+	require.ErrorIs(t, err, screwdb.ErrClosed)
+}
+
+func TestLeakedTxn(t *testing.T) {
+	pool := screwdb.NewCachePool(1)
+
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCachePool(pool))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+
+	func() {
+		tx, err := db.Begin(false)
+		require.NoError(t, err)
+
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+
+		_, _, err = c.First()
+		require.NoError(t, err)
+	}()
+	require.Equal(t, 1, db.ActiveTxns())
+
+	require.Eventually(t, func() bool {
+		runtime.GC()
+		return db.ActiveTxns() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The write lock and every page the cursor held were released.
+	require.NoError(t, db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("other"), true)
+	}))
+	require.Zero(t, pool.Size())
+}
+
+func TestHistory(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	update := func(fn func(tx *screwdb.Tx) error) {
+		require.NoError(t, db.Update(fn))
+	}
+
+	for _, value := range []string{"v1", "v2", "v2"} {
+		update(func(tx *screwdb.Tx) error {
+			return tx.Put([]byte("key"), []byte(value), true)
+		})
+		update(func(tx *screwdb.Tx) error {
+			return tx.Put([]byte("other"), []byte(value), true)
+		})
+	}
+	update(func(tx *screwdb.Tx) error {
+		return tx.Delete([]byte("key"))
+	})
+	update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("v3"), true)
+	})
+
+	versions, err := db.History([]byte("key"), 10)
+	require.NoError(t, err)
+	require.Equal(t, []screwdb.VersionedValue{
+		{Revision: 8, Value: []byte("v3")},
+		{Revision: 3, Value: []byte("v2")},
+		{Revision: 1, Value: []byte("v1")},
+	}, versions)
+
+	versions, err = db.History([]byte("key"), 2)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	require.Equal(t, uint64(3), versions[1].Revision)
+
+	versions, err = db.History([]byte("missing"), 10)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+}
+
+func TestViewRevision(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+
+	for _, value := range []string{"v0", "v1"} {
+		require.NoError(t, db.Update(func(tx *screwdb.Tx) error {
+			return tx.Put([]byte("key"), []byte(value), true)
+		}))
+	}
+
+	rev, err := db.Revision()
+	require.NoError(t, err)
+
+	require.NoError(t, db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("v2"), true)
+	}))
+
+	current, err := db.Revision()
+	require.NoError(t, err)
+	require.Equal(t, rev+1, current)
+
+	get := func(rev uint64) (value []byte, err error) {
+		err = db.ViewRevision(rev, func(tx *screwdb.Tx) error {
+			value, err = tx.Get([]byte("key"))
+			return err
+		})
+		return value, err
+	}
+
+	value, err := get(rev)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), value)
+
+	value, err = get(current)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+
+	_, err = get(current + 1)
+	require.ErrorIs(t, err, screwdb.ErrRevisionNotFound)
+
+	// Compacting keeps only the latest revision, numbered from 1 again.
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	current, err = db.Revision()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), current)
+
+	_, err = get(rev)
+	require.ErrorIs(t, err, screwdb.ErrRevisionNotFound)
+}
+
+func TestExportSorted(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for _, key := range []string{"b", "a", "c"} {
+			if err := tx.Put([]byte(key), []byte("v"+key), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var buf strings.Builder
+	require.NoError(t, db.ExportSorted(&buf, screwdb.ExportHexCSV))
+	require.Equal(t, "61,7661\n62,7662\n63,7663\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, db.ExportSorted(&buf, screwdb.ExportLengthPrefixed))
+	require.Equal(t, "\x00\x00\x00\x01a\x00\x00\x00\x02va"+
+		"\x00\x00\x00\x01b\x00\x00\x00\x02vb"+
+		"\x00\x00\x00\x01c\x00\x00\x00\x02vc", buf.String())
+}
+
+func TestCSV(t *testing.T) {
+	src := openWordsDB(t)
+
+	var csvBuf bytes.Buffer
+	require.NoError(t, src.ExportCSV(&csvBuf, nil))
+
+	dst, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	require.NoError(t, dst.ImportCSV(bytes.NewReader(csvBuf.Bytes()), nil))
+
+	var want, got bytes.Buffer
+	require.NoError(t, src.Dump(&want))
+	require.NoError(t, dst.Dump(&got))
+	require.Equal(t, want.Bytes(), got.Bytes())
+
+	// With a mapper of our own.
+	csvBuf.Reset()
+	err = src.ExportCSV(&csvBuf, func(k, v []byte) []string {
+		if string(k) != "betwixt" {
+			return []string{string(k), "skipped"}
+		}
+
+		return []string{string(k), strconv.FormatUint(binary.LittleEndian.Uint64(v), 10)}
+	})
+	require.NoError(t, err)
+	require.Contains(t, csvBuf.String(), "\nbetwixt,21631\n")
+
+	// A record that can't be decoded means nothing is imported.
+	empty, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer empty.Close()
+
+	err = empty.ImportCSV(strings.NewReader("YQ==,Yg==\nnot base64,Yg==\n"), nil)
+	require.ErrorContains(t, err, "line 2")
+
+	_, err = empty.Get([]byte("a"))
+	require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+}
+
+func TestBackup(t *testing.T) {
+	db := openWordsDB(t)
+	path := filepath.Join(t.TempDir(), "backup.db")
+
+	require.NoError(t, db.Backup(path))
+
+	backup, err := screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	require.NoError(t, backup.Verify())
+
+	var want, got bytes.Buffer
+	require.NoError(t, db.Dump(&want))
+	require.NoError(t, backup.Dump(&got))
+	require.Equal(t, want.Bytes(), got.Bytes())
+	require.NoError(t, backup.Close())
+
+	// Writes carry on while a backup is taken, and the backup holds a
+	// consistent revision: some run of them from the first, and no more.
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := uint64(0); ; i++ {
+			if i == 1 {
+				close(started)
+			}
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			err := db.Update(func(tx *screwdb.Tx) error {
+				return tx.Put(append([]byte("backup-"), sortedKey(i)...), wordValue(i), true)
+			})
+			assert.NoError(t, err)
+		}
+	}()
+
+	<-started
+	err = db.Backup(path)
+	close(stop)
+	<-done
+	require.NoError(t, err)
+
+	backup, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer backup.Close()
+	require.NoError(t, backup.Verify())
+
+	i := uint64(0)
+	err = backup.View(func(tx *screwdb.Tx) error {
+		return tx.ForEachRange([]byte("backup-"), []byte("backup."), func(key, value []byte) error {
+			require.Equal(t, append([]byte("backup-"), sortedKey(i)...), key)
+			require.Equal(t, wordValue(i), value)
+			i++
+
+			return nil
+		})
+	})
+	require.NoError(t, err)
+
+	stat, err := backup.Stat()
+	require.NoError(t, err)
+	require.Equal(t, uint64(235886)+i, stat.Entries)
+	require.NotZero(t, i)
+}
+
+func TestPing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, 0, 0o644)
+	require.NoError(t, err)
+	require.NoError(t, db.Ping())
+	require.NoError(t, db.Close())
+
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Ping())
+
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestMaxFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithMaxFileSize(64*1024))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var i uint64
+	for ; ; i++ {
+		err = db.Update(func(tx *screwdb.Tx) error {
+			return tx.Put(wordValue(i), make([]byte, 1024), true)
+		})
+		if err != nil {
+			break
+		}
+	}
+	require.ErrorIs(t, err, screwdb.ErrSizeLimitExceeded)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Size(), int64(64*1024))
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		_, err := tx.Get(wordValue(i))
+		require.Error(t, err)
+
+		_, err = tx.Get(wordValue(i - 1))
+		return err
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Delete(wordValue(0))
+	})
+	require.NoError(t, err)
+
+	// As are deletes through a cursor.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		if _, _, err := c.First(); err != nil {
+			return err
+		}
+
+		return c.Delete()
+	})
+	require.NoError(t, err)
+}
+
+func TestPreallocate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+
+	size, err := db.FileSize()
+	require.NoError(t, err)
+
+	stat, err := db.Stat()
+	require.NoError(t, err)
+	require.Less(t, stat.AllocatedBytes, int64(4<<20))
+
+	err = db.Preallocate(4 << 20)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("preallocation isn't supported here")
+	}
+	require.NoError(t, err)
+
+	// The space is reserved, and reported as such, without changing the size
+	// of the file.
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, size, info.Size())
+
+	stat, err = db.Stat()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, stat.AllocatedBytes, int64(4<<20))
+
+	for i := uint64(0); i < 100; i++ {
+		err := db.Update(func(tx *screwdb.Tx) error {
+			return tx.Put(wordValue(i), make([]byte, 1024), true)
+		})
+		require.NoError(t, err)
+	}
+
+	// Preallocating less than the file holds does nothing.
+	require.NoError(t, db.Preallocate(0))
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Verify())
+	require.ErrorIs(t, db.Preallocate(8<<20), screwdb.ErrReadOnly)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i < 100; i++ {
+			_, err := tx.Get(wordValue(i))
+			require.NoError(t, err)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestWriteValueTo(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	large := make([]byte, 5*4096+123)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		if err := tx.Put([]byte("small"), []byte("hello"), true); err != nil {
+			return err
+		}
+
+		return tx.Put([]byte("large"), large, true)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var buf strings.Builder
+		n, err := tx.WriteValueTo([]byte("small"), &buf)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), n)
+		require.Equal(t, "hello", buf.String())
+
+		buf.Reset()
+		n, err = tx.WriteValueTo([]byte("large"), &buf)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(large)), n)
+		require.Equal(t, string(large), buf.String())
+
+		_, err = tx.WriteValueTo([]byte("missing"), &buf)
+		require.Error(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCursorNotFound(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, _, err = c.First()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, _, err = c.Seek([]byte("a"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("a"), []byte("1"), true)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, _, err = c.Seek([]byte("b"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, _, err = c.First()
+		require.NoError(t, err)
+
+		_, _, err = c.Next()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCompactProgress(t *testing.T) {
+	db := openWordsDB(t)
+
+	stat, err := db.Stat()
+	require.NoError(t, err)
+	pages := stat.BranchPages + stat.LeafPages + stat.OverflowPages
+
+	var calls int
+	var last uint64
+	err = db.CompactProgress(func(copied, total uint64) {
+		calls++
+		require.GreaterOrEqual(t, copied, last)
+		require.LessOrEqual(t, copied, total)
+		last = copied
+	})
+	require.NoError(t, err)
+	require.Greater(t, calls, 1)
+	require.Equal(t, pages, last)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("betwixt"))
+		require.NoError(t, err)
+		require.Equal(t, wordValue(21631), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCompactRange(t *testing.T) {
+	db := openWordsDB(t)
+
+	leaves := func() (pages []uint64) {
+		err := db.WalkTree(func(_ int, pageNo uint64, pageType string, _ int, _ float64) error {
+			if pageType == "leaf" {
+				pages = append(pages, pageNo)
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+
+		return pages
+	}
+
+	before := leaves()
+
+	require.NoError(t, db.CompactRange([]byte("betwine"), []byte("bewail")))
+
+	after := leaves()
+	require.Len(t, after, len(before))
+
+	var rewritten int
+	for i := range after {
+		if after[i] != before[i] {
+			rewritten++
+			require.Greater(t, after[i], slices.Max(before))
+		}
+	}
+	require.Positive(t, rewritten)
+	require.Less(t, rewritten, 10)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		for word, i := range map[string]uint64{"betwine": 21628, "betwixt": 21631} {
+			value, err := tx.Get([]byte(word))
+			require.NoError(t, err)
+			require.Equal(t, wordValue(i), value)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestSlice(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		s, err := tx.Slice([]byte("betwine"), []byte("betwixu"))
+		require.NoError(t, err)
+		require.Equal(t, 4, s.Len())
+		require.True(t, sort.IsSorted(s))
+
+		i := sort.Search(s.Len(), func(i int) bool {
+			return string(s.Key(i)) >= "betwixen"
+		})
+		require.Equal(t, "betwixen", string(s.Key(i)))
+
+		value, err := s.Value(i)
+		require.NoError(t, err)
+		require.Equal(t, wordValue(21630), value)
+
+		sort.Sort(sort.Reverse(s))
+		require.Equal(t, "betwixt", string(s.Key(0)))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestGetAndReset(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		_, err := tx.IncrementMany(map[string]int64{"requests": 7})
+		return err
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		prior, err := tx.GetAndReset([]byte("requests"))
+		require.NoError(t, err)
+		require.Equal(t, int64(7), prior)
+
+		prior, err = tx.GetAndReset([]byte("missing"))
+		require.NoError(t, err)
+		require.Zero(t, prior)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		totals, err := tx.IncrementMany(map[string]int64{"requests": 1})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), totals["requests"])
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// A zero-copy read of the counter aliases the page the reset rewrites.
+	zeroCopy, err := screwdb.OpenMemory(0, screwdb.WithZeroCopyReads())
+	require.NoError(t, err)
+	defer zeroCopy.Close()
+
+	err = zeroCopy.Update(func(tx *screwdb.Tx) error {
+		_, err := tx.Increment([]byte("requests"), 5)
+		require.NoError(t, err)
+
+		prior, err := tx.GetAndReset([]byte("requests"))
+		require.NoError(t, err)
+		require.Equal(t, int64(5), prior)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for _, tc := range []struct {
+			expected, value []byte
+			swapped         bool
+			want            string
+		}{
+			// Absent key, expecting absence.
+			{nil, []byte("v1"), true, "v1"},
+			// Present key, expecting absence.
+			{nil, []byte("v2"), false, "v1"},
+			// Present key, expecting a different value.
+			{[]byte("v0"), []byte("v2"), false, "v1"},
+			// Present key, expecting its value.
+			{[]byte("v1"), []byte(""), true, ""},
+			// An empty value isn't the same as absence.
+			{nil, []byte("v3"), false, ""},
+			{[]byte{}, []byte("v3"), true, "v3"},
+		} {
+			swapped, err := tx.CompareAndSwap([]byte("key"), tc.expected, tc.value)
+			require.NoError(t, err)
+			require.Equal(t, tc.swapped, swapped)
+
+			value, err := tx.Get([]byte("key"))
+			require.NoError(t, err)
+			require.Equal(t, tc.want, string(value))
+		}
+
+		// Absent key, expecting a value.
+		swapped, err := tx.CompareAndSwap([]byte("missing"), []byte("v1"), []byte("v2"))
+		require.NoError(t, err)
+		require.False(t, swapped)
+
+		_, err = tx.Get([]byte("missing"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDeleteIf(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("key"), []byte("v1"), true))
+
+		// Present key, expecting a different value.
+		deleted, err := tx.DeleteIf([]byte("key"), []byte("v0"))
+		require.NoError(t, err)
+		require.False(t, deleted)
+
+		value, err := tx.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, "v1", string(value))
+
+		// Present key, expecting its value.
+		deleted, err = tx.DeleteIf([]byte("key"), []byte("v1"))
+		require.NoError(t, err)
+		require.True(t, deleted)
+
+		_, err = tx.Get([]byte("key"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		// Absent key.
+		deleted, err = tx.DeleteIf([]byte("key"), []byte("v1"))
+		require.NoError(t, err)
+		require.False(t, deleted)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestMultiExists(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		exists, err := tx.MultiExists([][]byte{[]byte("betwixt"), []byte("betwixtz"), []byte("aardvark"), []byte("zythum")})
+		require.NoError(t, err)
+		require.Equal(t, []bool{true, false, true, true}, exists)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestRoundTrip(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Keys and values are read in place by the btree, so include ones
+	// sliced out of a larger buffer, an empty value and one stored on
+	// overflow pages.
+	buf := []byte("keyvalue")
+	large := bytes.Repeat([]byte{'x'}, 3*4096+17)
+	entries := map[string][]byte{
+		"key":   []byte("value"),
+		"empty": {},
+		"large": large,
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put(buf[:3], buf[3:], true))
+		require.NoError(t, tx.Put([]byte("empty"), []byte{}, true))
+		require.NoError(t, tx.Put([]byte("large"), large, true))
+
+		// The btree copied them, so they can be reused straight away.
+		copy(buf, "xxxxxxxx")
+		require.NoError(t, tx.Put([]byte("deleted"), buf, true))
+		require.NoError(t, tx.Delete([]byte("deleted")))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		for key, want := range entries {
+			value, err := tx.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, string(want), string(value), key)
+		}
+
+		_, err := tx.Get([]byte("deleted"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestPutReserve(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	small := bytes.Repeat([]byte("small"), 20)
+	large := make([]byte, 3*4096+17)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		value, err := tx.PutReserve([]byte("small"), len(small))
+		require.NoError(t, err)
+		require.Equal(t, make([]byte, len(small)), value)
+		copy(value, small)
+
+		// Filled in place, so visible straight away.
+		got, err := tx.Get([]byte("small"))
+		require.NoError(t, err)
+		require.Equal(t, small, got)
+
+		value, err = tx.PutReserve([]byte("large"), len(large))
+		require.NoError(t, err)
+		copy(value, large)
+
+		value, err = tx.PutReserve([]byte("empty"), 0)
+		require.NoError(t, err)
+		require.Empty(t, value)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		value, err := tx.PutReserve([]byte("aborted"), 10)
+		require.NoError(t, err)
+		copy(value, "aborted")
+
+		return errors.New("abort")
+	})
+	require.Error(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		for key, want := range map[string][]byte{"small": small, "large": large, "empty": {}} {
+			value, err := tx.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, want, value, key)
+		}
+
+		_, err := tx.Get([]byte("aborted"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Verify())
+}
+
+func TestGetInto(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("betwixtz"), bytes.Repeat([]byte{'x'}, 100), true)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		buf := make([]byte, 16)
+
+		for word, i := range map[string]uint64{"betwine": 21628, "betwixt": 21631} {
+			n, err := tx.GetInto([]byte(word), buf)
+			require.NoError(t, err)
+			require.Equal(t, wordValue(i), buf[:n])
+		}
+
+		n, err := tx.GetInto([]byte("betwixtz"), buf)
+		require.ErrorIs(t, err, screwdb.ErrBufferTooSmall)
+		require.Equal(t, 100, n)
+
+		buf = make([]byte, n)
+		n, err = tx.GetInto([]byte("betwixtz"), buf)
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte{'x'}, 100), buf[:n])
+
+		_, err = tx.GetInto([]byte("betwixty"), buf)
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestGetMany(t *testing.T) {
+	db := openWordsDB(t)
+
+	keys := [][]byte{
+		[]byte("zythum"), []byte("betwixtz"), []byte("aardvark"), []byte("betwixt"),
+		[]byte("zzz"), []byte("Aani"), []byte("betwixt"), []byte("0"), []byte("nyxis"),
+	}
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		values, err := tx.GetMany(keys)
+		require.NoError(t, err)
+		require.Len(t, values, len(keys))
+
+		for i, key := range keys {
+			want, err := tx.Get(key)
+			if errors.Is(err, screwdb.ErrKeyNotFound) {
+				require.Nil(t, values[i], string(key))
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, want, values[i], string(key))
+		}
+
+		values, err = tx.GetMany(nil)
+		require.NoError(t, err)
+		require.Empty(t, values)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestTrimToCount(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i < 3000; i++ {
+			if err := tx.Put(binary.BigEndian.AppendUint64(nil, i), wordValue(i), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		deleted, err := tx.TrimToCount(5000)
+		require.NoError(t, err)
+		require.Zero(t, deleted)
+
+		deleted, err = tx.TrimToCount(100)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2900), deleted)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var keys [][]byte
+		for key := range tx.RangeHashes(nil, nil) {
+			keys = append(keys, key)
+		}
+		require.NoError(t, tx.Err())
+		require.Len(t, keys, 100)
+		require.Equal(t, binary.BigEndian.AppendUint64(nil, 2900), keys[0])
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestTxnConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	// Without the lock, so that both handles can write.
+	a, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithoutLock())
+	require.NoError(t, err)
+	defer a.Close()
+
+	b, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithoutLock())
+	require.NoError(t, err)
+	defer b.Close()
+
+	err = a.Update(func(tx *screwdb.Tx) error {
+		err := b.Update(func(tx *screwdb.Tx) error {
+			return tx.Put([]byte("b"), []byte("b"), true)
+		})
+		require.ErrorIs(t, err, screwdb.ErrTxnConflict)
+
+		return tx.Put([]byte("a"), []byte("a"), true)
+	})
+	require.NoError(t, err)
+
+	err = b.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("b"), []byte("b"), true)
+	})
+	require.NoError(t, err)
+}
+
+func TestUpdateRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	// Without the lock, so that both handles can write.
+	a, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithoutLock())
+	require.NoError(t, err)
+	defer a.Close()
+
+	b, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithoutLock())
+	require.NoError(t, err)
+	defer b.Close()
+
+	errBoom := errors.New("boom")
+
+	attempts := 0
+	err = b.UpdateRetry(func(tx *screwdb.Tx) error {
+		attempts++
+		return errBoom
+	}, 5)
+	require.ErrorIs(t, err, errBoom)
+	require.Equal(t, 1, attempts)
+
+	tx, err := a.Begin(false)
+	require.NoError(t, err)
+
+	// Conflicts are retried until out of attempts.
+	attempts = 0
+	err = b.UpdateRetry(func(tx *screwdb.Tx) error {
+		attempts++
+		return nil
+	}, 3)
+	require.ErrorIs(t, err, screwdb.ErrTxnConflict)
+	require.Zero(t, attempts)
+
+	// Or until the other writer is done.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		tx.Abort()
+	}()
+
+	err = b.UpdateRetry(func(tx *screwdb.Tx) error {
+		attempts++
+		return tx.Put([]byte("b"), []byte("b"), true)
+	}, 100)
+	require.NoError(t, err)
+	require.Equal(t, 1, attempts)
+
+	value, err := b.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), value)
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	a, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer a.Close()
+
+	_, err = screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.ErrorIs(t, err, screwdb.ErrLocked)
+
+	// Read only handles don't take the lock.
+	r, err := screwdb.Open(path, screwdb.ReadOnly, 0o644)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	// The lock stays with the file after a compaction.
+	require.NoError(t, a.Compact())
+	require.NoError(t, a.Ping())
+
+	_, err = screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.ErrorIs(t, err, screwdb.ErrLocked)
+
+	require.NoError(t, a.Close())
+
+	b, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	// Nor is there one to take on a database in memory.
+	m, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+}
+
+func TestStreamRange(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		var keys []string
+		err := tx.StreamRange([]byte("betwine"), []byte("betwixt"), func(key, value []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"betwine", "betwit", "betwixen"}, keys)
+
+		gone := errors.New("client gone")
+		keys = nil
+		err = tx.StreamRange([]byte("betwine"), nil, func(key, value []byte) error {
+			keys = append(keys, string(key))
+			if len(keys) == 2 {
+				return gone
+			}
+
+			return nil
+		})
+		require.ErrorIs(t, err, gone)
+		require.Len(t, keys, 2)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestForEach(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		var n int
+		require.NoError(t, tx.ForEach(func(key, value []byte) error {
+			n++
+			return nil
+		}))
+		require.Equal(t, 235886, n)
+
+		// ErrStopIteration stops without an error.
+		var keys []string
+		require.NoError(t, tx.ForEachRange([]byte("betwine"), nil, func(key, value []byte) error {
+			keys = append(keys, string(key))
+			if len(keys) == 3 {
+				return screwdb.ErrStopIteration
+			}
+
+			return nil
+		}))
+		require.Equal(t, []string{"betwine", "betwit", "betwixen"}, keys)
+
+		errBoom := errors.New("boom")
+		n = 0
+		err := tx.ForEach(func(key, value []byte) error {
+			if n++; n == 10 {
+				return errBoom
+			}
+
+			return nil
+		})
+		require.ErrorIs(t, err, errBoom)
+		require.Equal(t, 10, n)
+
+		values := map[string][]byte{}
+		require.NoError(t, tx.ForEachRange([]byte("betwine"), []byte("beudantite"), func(key, value []byte) error {
+			values[string(key)] = value
+			return nil
+		}))
+		require.Len(t, values, 4)
+		require.Equal(t, wordValue(21628), values["betwine"])
+		require.Equal(t, wordValue(21631), values["betwixt"])
+		require.NotContains(t, values, "beudantite")
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCachePool(t *testing.T) {
+	const budget = 64 * 4096
+
+	pool := screwdb.NewCachePool(budget)
+
+	var dbs []*screwdb.DB
+	for i := 0; i < 3; i++ {
+		db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCachePool(pool))
+		require.NoError(t, err)
+		dbs = append(dbs, db)
+
+		err = db.Update(func(tx *screwdb.Tx) error {
+			for j := uint64(0); j < 5000; j++ {
+				if err := tx.Put(wordValue(j), make([]byte, 100), true); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+
+		err = db.View(func(tx *screwdb.Tx) error {
+			_, err := tx.Get(wordValue(42))
+			return err
+		})
+		require.NoError(t, err)
+	}
+
+	require.Positive(t, pool.Size())
+	require.LessOrEqual(t, pool.Size(), uint(budget))
+
+	for _, db := range dbs {
+		require.NoError(t, db.Close())
+	}
+
+	require.Zero(t, pool.Size())
+}
+
+func TestTopBySize(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i < 100; i++ {
+			size := int(i*37%100) * 50
+			if err := tx.Put(wordValue(i), make([]byte, size), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		top, err := tx.TopBySize(3)
+		require.NoError(t, err)
+		require.Len(t, top, 3)
+
+		for i, size := range []int{99 * 50, 98 * 50, 97 * 50} {
+			require.Equal(t, size, top[i].Size)
+
+			value, err := tx.Get(top[i].Key)
+			require.NoError(t, err)
+			require.Len(t, value, size)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestMissingFromSet(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		missing, err := tx.MissingFromSet([]byte("betwi"), map[string]struct{}{
+			"betwine":  {},
+			"betwixt":  {},
+			"elephant": {},
+		})
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("betwit"), []byte("betwixen")}, missing)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCompareMatchesKeyOrder(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		s, err := tx.Slice([]byte("bet"), []byte("bez"))
+		require.NoError(t, err)
+		require.Greater(t, s.Len(), 100)
+
+		for i := 1; i < s.Len(); i++ {
+			require.Negative(t, db.Compare(s.Key(i-1), s.Key(i)))
+			require.Positive(t, db.Compare(s.Key(i), s.Key(i-1)))
+			require.Zero(t, db.Compare(s.Key(i), s.Key(i)))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func BenchmarkCompare(b *testing.B) {
+	db, err := screwdb.Open(filepath.Join(b.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(b, err)
+	defer db.Close()
+
+	x, y := []byte("users/alice/profile"), []byte("users/alice/settings")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = db.Compare(x, y)
+	}
+}
+
+func TestZeroCopyReads(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithZeroCopyReads())
+	require.NoError(t, err)
+	defer db.Close()
+
+	large := make([]byte, 3*4096)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("small"), []byte("hello"), true))
+		require.NoError(t, tx.Put([]byte("large"), large, true))
+
+		// Values read from pages dirtied by this transaction.
+		value, err := tx.Get([]byte("small"))
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(value))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The slices are only valid inside the transaction, so compare them there.
+	err = db.View(func(tx *screwdb.Tx) error {
+		small, err := tx.Get([]byte("small"))
+		require.NoError(t, err)
+
+		value, err := tx.Get([]byte("large"))
+		require.NoError(t, err)
+
+		again, err := tx.Get([]byte("small"))
+		require.NoError(t, err)
+
+		require.Equal(t, "hello", string(small))
+		require.Equal(t, large, value)
+		require.Same(t, &small[0], &again[0])
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestListChildren(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for _, key := range []string{"a", "a/b", "a/b/c", "a/b/d/e", "a/b-x", "a/e", "a/f/g", "b/h"} {
+			if err := tx.Put([]byte(key), []byte(key), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		for prefix, want := range map[string][]string{
+			"":     {"a", "b"},
+			"a/":   {"a/b", "a/b-x", "a/e", "a/f"},
+			"a/b/": {"a/b/c", "a/b/d"},
+			"c/":   nil,
+		} {
+			children, err := tx.ListChildren([]byte(prefix), []byte("/"))
+			require.NoError(t, err)
+
+			var got []string
+			for _, child := range children {
+				got = append(got, string(child))
+			}
+			require.Equal(t, want, got, "children of %q", prefix)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestListChildrenCaseInsensitive(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCollation(screwdb.CaseInsensitiveASCII))
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for _, key := range []string{"A/x", "a/B", "a/b/c", "a/C"} {
+			if err := tx.Put([]byte(key), []byte(key), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Children are matched, ordered and deduplicated the way keys are.
+	err = db.View(func(tx *screwdb.Tx) error {
+		children, err := tx.ListChildren([]byte("a/"), []byte("/"))
+		require.NoError(t, err)
+
+		var got []string
+		for _, child := range children {
+			got = append(got, string(child))
+		}
+		require.Equal(t, []string{"a/B", "a/C", "A/x"}, got)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithCoalesceWindow(time.Hour))
+	require.NoError(t, err)
+
+	for i := uint64(0); i < 100; i++ {
+		require.NoError(t, db.Put([]byte("hot"), wordValue(i)))
+	}
+
+	value, err := db.Get([]byte("hot"))
+	require.NoError(t, err)
+	require.Equal(t, wordValue(99), value)
+
+	// Nothing has been committed yet.
+	err = db.View(func(tx *screwdb.Tx) error {
+		_, err := tx.Get([]byte("hot"))
+		require.Error(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Flush())
+
+	versions, err := db.History([]byte("hot"), 10)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, wordValue(99), versions[0].Value)
+
+	// Close flushes whatever is still buffered.
+	require.NoError(t, db.Put([]byte("cold"), []byte("x")))
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	value, err = db.Get([]byte("cold"))
+	require.NoError(t, err)
+	require.Equal(t, "x", string(value))
+}
+
+func TestCoalesceWindowFlushing(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCoalesceWindow(time.Hour))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put([]byte("hot"), []byte("old")))
+	require.NoError(t, db.Flush())
+
+	// Hold the write lock, so the flush can't commit.
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put([]byte("hot"), []byte("new")))
+
+	flushed := make(chan error)
+	go func() {
+		flushed <- db.Flush()
+	}()
+
+	// The put stays visible while it is being flushed.
+	for deadline := time.Now().Add(50 * time.Millisecond); time.Now().Before(deadline); {
+		value, err := db.Get([]byte("hot"))
+		require.NoError(t, err)
+		require.Equal(t, "new", string(value))
+	}
+
+	require.NoError(t, tx.Abort())
+	require.NoError(t, <-flushed)
+
+	value, err := db.Get([]byte("hot"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(value))
+}
+
+func TestCoalesceWindowInvalid(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCoalesceWindow(time.Hour), screwdb.WithMaxFileSize(64*1024))
+	require.NoError(t, err)
+
+	// A key that could never be committed is refused up front.
+	err = db.Put(bytes.Repeat([]byte("k"), db.MaxKeySize()+1), []byte("x"))
+	require.ErrorIs(t, err, screwdb.ErrKeyTooLarge)
+
+	require.NoError(t, db.Put([]byte("key"), []byte("x")))
+	require.NoError(t, db.Flush())
+
+	// A batch that fails for good is dropped rather than failing every call
+	// after it.
+	require.NoError(t, db.Put([]byte("big"), make([]byte, 128*1024)))
+	require.ErrorIs(t, db.Flush(), screwdb.ErrSizeLimitExceeded)
+
+	_, err = db.Get([]byte("big"))
+	require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("other"), []byte("y"), true)
+	})
+	require.NoError(t, err)
+
+	_, err = db.Stat()
+	require.NoError(t, err)
+
+	// Close releases the handle even when the flush fails.
+	require.NoError(t, db.Put([]byte("big"), make([]byte, 128*1024)))
+	require.ErrorIs(t, db.Close(), screwdb.ErrSizeLimitExceeded)
+	require.NoError(t, db.Close())
+}
+
+func TestCoalesceWindowTimer(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCoalesceWindow(10*time.Millisecond))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put([]byte("key"), []byte("x")))
+
+	// The put is committed once the window passes, without another call.
+	require.Eventually(t, func() bool {
+		err := db.View(func(tx *screwdb.Tx) error {
+			_, err := tx.Get([]byte("key"))
+			return err
+		})
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPutOverwrite(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("first"), false)
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		err := tx.Put([]byte("key"), []byte("second"), false)
+		require.ErrorIs(t, err, syscall.EEXIST)
+		require.ErrorIs(t, err, fs.ErrExist)
+
+		// The failed put leaves the transaction usable.
+		return tx.Put([]byte("other"), []byte("value"), false)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, "first", string(value))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("second"), true)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, "second", string(value))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestGetKeyNotFound(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		_, err := tx.Get([]byte("betwixtz"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, err = tx.WriteValueTo([]byte("betwixtz"), io.Discard)
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, err = tx.Get(nil)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestRegisterExpvar(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Nothing is counted before registering.
+	require.NoError(t, db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("before"), []byte("value"), true)
+	}))
+
+	name := fmt.Sprintf("%s_%p", t.Name(), db)
+	require.NoError(t, db.RegisterExpvar(name))
+	require.Error(t, db.RegisterExpvar(name))
+
+	for i := range uint64(100) {
+		require.NoError(t, db.Update(func(tx *screwdb.Tx) error {
+			return tx.Put(sortedKey(i), wordValue(i), true)
+		}))
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := range uint64(10) {
+			if err := tx.Delete(sortedKey(i)); err != nil {
+				return err
+			}
+		}
+
+		return errors.New("aborted")
+	})
+	require.Error(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Delete(sortedKey(0))
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		for i := range uint64(5) {
+			if _, err := tx.Get(sortedKey(i + 1)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var vars map[string]uint64
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &vars))
+	require.Equal(t, map[string]uint64{
+		"puts":    100,
+		"gets":    5,
+		"deletes": 11,
+		"commits": 101,
+		"aborts":  1,
+		"entries": 100,
+		"depth":   1,
+	}, vars)
+}
+
+func TestLen(t *testing.T) {
+	require.Equal(t, uint64(235886), openWordsDB(t).Len())
+
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Zero(t, db.Len())
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("a"), []byte("1"), true))
+		require.NoError(t, tx.Put([]byte("b"), []byte("2"), true))
+		return tx.Put([]byte("c"), []byte("3"), true)
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), db.Len())
+
+	// An overwrite isn't a new entry.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("b"), []byte("4"), true))
+		require.NoError(t, tx.Delete([]byte("a")))
+		return tx.Put([]byte("d"), []byte("5"), true)
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), db.Len())
+
+	// Nor does an aborted transaction change anything.
+	errAborted := errors.New("aborted")
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("e"), []byte("6"), true))
+		require.NoError(t, tx.Delete([]byte("b")))
+		return errAborted
+	})
+	require.ErrorIs(t, err, errAborted)
+	require.Equal(t, uint64(3), db.Len())
+
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put([]byte("f"), []byte("7"), true))
+	require.Equal(t, uint64(3), db.Len())
+	require.NoError(t, tx.Abort())
+	require.Equal(t, uint64(3), db.Len())
+
+	stat, err := db.Stat()
+	require.NoError(t, err)
+	require.Equal(t, stat.Entries, db.Len())
+}
+
+func TestLenMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+
+	// Metadata is stored as reserved keys, which aren't entries.
+	require.NoError(t, db.SetMeta([]byte("schema"), []byte("1")))
+	require.Zero(t, db.Len())
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("a"), []byte("1"), true)
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.SetMeta([]byte("owner"), []byte("me")))
+
+	check := func() {
+		require.Equal(t, uint64(1), db.Len())
+
+		stat, err := db.Stat()
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), stat.Entries)
+
+		err = db.View(func(tx *screwdb.Tx) error {
+			n, err := tx.CountRange(nil, nil)
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), n)
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	check()
+
+	// Nor are they counted on open.
+	require.NoError(t, db.Close())
+	db, err = screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	check()
+}
+
+// stubTracerProvider records the spans started through it.
+type stubTracerProvider struct {
+	noop.TracerProvider
+	spans []*stubSpan
+}
+
+func (p *stubTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return stubTracer{provider: p}
+}
+
+type stubTracer struct {
+	noop.Tracer
+	provider *stubTracerProvider
+}
+
+func (t stubTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	s := &stubSpan{name: name, parent: trace.SpanFromContext(ctx), attrs: map[attribute.Key]attribute.Value{}}
+	t.provider.spans = append(t.provider.spans, s)
+
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+type stubSpan struct {
+	noop.Span
+	name   string
+	parent trace.Span
+	attrs  map[attribute.Key]attribute.Value
+	err    error
+	status codes.Code
+	ended  bool
+}
+
+func (s *stubSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *stubSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.err = err
+}
+
+func (s *stubSpan) SetStatus(code codes.Code, _ string) {
+	s.status = code
+}
+
+func (s *stubSpan) End(...trace.SpanEndOption) {
+	s.ended = true
+}
+
+func TestTracerProvider(t *testing.T) {
+	tp := &stubTracerProvider{}
+
+	db, err := screwdb.OpenMemory(0, screwdb.WithTracerProvider(tp))
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx, parent := stubTracer{provider: tp}.Start(context.Background(), "parent")
+
+	err = db.UpdateContext(ctx, func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("a"), []byte("1"), true))
+		require.NoError(t, tx.Put([]byte("b"), []byte("2"), true))
+		require.NoError(t, tx.Delete([]byte("a")))
+
+		_, err := tx.Get([]byte("b"))
+		require.NoError(t, err)
+
+		// The span is available to fn through the context.
+		require.Equal(t, tp.spans[1], trace.SpanFromContext(tx.Context()))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, tp.spans, 2)
+	span := tp.spans[1]
+	require.Equal(t, "screwdb.Update", span.name)
+	require.Equal(t, parent, span.parent)
+	require.True(t, span.ended)
+	require.Equal(t, int64(1), span.attrs["screwdb.gets"].AsInt64())
+	require.Equal(t, int64(2), span.attrs["screwdb.puts"].AsInt64())
+	require.Equal(t, int64(1), span.attrs["screwdb.deletes"].AsInt64())
+	require.Equal(t, "committed", span.attrs["screwdb.outcome"].AsString())
+	require.NoError(t, span.err)
+
+	// An Update whose fn fails aborts, and the error is recorded.
+	errFailed := errors.New("failed")
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return errFailed
+	})
+	require.ErrorIs(t, err, errFailed)
+
+	span = tp.spans[2]
+	require.Equal(t, "aborted", span.attrs["screwdb.outcome"].AsString())
+	require.ErrorIs(t, span.err, errFailed)
+	require.Equal(t, codes.Error, span.status)
+
+	// A View records its reads but has no outcome.
+	err = db.View(func(tx *screwdb.Tx) error {
+		_, err := tx.Get([]byte("b"))
+		return err
+	})
+	require.NoError(t, err)
+
+	span = tp.spans[3]
+	require.Equal(t, "screwdb.View", span.name)
+	require.Equal(t, int64(1), span.attrs["screwdb.gets"].AsInt64())
+	require.NotContains(t, span.attrs, attribute.Key("screwdb.outcome"))
+	require.True(t, span.ended)
+}
+
+func TestTracerProviderRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+	tp := &stubTracerProvider{}
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithoutLock(), screwdb.WithTracerProvider(tp), screwdb.WithCoalesceWindow(time.Hour))
+	require.NoError(t, err)
+	defer db.Close()
+
+	other, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithoutLock())
+	require.NoError(t, err)
+	defer other.Close()
+
+	tx, err := other.Begin(false)
+	require.NoError(t, err)
+
+	// Every attempt gets a span of its own.
+	err = db.UpdateRetry(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("a"), []byte("1"), true)
+	}, 2)
+	require.ErrorIs(t, err, screwdb.ErrTxnConflict)
+
+	require.Len(t, tp.spans, 2)
+	for i, span := range tp.spans {
+		require.Equal(t, "screwdb.Update", span.name)
+		require.Equal(t, int64(i+1), span.attrs["screwdb.attempt"].AsInt64())
+		require.ErrorIs(t, span.err, screwdb.ErrTxnConflict)
+		require.True(t, span.ended)
+	}
+
+	require.NoError(t, tx.Abort())
+
+	// As does each flush of buffered puts.
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Flush())
+
+	require.Len(t, tp.spans, 3)
+	span := tp.spans[2]
+	require.Equal(t, "screwdb.Flush", span.name)
+	require.Equal(t, int64(1), span.attrs["screwdb.puts"].AsInt64())
+	require.Equal(t, "committed", span.attrs["screwdb.outcome"].AsString())
+}
+
+func TestStat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+
+	stat, err := db.Stat()
+	require.NoError(t, err)
+	require.Zero(t, stat.Entries)
+	require.Zero(t, stat.Revisions)
+
+	empty, err := db.FileSize()
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := range uint64(1000) {
+			if err := tx.Put([]byte("key"+strconv.Itoa(int(i)+1000)), wordValue(i), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	size, err := db.FileSize()
+	require.NoError(t, err)
+	require.Greater(t, size, empty)
+
+	// Overwrites don't add entries.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := range uint64(100) {
+			if err := tx.Put([]byte("key"+strconv.Itoa(int(i)+1000)), wordValue(i+1), true); err != nil {
+				return err
+			}
+		}
+
+		for i := uint64(900); i < 1000; i++ {
+			if err := tx.Delete([]byte("key" + strconv.Itoa(int(i)+1000))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Nor do aborted transactions.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		if err := tx.Put([]byte("key9999"), wordValue(0), true); err != nil {
+			return err
+		}
+
+		return errors.New("abort")
+	})
+	require.Error(t, err)
+
+	stat, err = db.Stat()
+	require.NoError(t, err)
+	require.Equal(t, uint64(900), stat.Entries)
+	require.Equal(t, uint64(2), stat.Revisions)
+	require.NotZero(t, stat.PageSize)
+	require.Greater(t, stat.Depth, uint(1))
+	require.NotZero(t, stat.BranchPages)
+	require.NotZero(t, stat.LeafPages)
+
+	// The second commit copied pages that the first wrote.
+	require.Positive(t, stat.ReclaimablePages)
+
+	size, err = db.FileSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(stat.FilePages)*int64(stat.PageSize), size)
+
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	stat, err = db.Stat()
+	require.NoError(t, err)
+	require.Equal(t, uint64(900), stat.Entries)
+	require.Zero(t, stat.ReclaimablePages)
+
+	compacted, err := db.FileSize()
+	require.NoError(t, err)
+	require.Less(t, compacted, size)
+}
+
+func TestAutoCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	goroutines := runtime.NumGoroutine()
+
+	require.NoError(t, db.EnableAutoCompact(screwdb.AutoCompactPolicy{
+		Interval:            10 * time.Millisecond,
+		MinReclaimableRatio: 0.5,
+		MinFileSize:         1 << 20,
+	}))
+
+	// Every commit copies the pages it touches, so rewriting the same keys
+	// leaves most of the file reclaimable.
+	for i := range uint64(100) {
+		err = db.Update(func(tx *screwdb.Tx) error {
+			for j := range uint64(100) {
+				if err := tx.Put(wordValue(j), wordValue(i), true); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if errors.Is(err, screwdb.ErrTxnConflict) {
+			// The compaction is in progress.
+			continue
+		}
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		size, err := db.FileSize()
+		require.NoError(t, err)
+
+		return size < 1<<20
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The handle has moved on to the compacted file.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("after"), []byte("compaction"), true)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("after"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("compaction"), value)
+
+		_, err = tx.Get(wordValue(99))
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Close waits for the goroutine to exit. Eventually can't be used to
+	// check, as it runs goroutines of its own.
+	require.NoError(t, db.Close())
+	require.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+
+	require.ErrorIs(t, db.EnableAutoCompact(screwdb.AutoCompactPolicy{Interval: time.Second}), screwdb.ErrClosed)
+}
+
+func TestAutoCompactLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := range uint64(100) {
+		err = db.Update(func(tx *screwdb.Tx) error {
+			return tx.Put([]byte("key"), wordValue(i), true)
+		})
+		require.NoError(t, err)
+	}
+
+	size, err := db.FileSize()
+	require.NoError(t, err)
+
+	require.NoError(t, db.EnableAutoCompact(screwdb.AutoCompactPolicy{
+		Interval:            10 * time.Millisecond,
+		MinReclaimableRatio: 0.5,
+	}))
+
+	require.Eventually(t, func() bool {
+		compacted, err := db.FileSize()
+		require.NoError(t, err)
+
+		return compacted < size
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Let it tick a few more times, then check the compacted file is locked
+	// without anything else having used the handle.
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.ErrorIs(t, err, screwdb.ErrLocked)
+}
+
+func TestCompactThenUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("before"), true)
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Compact())
+
+	// The handle that compacted moves on to the new file too.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("after"), true)
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("after"), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestAutoCompactOpenReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := range uint64(100) {
+		err = db.Update(func(tx *screwdb.Tx) error {
+			for j := range uint64(100) {
+				if err := tx.Put(wordValue(j), wordValue(i), true); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	size, err := db.FileSize()
+	require.NoError(t, err)
+
+	reader, err := db.Begin(true)
+	require.NoError(t, err)
+
+	require.NoError(t, db.EnableAutoCompact(screwdb.AutoCompactPolicy{
+		Interval:            10 * time.Millisecond,
+		MinReclaimableRatio: 0.5,
+	}))
+
+	// The handle moves on to the compacted file while the reader is open.
+	require.Eventually(t, func() bool {
+		compacted, err := db.FileSize()
+		require.NoError(t, err)
+
+		return compacted < size
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put(wordValue(0), []byte("after"), true)
+	})
+	require.NoError(t, err)
+
+	// The reader goes on reading the old file.
+	value, err := reader.Get(wordValue(0))
+	require.NoError(t, err)
+	require.Equal(t, wordValue(99), value)
+	require.NoError(t, reader.Commit())
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get(wordValue(0))
+		require.NoError(t, err)
+		require.Equal(t, []byte("after"), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The write reached the file now at the path.
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get(wordValue(0))
+		require.NoError(t, err)
+		require.Equal(t, []byte("after"), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBeginNested(t *testing.T) {
+	db := openWordsDB(t)
+
+	before, err := db.Stat()
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("nested-parent"), []byte("before"), true))
+		require.NoError(t, tx.Delete([]byte("betwit")))
+
+		nested, err := tx.BeginNested()
+		require.NoError(t, err)
+
+		// Enough puts to split pages the parent has already modified.
+		for i := uint64(0); i < 2000; i++ {
+			require.NoError(t, nested.Put(sortedKey(i), []byte("nested"), true))
+		}
+		require.NoError(t, nested.Put([]byte("nested-parent"), []byte("nested"), true))
+		require.NoError(t, nested.Put([]byte("nested-large"), make([]byte, 3*4096+17), true))
+		require.NoError(t, nested.Delete([]byte("betwine")))
+
+		require.ErrorIs(t, tx.Commit(), screwdb.ErrTxnInProgress)
+		require.NoError(t, nested.Abort())
+		require.ErrorIs(t, nested.Put([]byte("nested-parent"), []byte("nested"), true), screwdb.ErrTxnDone)
+
+		value, err := tx.Get([]byte("nested-parent"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("before"), value)
+
+		value, err = tx.Get([]byte("betwine"))
+		require.NoError(t, err)
+		require.Equal(t, wordValue(21628), value)
+
+		for _, key := range [][]byte{[]byte("betwit"), []byte("nested-large"), sortedKey(0)} {
+			_, err = tx.Get(key)
+			require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+		}
+
+		nested, err = tx.BeginNested()
+		require.NoError(t, err)
+		require.NoError(t, nested.Put([]byte("nested-committed"), []byte("nested"), true))
+
+		inner, err := nested.BeginNested()
+		require.NoError(t, err)
+		require.NoError(t, inner.Put([]byte("nested-aborted"), []byte("inner"), true))
+		require.NoError(t, inner.Abort())
+
+		return nested.Commit()
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		for key, want := range map[string]string{"nested-parent": "before", "nested-committed": "nested"} {
+			value, err := tx.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, []byte(want), value, key)
+		}
+
+		_, err := tx.Get([]byte("nested-aborted"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	after, err := db.Stat()
+	require.NoError(t, err)
+	require.Equal(t, before.Entries+1, after.Entries)
+	require.NoError(t, db.Verify())
+}
+
+func TestSnapshot(t *testing.T) {
+	db := openWordsDB(t)
+
+	snap, err := db.Snapshot()
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		if err := tx.Put([]byte("betwixtz"), []byte("new"), true); err != nil {
+			return err
+		}
+		if err := tx.Put([]byte("betwixt"), []byte("changed"), true); err != nil {
+			return err
+		}
+
+		return tx.Delete([]byte("zythum"))
+	})
+	require.NoError(t, err)
+
+	// None of the writes are visible to the snapshot.
+	_, err = snap.Get([]byte("betwixtz"))
+	require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+	value, err := snap.Get([]byte("betwixt"))
+	require.NoError(t, err)
+	require.Equal(t, wordValue(21631), value)
+
+	ok, err := snap.Has([]byte("zythum"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	c, err := snap.Cursor()
+	require.NoError(t, err)
+
+	key, _, err := c.SeekRange([]byte("betwixt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("betwixt"), key)
+
+	key, _, err = c.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("beudantite"), key)
+	c.Close()
+
+	// The database can't be closed while the snapshot is open.
+	require.ErrorIs(t, db.Close(), screwdb.ErrTxnInProgress)
+
+	require.NoError(t, snap.Close())
+	require.NoError(t, snap.Close())
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get([]byte("betwixtz"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("new"), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestAll(t *testing.T) {
+	pool := screwdb.NewCachePool(1)
+
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCachePool(pool))
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i < 5000; i++ {
+			if err := tx.Put(wordValue(i), wordValue(i*2), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var n int
+		var last []byte
+		for k, v := range tx.All() {
+			require.Negative(t, bytes.Compare(last, k))
+			require.Equal(t, binary.LittleEndian.Uint64(k)*2, binary.LittleEndian.Uint64(v))
+			last = k
+			n++
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, 5000, n)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Zero(t, pool.Size())
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var n int
+		for range tx.All() {
+			if n++; n == 10 {
+				break
+			}
+		}
+		require.NoError(t, tx.Err())
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Pages referenced by an open cursor can't be evicted, so an empty cache
+	// means the cursor was closed when the loop was broken out of.
+	require.Zero(t, pool.Size())
+}
+
+func TestAllReverse(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		var keys, values [][]byte
+		for k, v := range tx.All() {
+			keys = append(keys, k)
+			values = append(values, v)
+		}
+		require.NoError(t, tx.Err())
+
+		var reverseKeys, reverseValues [][]byte
+		for k, v := range tx.AllReverse() {
+			reverseKeys = append(reverseKeys, k)
+			reverseValues = append(reverseValues, v)
+		}
+		require.NoError(t, tx.Err())
+
+		slices.Reverse(reverseKeys)
+		slices.Reverse(reverseValues)
+		require.Len(t, keys, 235886)
+		require.Equal(t, keys, reverseKeys)
+		require.Equal(t, values, reverseValues)
+
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		k, _, err := c.Last()
+		require.NoError(t, err)
+		require.Equal(t, keys[len(keys)-1], k)
+
+		i := slices.IndexFunc(keys, func(k []byte) bool { return string(k) == "betwixt" })
+		_, _, err = c.Seek([]byte("betwixt"))
+		require.NoError(t, err)
+
+		k, v, err := c.Prev()
+		require.NoError(t, err)
+		require.Equal(t, keys[i-1], k)
+		require.Equal(t, values[i-1], v)
+
+		_, _, err = c.First()
+		require.NoError(t, err)
+
+		_, _, err = c.Prev()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, _, err = c.Seek([]byte("beudantite"))
+		require.NoError(t, err)
+		require.NoError(t, c.Delete())
+
+		// The entry before the deleted one.
+		k, _, err := c.Prev()
+		require.NoError(t, err)
+		require.Equal(t, []byte("betwixt"), k)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	pool := screwdb.NewCachePool(1)
+
+	db, err = screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCachePool(pool))
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := range uint64(1000) {
+			if err := tx.Put(sortedKey(i), sortedKey(i), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		i := uint64(1000)
+		for k := range tx.AllReverse() {
+			i--
+			require.Equal(t, sortedKey(i), k)
+			if i == 990 {
+				break
+			}
+		}
+		require.NoError(t, tx.Err())
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The cursor was closed when the loop was broken out of.
+	require.Zero(t, pool.Size())
+}
+
+func TestKeys(t *testing.T) {
+	pool := screwdb.NewCachePool(1)
+
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644, screwdb.WithCachePool(pool))
+	require.NoError(t, err)
+	defer db.Close()
+
+	const n = 1000
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := range uint64(n) {
+			if err := tx.Put(sortedKey(i), make([]byte, 1024), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var i uint64
+		for k := range tx.Keys() {
+			require.Equal(t, sortedKey(i), k)
+			i++
+		}
+		require.NoError(t, tx.Err())
+		require.EqualValues(t, n, i)
+
+		i = 100
+		for k := range tx.KeysRange(sortedKey(100), sortedKey(200)) {
+			require.Equal(t, sortedKey(i), k)
+			i++
+		}
+		require.NoError(t, tx.Err())
+		require.EqualValues(t, 200, i)
+
+		// The 1 KiB values are never copied.
+		allocated := func(fn func()) uint64 {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			fn()
+			runtime.ReadMemStats(&after)
+
+			return after.TotalAlloc - before.TotalAlloc
+		}
+
+		require.Less(t, allocated(func() {
+			for range tx.Keys() {
+			}
+		}), uint64(n*128))
+
+		require.Greater(t, allocated(func() {
+			for range tx.All() {
+			}
+		}), uint64(n*1024))
+
+		for range tx.Keys() {
+			break
+		}
+		require.NoError(t, tx.Err())
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The cursor was closed when the loop was broken out of.
+	require.Zero(t, pool.Size())
+}
+
+func TestSeekRange(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, _, err = c.Seek([]byte("betwi"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		k, v, err := c.SeekRange([]byte("betwi"))
+		require.NoError(t, err)
+		require.Equal(t, "betwine", string(k))
+		require.Equal(t, wordValue(21628), v)
+
+		k, v, err = c.SeekRange([]byte("betwio"))
+		require.NoError(t, err)
+		require.Equal(t, "betwit", string(k))
+		require.Equal(t, wordValue(21629), v)
+
+		k, _, err = c.Next()
+		require.NoError(t, err)
+		require.Equal(t, "betwixen", string(k))
+
+		k, _, err = c.SeekRange([]byte("betwixt"))
+		require.NoError(t, err)
+		require.Equal(t, "betwixt", string(k))
+
+		_, _, err = c.SeekRange([]byte("zythumz"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestSeekFloorCeil(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		k, v, exact, err := c.SeekFloor([]byte("betwix"))
+		require.NoError(t, err)
+		require.Equal(t, "betwit", string(k))
+		require.Equal(t, wordValue(21629), v)
+		require.False(t, exact)
+
+		// The cursor is left on the floor.
+		k, _, err = c.Next()
+		require.NoError(t, err)
+		require.Equal(t, "betwixen", string(k))
+
+		k, _, exact, err = c.SeekFloor([]byte("betwit"))
+		require.NoError(t, err)
+		require.Equal(t, "betwit", string(k))
+		require.True(t, exact)
+
+		k, _, exact, err = c.SeekCeil([]byte("betwix"))
+		require.NoError(t, err)
+		require.Equal(t, "betwixen", string(k))
+		require.False(t, exact)
+
+		k, _, exact, err = c.SeekCeil([]byte("betwixt"))
+		require.NoError(t, err)
+		require.Equal(t, "betwixt", string(k))
+		require.True(t, exact)
+
+		// Past either end.
+		k, _, exact, err = c.SeekFloor([]byte("zythumz"))
+		require.NoError(t, err)
+		require.Equal(t, "zythum", string(k))
+		require.False(t, exact)
+
+		_, _, _, err = c.SeekFloor([]byte("0"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, _, _, err = c.SeekCeil([]byte("zythumz"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDeleteValue(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	large := make([]byte, 3*4096+17)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		if err := tx.Put([]byte("small"), []byte("value"), true); err != nil {
+			return err
+		}
+
+		return tx.Put([]byte("large"), large, true)
+	})
+	require.NoError(t, err)
+
+	var small, gotLarge []byte
+	err = db.Update(func(tx *screwdb.Tx) error {
+		var err error
+		if small, err = tx.DeleteValue([]byte("small")); err != nil {
+			return err
+		}
+
+		if gotLarge, err = tx.DeleteValue([]byte("large")); err != nil {
+			return err
+		}
+
+		value, err := tx.DeleteValue([]byte("small"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+		require.Nil(t, value)
+
+		require.ErrorIs(t, tx.Delete([]byte("missing")), screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Churn the page cache so any memory the values aliased is reused.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i < 1000; i++ {
+			if err := tx.Put(wordValue(i), make([]byte, 100), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []byte("value"), small)
+	require.Equal(t, large, gotLarge)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		_, err := tx.Get([]byte("small"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, err = tx.Get([]byte("large"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCompare(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	// Order decimal keys numerically.
+	numeric := func(a, b []byte) int {
+		na, errA := strconv.Atoi(string(a))
+		nb, errB := strconv.Atoi(string(b))
+		if errA != nil || errB != nil {
+			return bytes.Compare(a, b)
+		}
+
+		return na - nb
+	}
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithCompare(numeric))
+	require.NoError(t, err)
+
+	const n = 5000
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for _, i := range rand.Perm(n) {
+			if err := tx.Put([]byte(strconv.Itoa(i)), wordValue(uint64(i)), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Negative(t, db.Compare([]byte("9"), []byte("10")))
+
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	db, err = screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithCompare(numeric))
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var i int
+		for k, v := range tx.All() {
+			require.Equal(t, strconv.Itoa(i), string(k))
+			require.Equal(t, wordValue(uint64(i)), v)
+			i++
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, n, i)
+
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		k, _, err := c.SeekRange([]byte("999"))
+		require.NoError(t, err)
+		require.Equal(t, "999", string(k))
+
+		k, _, err = c.Next()
+		require.NoError(t, err)
+		require.Equal(t, "1000", string(k))
+
+		v, err := tx.Get([]byte("4321"))
+		require.NoError(t, err)
+		require.Equal(t, wordValue(4321), v)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestOpenMemory(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i < 1000; i++ {
+			if err := tx.Put(wordValue(i), wordValue(i*2), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i < 1000; i++ {
+			v, err := tx.Get(wordValue(i))
+			require.NoError(t, err)
+			require.Equal(t, wordValue(i*2), v)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.NoError(t, db.Close())
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestErrno(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		_, err := tx.Get([]byte("missing"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+		require.ErrorIs(t, tx.Delete([]byte("missing")), screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// A descriptor opened read only makes every write fail with EBADF, even
+	// though the database wasn't opened ReadOnly.
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	db, err = screwdb.OpenFD(f.Fd(), screwdb.NoSync)
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("other"), true)
+	})
+	require.ErrorIs(t, err, screwdb.ErrReadOnly)
+
+	var errno syscall.Errno
+	require.ErrorAs(t, err, &errno)
+	require.Equal(t, syscall.EBADF, errno)
+
+	var leaf uint64
+	err = db.WalkTree(func(_ int, pageNo uint64, pageType string, _ int, _ float64) error {
+		if pageType == "leaf" {
+			leaf = pageNo
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// Overwrite the leaf page holding the key.
+	g, err := os.OpenFile(path, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = g.WriteAt(make([]byte, 4096), int64(leaf)*4096)
+	require.NoError(t, err)
+	require.NoError(t, g.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Get([]byte("key"))
+	require.ErrorIs(t, err, screwdb.ErrCorrupted)
+}
+
+func TestVerify(t *testing.T) {
+	db := openWordsDB(t)
+	require.NoError(t, db.Verify())
+
+	// Deletes rebalance the tree, and large values go on overflow pages.
+	err := db.Update(func(tx *screwdb.Tx) error {
+		if _, err := tx.DeleteRange([]byte("o"), []byte("p")); err != nil {
+			return err
+		}
+
+		return tx.Put([]byte("betwixtz"), make([]byte, 100000), true)
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Verify())
+
+	empty, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer empty.Close()
+	require.NoError(t, empty.Verify())
+
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	db, err = screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithPageSize(4096))
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := range uint64(1000) {
+			if err := tx.Put(sortedKey(i), wordValue(i), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var leaf uint64
+	err = db.WalkTree(func(_ int, pageNo uint64, pageType string, _ int, _ float64) error {
+		if pageType == "leaf" {
+			leaf = pageNo
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 4096), int64(leaf)*4096)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Verify()
+	require.ErrorIs(t, err, screwdb.ErrCorrupted)
+	require.ErrorContains(t, err, fmt.Sprintf("page %d", leaf))
+}
+
+func TestOpenFD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	require.NoError(t, err)
+	defer f.Close()
+
+	db, err := screwdb.OpenFD(f.Fd(), screwdb.NoSync)
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("key"), []byte("value"), true)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		v, err := tx.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), v)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// The caller's descriptor is left open.
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Positive(t, fi.Size())
+	require.NoError(t, f.Close())
+
+	db, err = screwdb.Open(path, screwdb.ReadOnly, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		v, err := tx.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), v)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestHas(t *testing.T) {
+	db, err := screwdb.Open(filepath.Join(t.TempDir(), "screwdb_test.db"), screwdb.NoSync, 0o644)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		ok, err := tx.Has([]byte("key"))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		require.NoError(t, tx.Put([]byte("key"), make([]byte, 10*4096), true))
+
+		ok, err = tx.Has([]byte("key"))
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		require.NoError(t, tx.Delete([]byte("key")))
+
+		ok, err = tx.Has([]byte("key"))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestPutBatch(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	const n = 10000
+
+	keys, values := make([][]byte, n), make([][]byte, n)
+	for i := range keys {
+		keys[i], values[i] = wordValue(uint64(i)), []byte(strconv.Itoa(i))
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.PutBatch(keys, values)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var got int
+		for k, v := range tx.All() {
+			require.Equal(t, strconv.Itoa(int(binary.LittleEndian.Uint64(k))), string(v))
+			got++
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, n, got)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.PutBatch(keys, values[:1])
+	})
+	require.Error(t, err)
+
+	// An empty key is refused.
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.PutBatch([][]byte{[]byte("a"), []byte("b"), {}}, [][]byte{{1}, {2}, {3}})
+	})
+	require.ErrorIs(t, err, screwdb.ErrEmptyKey)
+	require.ErrorContains(t, err, "put 2 failed")
+}
+
+func TestAppend(t *testing.T) {
+	const n = 10000
+
+	load := func(put func(tx *screwdb.Tx, key, value []byte) error) *screwdb.DB {
+		db, err := screwdb.OpenMemory(0)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			db.Close()
+		})
+
+		err = db.Update(func(tx *screwdb.Tx) error {
+			for i := uint64(0); i < n; i++ {
+				if err := put(tx, sortedKey(i), wordValue(i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+
+		return db
+	}
+
+	db := load(func(tx *screwdb.Tx, key, value []byte) error {
+		return tx.Append(key, value)
+	})
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		var i uint64
+		for k, v := range tx.All() {
+			require.Equal(t, sortedKey(i), k)
+			require.Equal(t, wordValue(i), v)
+			i++
+		}
+		require.NoError(t, tx.Err())
+		require.EqualValues(t, n, i)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Appending packs the leaves rather than splitting them in half.
+	appended, err := db.Stat()
+	require.NoError(t, err)
+
+	put, err := load(func(tx *screwdb.Tx, key, value []byte) error {
+		return tx.Put(key, value, true)
+	}).Stat()
+	require.NoError(t, err)
+	require.Less(t, appended.LeafPages, put.LeafPages)
+
+	// Keys that don't sort after the last key are rejected, including the
+	// last key itself.
+	for _, i := range []uint64{0, n / 2, n - 1} {
+		err = db.Update(func(tx *screwdb.Tx) error {
+			return tx.Append(sortedKey(i), nil)
+		})
+		require.ErrorIs(t, err, screwdb.ErrKeyOutOfOrder)
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Append(sortedKey(n), wordValue(n))
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		value, err := tx.Get(sortedKey(n))
+		require.NoError(t, err)
+		require.Equal(t, wordValue(n), value)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func BenchmarkGet(b *testing.B) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(b, err)
+	defer db.Close()
+
+	const n = 1000
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := range uint64(n) {
+			if err := tx.Put(sortedKey(i), wordValue(i), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(b, err)
+
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = sortedKey(uint64(i))
+	}
+
+	b.ReportAllocs()
+	err = db.View(func(tx *screwdb.Tx) error {
+		for i := 0; i < b.N; i++ {
+			if _, err := tx.Get(keys[i%n]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(b, err)
+}
+
+func BenchmarkAll(b *testing.B) {
+	benchmarkScan(b, func(tx *screwdb.Tx) {
+		for range tx.All() {
+		}
+	})
+}
+
+func BenchmarkKeys(b *testing.B) {
+	benchmarkScan(b, func(tx *screwdb.Tx) {
+		for range tx.Keys() {
+		}
+	})
+}
+
+func BenchmarkCursorNext(b *testing.B) {
+	benchmarkScan(b, func(tx *screwdb.Tx) {
+		c, err := tx.Cursor()
+		require.NoError(b, err)
+		defer c.Close()
+
+		for _, _, err = c.First(); err == nil; _, _, err = c.Next() {
+		}
+		require.ErrorIs(b, err, screwdb.ErrKeyNotFound)
+	})
+}
+
+func BenchmarkCursorScan(b *testing.B) {
+	benchmarkScan(b, func(tx *screwdb.Tx) {
+		c, err := tx.Cursor()
+		require.NoError(b, err)
+		defer c.Close()
+
+		for c.Scan() {
+		}
+		require.NoError(b, c.Err())
+	})
+}
+
+// benchmarkScan measures scanning 1000 entries with 1 KiB values.
+func benchmarkScan(b *testing.B, scan func(tx *screwdb.Tx)) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(b, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := range uint64(1000) {
+			if err := tx.Put(sortedKey(i), make([]byte, 1024), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		err = db.View(func(tx *screwdb.Tx) error {
+			scan(tx)
+			return tx.Err()
+		})
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	benchmarkPut(b, wordValue, func(tx *screwdb.Tx, keys, values [][]byte) error {
+		for i := range keys {
+			if err := tx.Put(keys[i], values[i], true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func BenchmarkPutBatch(b *testing.B) {
+	benchmarkPut(b, wordValue, func(tx *screwdb.Tx, keys, values [][]byte) error {
+		return tx.PutBatch(keys, values)
+	})
+}
+
+func BenchmarkPutSorted(b *testing.B) {
+	benchmarkPut(b, sortedKey, func(tx *screwdb.Tx, keys, values [][]byte) error {
+		for i := range keys {
+			if err := tx.Put(keys[i], values[i], true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func BenchmarkAppend(b *testing.B) {
+	benchmarkPut(b, sortedKey, func(tx *screwdb.Tx, keys, values [][]byte) error {
+		for i := range keys {
+			if err := tx.Append(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// sortedKey encodes i so that keys sort in the order of i.
+func sortedKey(i uint64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], i)
+
+	return key[:]
+}
+
+// benchmarkPut measures loading batches of 1000 small entries, one batch per
+// transaction, with the i'th key generated by key.
+func benchmarkPut(b *testing.B, key func(i uint64) []byte, put func(tx *screwdb.Tx, keys, values [][]byte) error) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(b, err)
+	defer db.Close()
+
+	const batchSize = 1000
+
+	keys, values := make([][]byte, batchSize), make([][]byte, batchSize)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := range keys {
+			keys[j], values[j] = key(uint64(i*batchSize+j)), wordValue(uint64(j))
+		}
+
+		err = db.Update(func(tx *screwdb.Tx) error {
+			return put(tx, keys, values)
+		})
+		require.NoError(b, err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	db := openWordsDB(t)
+
+	words, err := os.ReadFile("testdata/words.txt")
+	require.NoError(t, err)
+
+	var want []string
+	var wantValues [][]byte
+	var total int
+	for i, word := range strings.Split(strings.TrimSpace(string(words)), "\n") {
+		if strings.HasPrefix(word, "oxy") {
+			want = append(want, word)
+			wantValues = append(wantValues, wordValue(uint64(i)))
+		}
+		total++
+	}
+	require.Contains(t, want, "oxy")
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var got []string
+		var gotValues [][]byte
+		for k, v := range tx.Prefix([]byte("oxy")) {
+			got = append(got, string(k))
+			gotValues = append(gotValues, v)
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, want, got)
+		require.Equal(t, wantValues, gotValues)
+
+		var n int
+		for range tx.Prefix(nil) {
+			n++
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, total, n)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	db, err = screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for _, key := range []string{"\xfe", "\xfe\xff", "\xff", "\xff\xff", "\xff\xff\x00", "\xff\xff\xff"} {
+			if err := tx.Put([]byte(key), nil, true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var got []string
+		for k := range tx.Prefix([]byte("\xff\xff")) {
+			got = append(got, string(k))
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, []string{"\xff\xff", "\xff\xff\x00", "\xff\xff\xff"}, got)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestTyped(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	counts := screwdb.NewTyped[string, uint64](db, screwdb.StringCodec{}, screwdb.Uint64Codec{})
+
+	want := map[string]uint64{"apple": 3, "banana": 1 << 40, "cherry": 0}
+	for k, v := range want {
+		require.NoError(t, counts.Put(k, v))
+	}
+
+	for k, v := range want {
+		got, err := counts.Get(k)
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+	}
+
+	_, err = counts.Get("durian")
+	require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var keys []string
+		for k, v := range counts.All(tx) {
+			require.Equal(t, want[k], v)
+			keys = append(keys, k)
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, []string{"apple", "banana", "cherry"}, keys)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put([]byte("blueberry"), []byte("corrupt")))
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var keys []string
+		for k := range counts.All(tx) {
+			keys = append(keys, k)
+		}
+		require.Error(t, tx.Err())
+		require.Equal(t, []string{"apple", "banana"}, keys)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestTypedCursor(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	names := screwdb.NewTyped[uint64, string](db, screwdb.Uint64Codec{}, screwdb.StringCodec{})
+	for i, name := range []string{"zero", "one", "two", "three"} {
+		require.NoError(t, names.Put(uint64(i)*10, name))
+	}
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		c, err := names.Cursor(tx)
+		require.NoError(t, err)
+		defer c.Close()
+
+		k, v, err := c.Seek(20)
+		require.NoError(t, err)
+		require.Equal(t, uint64(20), k)
+		require.Equal(t, "two", v)
+
+		k, v, err = c.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(30), k)
+		require.Equal(t, "three", v)
+
+		_, _, err = c.Next()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, _, err = c.Seek(15)
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		k, v, err = c.SeekRange(15)
+		require.NoError(t, err)
+		require.Equal(t, uint64(20), k)
+		require.Equal(t, "two", v)
+
+		k, v, err = c.First()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), k)
+		require.Equal(t, "zero", v)
+
+		var keys []uint64
+		var values []string
+		for k, v := range c.All() {
+			keys = append(keys, k)
+			values = append(values, v)
+		}
+		require.NoError(t, c.Err())
+		require.Equal(t, []uint64{0, 10, 20, 30}, keys)
+		require.Equal(t, []string{"zero", "one", "two", "three"}, values)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// A key too long for Uint64Codec, sorting between 10 and 20.
+	require.NoError(t, db.Put([]byte("\x00\x00\x00\x00\x00\x00\x00\x0a!"), []byte("corrupt")))
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		c, err := names.Cursor(tx)
+		require.NoError(t, err)
+		defer c.Close()
+
+		var keys []uint64
+		for k := range c.All() {
+			keys = append(keys, k)
+		}
+		require.ErrorIs(t, c.Err(), screwdb.ErrDecodeFailed)
+		require.Equal(t, []uint64{0, 10}, keys)
+
+		_, _, err = c.Seek(10)
+		require.NoError(t, err)
+
+		_, _, err = c.Next()
+		require.ErrorIs(t, err, screwdb.ErrDecodeFailed)
+		require.NotErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		k, _, err := c.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(20), k)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCodecs(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	type user struct {
+		Name   string
+		Age    int
+		Emails []string
+	}
+
+	want := user{Name: "ada", Age: 36, Emails: []string{"ada@example.com"}}
+
+	for name, users := range map[string]*screwdb.Typed[uint64, user]{
+		"json": screwdb.NewTyped(db, codec.BigEndianUint64Codec{}, codec.JSONCodec[user]()),
+		"gob":  screwdb.NewTyped(db, codec.BigEndianUint64Codec{}, codec.GobCodec[user]()),
+	} {
+		require.NoError(t, users.Put(1, want), name)
+
+		got, err := users.Get(1)
+		require.NoError(t, err, name)
+		require.Equal(t, want, got, name)
+	}
+
+	// Little-endian keys would come back as 1, 256, 2, 65536.
+	counts := screwdb.NewTyped[uint64, uint64](db, codec.BigEndianUint64Codec{}, codec.BigEndianUint64Codec{})
+	for _, n := range []uint64{65536, 2, 256, 1} {
+		require.NoError(t, counts.Put(n, n))
+	}
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		var keys []uint64
+		for k, v := range counts.All(tx) {
+			require.Equal(t, k, v)
+			keys = append(keys, k)
+		}
+		require.NoError(t, tx.Err())
+		require.Equal(t, []uint64{1, 2, 256, 65536}, keys)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestContext(t *testing.T) {
+	db := openWordsDB(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var n int
+	err := db.ViewContext(ctx, func(tx *screwdb.Tx) error {
+		require.Equal(t, ctx, tx.Context())
+
+		for range tx.All() {
+			if n++; n == 100 {
+				cancel()
+			}
+		}
+
+		return tx.Err()
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 100, n)
+
+	err = db.ViewContext(ctx, func(tx *screwdb.Tx) error {
+		t.Fatal("transaction started with a cancelled context")
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	err = db.UpdateContext(ctx, func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put([]byte("betwixtz"), []byte("value"), true))
+		cancel()
+
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, db.ActiveTxns())
+
+	// The transaction was aborted rather than committed.
+	_, err = db.Get([]byte("betwixtz"))
+	require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		return tx.Put([]byte("betwixtz"), []byte("value"), true)
+	})
+	require.NoError(t, err)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	const writers, readers, updates = 8, 8, 50
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range updates {
+				err := db.Update(func(tx *screwdb.Tx) error {
+					n, err := tx.Get([]byte("count"))
+					if errors.Is(err, screwdb.ErrKeyNotFound) {
+						n = wordValue(0)
+					} else if err != nil {
+						return err
+					}
+
+					if err := tx.Put([]byte("count"), wordValue(binary.LittleEndian.Uint64(n)+1), true); err != nil {
+						return err
+					}
+
+					return tx.Put([]byte(fmt.Sprintf("w/%d/%d", w, i)), make([]byte, 512), true)
+				})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var readersWg sync.WaitGroup
+	for range readers {
+		readersWg.Add(1)
+		go func() {
+			defer readersWg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Each View sees one commit or the next, never a mix.
+				err := db.View(func(tx *screwdb.Tx) error {
+					var want uint64
+					n, err := tx.Get([]byte("count"))
+					if err == nil {
+						want = binary.LittleEndian.Uint64(n)
+					} else if !errors.Is(err, screwdb.ErrKeyNotFound) {
+						return err
+					}
+
+					got, err := tx.CountRange([]byte("w/"), []byte("w0"))
+					if err != nil {
+						return err
+					}
+					assert.Equal(t, want, got)
+
+					return nil
+				})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readersWg.Wait()
+
+	value, err := db.Get([]byte("count"))
+	require.NoError(t, err)
+	require.Equal(t, wordValue(writers*updates), value)
+	require.NoError(t, db.Verify())
+}
+
+func TestBegin(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put([]byte("committed"), []byte("value"), true))
+
+	_, err = db.Begin(false)
+	require.ErrorIs(t, err, screwdb.ErrTxnConflict)
+	require.ErrorIs(t, db.Close(), screwdb.ErrTxnInProgress)
+
+	require.NoError(t, tx.Commit())
+	require.ErrorIs(t, tx.Commit(), screwdb.ErrTxnDone)
+	require.ErrorIs(t, tx.Abort(), screwdb.ErrTxnDone)
+	require.ErrorIs(t, tx.Put([]byte("late"), []byte("value"), true), screwdb.ErrTxnDone)
+
+	tx, err = db.Begin(false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put([]byte("aborted"), []byte("value"), true))
+	require.NoError(t, tx.Abort())
+	require.ErrorIs(t, tx.Abort(), screwdb.ErrTxnDone)
+	require.ErrorIs(t, tx.Commit(), screwdb.ErrTxnDone)
+
+	// A failed commit still finishes the transaction.
+	tx, err = db.Begin(false)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put([]byte("asserted"), []byte("value"), true))
+	tx.Assert(func(*screwdb.Tx) bool { return false })
+	require.ErrorIs(t, tx.Commit(), screwdb.ErrAssertionFailed)
+	require.ErrorIs(t, tx.Abort(), screwdb.ErrTxnDone)
+
+	tx, err = db.Begin(true)
+	require.NoError(t, err)
+
+	v, err := tx.Get([]byte("committed"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), v)
+
+	for _, key := range []string{"aborted", "asserted", "late"} {
+		_, err = tx.Get([]byte(key))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+	}
+
+	require.NoError(t, tx.Commit())
+	_, err = tx.Get([]byte("committed"))
+	require.ErrorIs(t, err, screwdb.ErrTxnDone)
+
+	require.Zero(t, db.ActiveTxns())
+}
+
+func TestCursorCurrent(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, _, err = c.Current()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		k, v, err := c.Seek([]byte("betwit"))
+		require.NoError(t, err)
+
+		for range 2 {
+			ck, cv, err := c.Current()
+			require.NoError(t, err)
+			require.Equal(t, k, ck)
+			require.Equal(t, v, cv)
+		}
+
+		k, v, err = c.Next()
+		require.NoError(t, err)
+		require.Equal(t, "betwixen", string(k))
+
+		ck, cv, err := c.Current()
+		require.NoError(t, err)
+		require.Equal(t, k, ck)
+		require.Equal(t, v, cv)
+
+		_, _, err = c.Seek([]byte("betwixtz"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, _, err = c.Current()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		k, _, err = c.SeekRange([]byte("zythum"))
+		require.NoError(t, err)
+
+		ck, _, err = c.Current()
+		require.NoError(t, err)
+		require.Equal(t, k, ck)
+
+		_, _, err = c.Next()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		_, _, err = c.Current()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCursorScan(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		scanner, err := tx.Cursor()
+		require.NoError(t, err)
+		defer scanner.Close()
+
+		n := 0
+		k, v, err := c.First()
+		for ; err == nil; k, v, err = c.Next() {
+			require.True(t, scanner.Scan())
+			require.Equal(t, k, scanner.Key())
+			require.Equal(t, v, scanner.Value())
+			n++
+		}
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+		require.Equal(t, 235886, n)
+
+		require.False(t, scanner.Scan())
+		require.NoError(t, scanner.Err())
+
+		// Scan carries on from wherever the cursor was positioned.
+		_, _, err = scanner.Seek([]byte("betwine"))
+		require.NoError(t, err)
+		require.True(t, scanner.Scan())
+		require.Equal(t, []byte("betwit"), scanner.Key())
+		require.Equal(t, wordValue(21629), scanner.Value())
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCursorDelete(t *testing.T) {
+	db := openWordsDB(t)
+
+	// Delete every other word starting with b, and the very last word.
+	var want [][]byte
+	err := db.View(func(tx *screwdb.Tx) error {
+		var i int
+		for k := range tx.All() {
+			if k[0] == 'b' {
+				i++
+				if i%2 == 1 {
+					continue
+				}
+			}
+			want = append(want, k)
+		}
+		want = want[:len(want)-1]
+
+		return tx.Err()
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		require.ErrorIs(t, c.Delete(), screwdb.ErrKeyNotFound)
+
+		k, _, err := c.SeekRange([]byte("b"))
+		for i := 0; err == nil && k[0] == 'b'; i++ {
+			if i%2 == 0 {
+				require.NoError(t, c.Delete())
+
+				_, _, err = c.Current()
+				require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+				require.ErrorIs(t, c.Delete(), screwdb.ErrKeyNotFound)
+			}
+
+			k, _, err = c.Next()
+		}
+		require.NoError(t, err)
+		require.Equal(t, "c", string(k[:1]))
+
+		_, _, err = c.SeekRange([]byte("zythum"))
+		require.NoError(t, err)
+		require.NoError(t, c.Delete())
+
+		_, _, err = c.Next()
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		c.Close()
+		require.ErrorIs(t, c.Delete(), syscall.EINVAL)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var keys [][]byte
+	err = db.View(func(tx *screwdb.Tx) error {
+		c, err := tx.Cursor()
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, _, err = c.First()
+		require.NoError(t, err)
+		require.ErrorContains(t, c.Delete(), "cursor delete failed")
+
+		for k := range tx.All() {
+			keys = append(keys, k)
+		}
+
+		return tx.Err()
+	})
+	require.NoError(t, err)
+	require.Equal(t, want, keys)
+
+	stat, err := db.Stat()
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(want)), stat.Entries)
+}
+
+func TestPageSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screwdb_test.db")
+
+	_, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithPageSize(12288))
+	require.Error(t, err)
+
+	db, err := screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithPageSize(16384), screwdb.WithCacheSize(16))
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for i := uint64(0); i < 5000; i++ {
+			if err := tx.Put(wordValue(i), make([]byte, 100), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	stat, err := db.Stat()
+	require.NoError(t, err)
+	require.Equal(t, uint(16384), stat.PageSize)
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	// The page size of an existing database, compacted or not, is kept.
+	db, err = screwdb.Open(path, screwdb.NoSync, 0o644, screwdb.WithPageSize(4096))
+	require.NoError(t, err)
+	defer db.Close()
+
+	stat, err = db.Stat()
+	require.NoError(t, err)
+	require.Equal(t, uint(16384), stat.PageSize)
+	require.Equal(t, uint64(5000), stat.Entries)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		_, err := tx.Get(wordValue(4999))
+		return err
+	})
+	require.NoError(t, err)
+}
+
+func TestGetRef(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	large := make([]byte, 5*4096+7)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		if err := tx.Put([]byte("small"), []byte("hello"), true); err != nil {
+			return err
+		}
+
+		return tx.Put([]byte("large"), large, true)
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		small, err := tx.GetRef([]byte("small"))
+		require.NoError(t, err)
+
+		got, err := tx.GetRef([]byte("large"))
+		require.NoError(t, err)
+
+		// Both stay readable for the rest of the transaction. They must not
+		// be modified, or used once View returns.
+		var n int
+		for range tx.All() {
+			n++
+		}
+		require.Equal(t, 2, n)
+
+		require.Equal(t, []byte("hello"), small)
+		require.Equal(t, large, got)
+
+		_, err = tx.GetRef([]byte("missing"))
+		require.ErrorIs(t, err, screwdb.ErrKeyNotFound)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCountRange(t *testing.T) {
+	db := openWordsDB(t)
+
+	err := db.View(func(tx *screwdb.Tx) error {
+		for _, tt := range []struct {
+			start, end string
+			want       uint64
+		}{
+			{"betwi", "betwj", 4},
+			// Inclusive start, exclusive end.
+			{"betwit", "betwixt", 2},
+			{"betwit", "betwit", 0},
+			{"betwj", "betwi", 0},
+		} {
+			n, err := tx.CountRange([]byte(tt.start), []byte(tt.end))
+			require.NoError(t, err)
+			require.Equal(t, tt.want, n, "[%s, %s)", tt.start, tt.end)
+		}
+
+		n, err := tx.CountRange(nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, uint64(235886), n)
+
+		n, err = tx.CountRange([]byte("zythum"), nil)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), n)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDeleteRange(t *testing.T) {
+	db := openWordsDB(t)
+
+	var total, oWords uint64
+	err := db.View(func(tx *screwdb.Tx) error {
+		var err error
+		if total, err = tx.CountRange(nil, nil); err != nil {
+			return err
+		}
+
+		oWords, err = tx.CountRange([]byte("o"), []byte("p"))
+		return err
+	})
+	require.NoError(t, err)
+	require.Positive(t, oWords)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		n, err := tx.DeleteRange([]byte("o"), []byte("p"))
+		require.NoError(t, err)
+		require.Equal(t, oWords, n)
+
+		n, err = tx.DeleteRange([]byte("o"), []byte("p"))
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *screwdb.Tx) error {
+		n, err := tx.CountRange(nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, total-oWords, n)
+
+		for k := range tx.All() {
+			require.NotEqual(t, byte('o'), k[0])
+		}
+
+		for _, key := range []string{"nyxis", "p", "pa"} {
+			_, err := tx.Get([]byte(key))
+			require.NoError(t, err, key)
+		}
+
+		_, err = tx.DeleteRange(nil, nil)
+		require.Error(t, err)
+
+		return tx.Err()
+	})
+	require.NoError(t, err)
+}
+
+func TestKeyTooLarge(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	max := db.MaxKeySize()
+	require.Positive(t, max)
+
+	err = db.Update(func(tx *screwdb.Tx) error {
+		require.NoError(t, tx.Put(bytes.Repeat([]byte("k"), max), []byte("value"), true))
+
+		err := tx.Put(bytes.Repeat([]byte("k"), max+1), []byte("value"), true)
+		require.ErrorIs(t, err, screwdb.ErrKeyTooLarge)
+		require.ErrorContains(t, err, strconv.Itoa(max+1))
+
+		err = tx.PutBatch([][]byte{[]byte("a"), bytes.Repeat([]byte("k"), max+1)}, [][]byte{nil, nil})
+		require.ErrorIs(t, err, screwdb.ErrKeyTooLarge)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDump(t *testing.T) {
+	db, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var buf bytes.Buffer
+	require.NoError(t, db.Dump(&buf))
+	require.Zero(t, buf.Len())
+
+	want := map[string]string{"a": "1", "b": "", "c": strings.Repeat("x", 300)}
+	err = db.Update(func(tx *screwdb.Tx) error {
+		for k, v := range want {
+			if err := tx.Put([]byte(k), []byte(v), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.SetMeta([]byte("version"), []byte("1")))
+
+	require.NoError(t, db.Dump(&buf))
+
+	r := bufio.NewReader(&buf)
+	readField := func() string {
+		n, err := binary.ReadUvarint(r)
+		require.NoError(t, err)
+
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		require.NoError(t, err)
+
+		return string(b)
+	}
+
+	var keys []string
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		}
+
+		k, v := readField(), readField()
+		require.Equal(t, want[k], v)
+		keys = append(keys, k)
+	}
+	require.Equal(t, []string{"a", "b", "c"}, keys)
+}
+
+func TestLoad(t *testing.T) {
+	src, err := screwdb.OpenMemory(0)
+	require.NoError(t, err)
+	defer src.Close()
+
+	err = src.Update(func(tx *screwdb.Tx) error {
+		for i := 0; i < 1000; i++ {
+			key := []byte("key" + strconv.Itoa(i))
+			if err := tx.Put(key, bytes.Repeat(key, i%10), true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var dump bytes.Buffer
+	require.NoError(t, src.Dump(&dump))
+
+	t.Run("Round Trip", func(t *testing.T) {
+		dst, err := screwdb.OpenMemory(0)
+		require.NoError(t, err)
+		defer dst.Close()
+
+		require.NoError(t, dst.Load(bytes.NewReader(dump.Bytes())))
+
+		var roundTrip bytes.Buffer
+		require.NoError(t, dst.Dump(&roundTrip))
+		require.Equal(t, dump.Bytes(), roundTrip.Bytes())
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		dst, err := screwdb.OpenMemory(0)
+		require.NoError(t, err)
+		defer dst.Close()
+
+		require.NoError(t, dst.Put([]byte("existing"), []byte("value")))
+
+		err = dst.Load(bytes.NewReader(dump.Bytes()[:dump.Len()-1]))
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+		var after bytes.Buffer
+		require.NoError(t, dst.Dump(&after))
+
+		var want bytes.Buffer
+		want.Write([]byte{byte(len("existing"))})
+		want.WriteString("existing")
+		want.Write([]byte{byte(len("value"))})
+		want.WriteString("value")
+		require.Equal(t, want.Bytes(), after.Bytes())
+	})
+}